@@ -82,3 +82,39 @@ func (cnsClient *CNSClient) GetNetworkConfiguration(podName, podNamespace string
 
 	return &resp, nil
 }
+
+// GetIPConfigurations requests the IP configurations of all network containers on the node.
+func (cnsClient *CNSClient) GetIPConfigurations() (*cns.GetIPConfigurationsResponse, error) {
+	httpc := &http.Client{}
+	url := cnsClient.connectionURL + cns.GetIPConfigurations
+	log.Printf("GetIPConfigurations url %v", url)
+
+	res, err := httpc.Get(url)
+	if err != nil {
+		log.Printf("[Azure CNSClient] HTTP Get returned error %v", err.Error())
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		errMsg := fmt.Sprintf("[Azure CNSClient] GetIPConfigurations invalid http status code: %v", res.StatusCode)
+		log.Printf(errMsg)
+		return nil, fmt.Errorf(errMsg)
+	}
+
+	var resp cns.GetIPConfigurationsResponse
+
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		log.Printf("[Azure CNSClient] Error received while parsing GetIPConfigurations response err:%v", err.Error())
+		return nil, err
+	}
+
+	if resp.Response.ReturnCode != 0 {
+		log.Printf("[Azure CNSClient] GetIPConfigurations received error response :%v", resp.Response.Message)
+		return nil, fmt.Errorf(resp.Response.Message)
+	}
+
+	return &resp, nil
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/Azure/azure-container-networking/cni"
 	"github.com/Azure/azure-container-networking/common"
@@ -26,12 +27,14 @@ const (
 
 var (
 	ipv4DefaultRouteDstPrefix = net.IPNet{net.IPv4zero, net.IPv4Mask(0, 0, 0, 0)}
+	ipv6DefaultRouteDstPrefix = net.IPNet{net.IPv6zero, net.CIDRMask(0, 128)}
 )
 
 // IpamPlugin represents the CNI IPAM plugin.
 type ipamPlugin struct {
 	*cni.Plugin
-	am ipam.AddressManager
+	am       ipam.AddressManager
+	lowPools []*ipam.PoolUtilization
 }
 
 // NewPlugin creates a new ipamPlugin object.
@@ -54,6 +57,11 @@ func NewPlugin(config *common.PluginConfig) (*ipamPlugin, error) {
 		am:     am,
 	}
 
+	// Record pools running low on addresses for telemetry.
+	am.SetLowWatermarkHandler(func(pu *ipam.PoolUtilization) {
+		ipamPlg.lowPools = append(ipamPlg.lowPools, pu)
+	})
+
 	config.IpamApi = ipamPlg
 
 	return ipamPlg, nil
@@ -91,6 +99,30 @@ func (plugin *ipamPlugin) Stop() {
 	log.Printf("[cni-ipam] Plugin stopped.")
 }
 
+// GetOrphanedAddresses returns the in-use addresses withdrawn by the address source since the given time.
+func (plugin *ipamPlugin) GetOrphanedAddresses(since time.Time) []string {
+	var addresses []string
+
+	infos, err := plugin.am.ListOrphanedAddresses()
+	if err != nil {
+		log.Printf("[cni-ipam] Failed to list orphaned addresses, err:%v.", err)
+		return nil
+	}
+
+	for _, info := range infos {
+		if info.OrphanedAt.After(since) {
+			addresses = append(addresses, info.Address.String())
+		}
+	}
+
+	return addresses
+}
+
+// GetLowWatermarkPools returns the pools that ran low on addresses since the plugin started.
+func (plugin *ipamPlugin) GetLowWatermarkPools() []*ipam.PoolUtilization {
+	return plugin.lowPools
+}
+
 // Configure parses and applies the given network configuration.
 func (plugin *ipamPlugin) Configure(stdinData []byte) (*cni.NetworkConfig, error) {
 	// Parse network configuration from stdin.
@@ -115,6 +147,42 @@ func (plugin *ipamPlugin) Configure(stdinData []byte) (*cni.NetworkConfig, error
 		plugin.SetOption(common.OptIpamQueryInterval, i)
 	}
 
+	// Set grace period before leaked addresses are reclaimed.
+	if nwCfg.Ipam.ReclaimGracePeriod != "" {
+		i, _ := strconv.Atoi(nwCfg.Ipam.ReclaimGracePeriod)
+		plugin.SetOption(common.OptIpamReclaimGracePeriod, i)
+	}
+
+	// Set cooldown before released addresses are offered again.
+	if nwCfg.Ipam.ReleaseCooldown != "" {
+		i, _ := strconv.Atoi(nwCfg.Ipam.ReleaseCooldown)
+		plugin.SetOption(common.OptIpamReleaseCooldown, i)
+	}
+
+	// Probe addresses for conflicts with other hosts before allocating them.
+	plugin.SetOption(common.OptIpamProbe, nwCfg.Ipam.Probe)
+
+	// Set the address allocation strategy.
+	if nwCfg.Ipam.AllocationStrategy != "" {
+		plugin.SetOption(common.OptIpamAllocationStrategy, nwCfg.Ipam.AllocationStrategy)
+	}
+
+	// Set the percentage of free addresses below which a low watermark event is raised.
+	if nwCfg.Ipam.LowWatermark != "" {
+		i, _ := strconv.Atoi(nwCfg.Ipam.LowWatermark)
+		plugin.SetOption(common.OptIpamLowWatermark, i)
+	}
+
+	// Set the shared store for global address spaces.
+	if nwCfg.Ipam.GlobalStore != "" {
+		plugin.SetOption(common.OptIpamGlobalStore, nwCfg.Ipam.GlobalStore)
+	}
+
+	// Set configuration file for the file environment.
+	if nwCfg.Ipam.ConfigFile != "" {
+		plugin.SetOption(common.OptIpamConfigFile, nwCfg.Ipam.ConfigFile)
+	}
+
 	err = plugin.am.StartSource(plugin.Options)
 	if err != nil {
 		return nil, err
@@ -150,6 +218,13 @@ func (plugin *ipamPlugin) Add(args *cniSkel.CmdArgs) error {
 		return err
 	}
 
+	// Reclaim addresses of containers whose network namespace no longer exists,
+	// since DEL commands for them may never arrive.
+	_, reclaimErr := plugin.am.ReclaimAddresses()
+	if reclaimErr != nil {
+		log.Printf("[cni-ipam] Failed to reclaim addresses, err:%v.", reclaimErr)
+	}
+
 	// Check if an address pool is specified.
 	if nwCfg.Ipam.Subnet == "" {
 		var poolID string
@@ -178,28 +253,55 @@ func (plugin *ipamPlugin) Add(args *cniSkel.CmdArgs) error {
 		log.Printf("[cni-ipam] Allocated address poolID %v with subnet %v.", poolID, subnet)
 	}
 
-	// Allocate an address for the endpoint.
-	address, err := plugin.am.RequestAddress(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, nwCfg.Ipam.Address, nil)
+	// Record the container that owns the address.
+	options := make(map[string]string)
+	options[ipam.OptContainerID] = args.ContainerID
+	options[ipam.OptNetNsPath] = args.Netns
+
+	// Allocate addresses for the endpoint.
+	var addresses []string
+
+	count := 1
+	if nwCfg.Ipam.AddressCount != "" {
+		count, _ = strconv.Atoi(nwCfg.Ipam.AddressCount)
+	}
+
+	if count > 1 && nwCfg.Ipam.Address == "" {
+		// Allocate all addresses at once, so that either all or none are allocated.
+		addresses, err = plugin.am.RequestAddresses(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, count, options)
+	} else {
+		var address string
+		address, err = plugin.am.RequestAddress(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, nwCfg.Ipam.Address, options)
+		addresses = []string{address}
+	}
 	if err != nil {
 		err = plugin.Errorf("Failed to allocate address: %v", err)
 		return err
 	}
 
-	// On failure, release the address.
+	// On failure, release the addresses.
 	defer func() {
-		if err != nil && address != "" {
-			log.Printf("[cni-ipam] Releasing address %v.", address)
-			plugin.am.ReleaseAddress(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, address, nil)
+		if err != nil {
+			for _, address := range addresses {
+				log.Printf("[cni-ipam] Releasing address %v.", address)
+				ipAddress, _, _ := net.ParseCIDR(address)
+				plugin.am.ReleaseAddress(nwCfg.Ipam.AddrSpace, nwCfg.Ipam.Subnet, ipAddress.String(), nil)
+			}
 		}
 	}()
 
-	log.Printf("[cni-ipam] Allocated address %v.", address)
+	log.Printf("[cni-ipam] Allocated addresses %v.", addresses)
 
-	// Parse IP address.
-	ipAddress, err := platform.ConvertStringToIPNet(address)
-	if err != nil {
-		err = plugin.Errorf("Failed to parse address: %v", err)
-		return err
+	// Parse IP addresses.
+	var ipAddresses []*net.IPNet
+	for _, address := range addresses {
+		var ipAddress *net.IPNet
+		ipAddress, err = platform.ConvertStringToIPNet(address)
+		if err != nil {
+			err = plugin.Errorf("Failed to parse address: %v", err)
+			return err
+		}
+		ipAddresses = append(ipAddresses, ipAddress)
 	}
 
 	// Query pool information for gateways and DNS servers.
@@ -209,23 +311,30 @@ func (plugin *ipamPlugin) Add(args *cniSkel.CmdArgs) error {
 		return err
 	}
 
+	version, defaultRouteDstPrefix := "4", ipv4DefaultRouteDstPrefix
+	if apInfo.IsIPv6 {
+		version, defaultRouteDstPrefix = "6", ipv6DefaultRouteDstPrefix
+	}
+
 	// Populate result.
 	result = &cniTypesCurr.Result{
-		IPs: []*cniTypesCurr.IPConfig{
-			{
-				Version: "4",
-				Address: *ipAddress,
-				Gateway: apInfo.Gateway,
-			},
-		},
 		Routes: []*cniTypes.Route{
 			{
-				Dst: ipv4DefaultRouteDstPrefix,
+				Dst: defaultRouteDstPrefix,
 				GW:  apInfo.Gateway,
 			},
 		},
 	}
 
+	// Populate IP addresses.
+	for _, ipAddress := range ipAddresses {
+		result.IPs = append(result.IPs, &cniTypesCurr.IPConfig{
+			Version: version,
+			Address: *ipAddress,
+			Gateway: apInfo.Gateway,
+		})
+	}
+
 	// Populate DNS servers.
 	for _, dnsServer := range apInfo.DnsServers {
 		result.DNS.Nameservers = append(result.DNS.Nameservers, dnsServer.String())
@@ -6,15 +6,42 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/Azure/azure-container-networking/cni"
 	"github.com/Azure/azure-container-networking/cni/ipam"
 	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/telemetry"
+)
+
+const (
+	hostNetAgentURL = "http://169.254.169.254/machine/plugins?comp=netagent&type=cnireport"
+	pluginName      = "CNI"
+	reportType      = "application/json"
 )
 
 // Version is populated by make during build.
 var version string
 
+// Sends a report of IPAM events to hostnetagent.
+func reportIpamEvents(ipamInfo *telemetry.IpamInfo) {
+	reportManager := &telemetry.ReportManager{
+		HostNetAgentURL: hostNetAgentURL,
+		ReportType:      reportType,
+		Report: &telemetry.Report{
+			Name:        pluginName,
+			Version:     version,
+			Context:     "AzureCNIIpam",
+			IpamDetails: ipamInfo,
+		},
+	}
+
+	if err := reportManager.SendReport(); err != nil {
+		log.Printf("SendReport failed due to %v", err)
+	}
+}
+
 // Main is the entry point for CNI IPAM plugin.
 func main() {
 	var config common.PluginConfig
@@ -32,8 +59,28 @@ func main() {
 		os.Exit(1)
 	}
 
+	startTime := time.Now()
+
 	err = ipamPlugin.Execute(cni.PluginApi(ipamPlugin))
 
+	// Report addresses that the address source withdrew while they were in use,
+	// and pools that ran low on addresses.
+	ipamInfo := &telemetry.IpamInfo{
+		OrphanedAddresses: ipamPlugin.GetOrphanedAddresses(startTime),
+	}
+
+	for _, pu := range ipamPlugin.GetLowWatermarkPools() {
+		ipamInfo.LowWatermarkPools = append(ipamInfo.LowWatermarkPools, telemetry.IpamPoolInfo{
+			PoolId:   pu.PoolId,
+			Capacity: pu.Capacity,
+			Free:     pu.Free,
+		})
+	}
+
+	if len(ipamInfo.OrphanedAddresses) > 0 || len(ipamInfo.LowWatermarkPools) > 0 {
+		reportIpamEvents(ipamInfo)
+	}
+
 	ipamPlugin.Stop()
 
 	if err != nil {
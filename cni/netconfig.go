@@ -17,13 +17,22 @@ type NetworkConfig struct {
 	Bridge     string `json:"bridge,omitempty"`
 	LogLevel   string `json:"logLevel,omitempty"`
 	LogTarget  string `json:"logTarget,omitempty"`
+	DryRun     bool   `json:"dryRun,omitempty"`
 	Ipam       struct {
-		Type          string `json:"type"`
-		Environment   string `json:"environment,omitempty"`
-		AddrSpace     string `json:"addressSpace,omitempty"`
-		Subnet        string `json:"subnet,omitempty"`
-		Address       string `json:"ipAddress,omitempty"`
-		QueryInterval string `json:"queryInterval,omitempty"`
+		Type               string `json:"type"`
+		Environment        string `json:"environment,omitempty"`
+		AddrSpace          string `json:"addressSpace,omitempty"`
+		Subnet             string `json:"subnet,omitempty"`
+		Address            string `json:"ipAddress,omitempty"`
+		QueryInterval      string `json:"queryInterval,omitempty"`
+		ConfigFile         string `json:"configFile,omitempty"`
+		ReclaimGracePeriod string `json:"reclaimGracePeriod,omitempty"`
+		ReleaseCooldown    string `json:"releaseCooldown,omitempty"`
+		Probe              bool   `json:"probe,omitempty"`
+		AllocationStrategy string `json:"allocationStrategy,omitempty"`
+		AddressCount       string `json:"addressCount,omitempty"`
+		GlobalStore        string `json:"globalStore,omitempty"`
+		LowWatermark       string `json:"lowWatermark,omitempty"`
 	}
 }
 
@@ -4,7 +4,9 @@
 package network
 
 import (
+	"fmt"
 	"net"
+	"strings"
 
 	"github.com/Azure/azure-container-networking/client/cnsclient"
 	"github.com/Azure/azure-container-networking/cni"
@@ -174,6 +176,134 @@ func getContainerNetworkConfiguration(namespace string, podName string) (*cniTyp
 	return convertToCniResult(networkConfig), networkConfig.MultiTenancyInfo.ID, nil
 }
 
+// collectStaleRules removes bridge rules left behind by endpoints deleted while a plugin crashed,
+// before their addresses are reused. The plugin holds the store lock for the whole command.
+func (plugin *netPlugin) collectStaleRules() {
+	_, err := plugin.nm.CollectStaleRulesIfDue(0, false)
+	if err != nil {
+		log.Printf("[cni-net] Failed to collect stale bridge rules, err:%v.", err)
+	}
+}
+
+// planAdd reports the changes an ADD command would make, without making them.
+// IPAM plugins are not called, so addresses that are not known yet are described but not planned.
+func (plugin *netPlugin) planAdd(nwCfg *cni.NetworkConfig, epInfo *network.EndpointInfo, result *cniTypesCurr.Result) error {
+	var plan []string
+	var masterIfName string
+
+	networkId := nwCfg.Name
+
+	nwInfo, err := plugin.nm.GetNetworkInfo(networkId)
+	if err != nil {
+		var subnetPrefix net.IPNet
+		var gateway net.IP
+
+		// Derive the subnet prefix from the address given by CNS or from the IPAM configuration.
+		if result != nil {
+			subnetPrefix = result.IPs[0].Address
+			subnetPrefix.IP = subnetPrefix.IP.Mask(subnetPrefix.Mask)
+			gateway = result.IPs[0].Gateway
+		} else {
+			plan = append(plan, fmt.Sprintf("Allocate an address pool and an address from IPAM plugin %v.", nwCfg.Ipam.Type))
+
+			if nwCfg.Ipam.Subnet == "" {
+				plan = append(plan,
+					fmt.Sprintf("Create network %v on the interface of the allocated address pool.", networkId),
+					fmt.Sprintf("Create endpoint %v with the allocated address.", epInfo.Id))
+				return plugin.reportPlan(plan)
+			}
+
+			_, prefix, err := net.ParseCIDR(nwCfg.Ipam.Subnet)
+			if err != nil {
+				return plugin.Errorf("Failed to parse subnet %v: %v", nwCfg.Ipam.Subnet, err)
+			}
+			subnetPrefix = *prefix
+		}
+
+		// Find the master interface.
+		masterIfName = plugin.findMasterInterface(nwCfg, &subnetPrefix)
+		if masterIfName == "" {
+			return plugin.Errorf("Failed to find the master interface")
+		}
+
+		nwInfo = &network.NetworkInfo{
+			Id:   networkId,
+			Mode: nwCfg.Mode,
+			Subnets: []network.SubnetInfo{
+				network.SubnetInfo{
+					Family:  platform.AfINET,
+					Prefix:  subnetPrefix,
+					Gateway: gateway,
+				},
+			},
+			BridgeName: nwCfg.Bridge,
+		}
+
+		nwPlan, err := plugin.nm.PlanNetwork(nwInfo, masterIfName)
+		if err != nil {
+			return plugin.Errorf("Failed to plan network: %v", err)
+		}
+
+		plan = append(plan, nwPlan...)
+	} else if result == nil {
+		plan = append(plan, fmt.Sprintf("Allocate an address in subnet %v from IPAM plugin %v.",
+			nwInfo.Subnets[0].Prefix.String(), nwCfg.Ipam.Type))
+	}
+
+	if result != nil {
+		for _, ipconfig := range result.IPs {
+			epInfo.IPAddresses = append(epInfo.IPAddresses, ipconfig.Address)
+		}
+
+		for _, route := range result.Routes {
+			epInfo.Routes = append(epInfo.Routes, network.RouteInfo{Dst: route.Dst, Gw: route.GW})
+		}
+	}
+
+	epPlan, err := plugin.nm.PlanEndpoint(nwInfo, masterIfName, epInfo)
+	if err != nil {
+		return plugin.Errorf("Failed to plan endpoint: %v", err)
+	}
+
+	plan = append(plan, epPlan...)
+
+	return plugin.reportPlan(plan)
+}
+
+// planDelete reports the changes a DEL command would make, without making them.
+func (plugin *netPlugin) planDelete(nwCfg *cni.NetworkConfig, networkId string, endpointId string) error {
+	var plan []string
+
+	epInfo, err := plugin.nm.GetEndpointInfo(networkId, endpointId)
+	if err == nil {
+		plan = append(plan, fmt.Sprintf("Delete endpoint %v from network %v.", endpointId, networkId))
+
+		for _, address := range epInfo.IPAddresses {
+			plan = append(plan, fmt.Sprintf("Release address %v to IPAM plugin %v.", address.IP.String(), nwCfg.Ipam.Type))
+		}
+	}
+
+	return plugin.reportPlan(plan)
+}
+
+// reportPlan logs the changes planned in dry-run mode. The plan is returned as an error,
+// so that the runtime does not treat the container as connected.
+func (plugin *netPlugin) reportPlan(plan []string) error {
+	if len(plan) == 0 {
+		plan = append(plan, "No changes.")
+	}
+
+	for i, step := range plan {
+		log.Printf("[cni-net] [dry-run] %v: %v", i+1, step)
+	}
+
+	return plugin.Error(&types.Error{
+		Code:    100,
+		Msg:     "Dry-run mode, no changes were made",
+		Details: strings.Join(plan, " "),
+	})
+}
+
 //
 // CNI implementation
 // https://github.com/containernetworking/cni/blob/master/SPEC.md
@@ -200,6 +330,10 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 
 	log.Printf("[cni-net] Read network configuration %+v.", nwCfg)
 
+	if !nwCfg.DryRun {
+		plugin.collectStaleRules()
+	}
+
 	// Initialize values from network config.
 	networkId := nwCfg.Name
 	endpointId := plugin.GetEndpointID(args)
@@ -226,6 +360,12 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 		epInfo.Data["vlanid"] = vlanid
 	}
 
+	// Report the planned changes instead of making them in dry-run mode.
+	if nwCfg.DryRun {
+		err = plugin.planAdd(nwCfg, epInfo, result)
+		return err
+	}
+
 	// Check whether the network already exists.
 	nwInfo, err := plugin.nm.GetNetworkInfo(networkId)
 	if err != nil {
@@ -245,12 +385,14 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 		subnetPrefix := ipconfig.Address
 		subnetPrefix.IP = subnetPrefix.IP.Mask(subnetPrefix.Mask)
 
-		// On failure, call into IPAM plugin to release the address and address pool.
+		// On failure, call into IPAM plugin to release the addresses and address pool.
 		defer func() {
 			if err != nil {
 				nwCfg.Ipam.Subnet = subnetPrefix.String()
-				nwCfg.Ipam.Address = ipconfig.Address.IP.String()
-				plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+				for _, ipconfig := range result.IPs {
+					nwCfg.Ipam.Address = ipconfig.Address.IP.String()
+					plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+				}
 
 				nwCfg.Ipam.Address = ""
 				plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
@@ -307,13 +449,13 @@ func (plugin *netPlugin) Add(args *cniSkel.CmdArgs) error {
 				return err
 			}
 
-			ipconfig := result.IPs[0]
-
-			// On failure, call into IPAM plugin to release the address.
+			// On failure, call into IPAM plugin to release the addresses.
 			defer func() {
 				if err != nil {
-					nwCfg.Ipam.Address = ipconfig.Address.IP.String()
-					plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+					for _, ipconfig := range result.IPs {
+						nwCfg.Ipam.Address = ipconfig.Address.IP.String()
+						plugin.DelegateDel(nwCfg.Ipam.Type, nwCfg)
+					}
 				}
 			}()
 		}
@@ -382,6 +524,14 @@ func (plugin *netPlugin) Delete(args *cniSkel.CmdArgs) error {
 	networkId := nwCfg.Name
 	endpointId := plugin.GetEndpointID(args)
 
+	// Report the planned changes instead of making them in dry-run mode.
+	if nwCfg.DryRun {
+		err = plugin.planDelete(nwCfg, networkId, endpointId)
+		return err
+	}
+
+	plugin.collectStaleRules()
+
 	// Query the network.
 	nwInfo, err := plugin.nm.GetNetworkInfo(networkId)
 	if err != nil {
@@ -56,8 +56,9 @@ func (plugin *Plugin) Initialize(config *common.PluginConfig) error {
 	// Initialize store.
 	if plugin.Store == nil {
 		// Create the key value store.
+		// The store is created before the network configuration is read, so CNI always uses JSON files.
 		var err error
-		plugin.Store, err = store.NewJsonFileStore(platform.CNIRuntimePath + plugin.Name + ".json")
+		plugin.Store, err = store.NewStore(store.BackendJson, platform.CNIRuntimePath+plugin.Name)
 		if err != nil {
 			log.Printf("[cni] Failed to create store, err:%v.", err)
 			return err
@@ -16,6 +16,13 @@ const (
 	RequestAddressPath   = "/IpamDriver.RequestAddress"
 	ReleaseAddressPath   = "/IpamDriver.ReleaseAddress"
 
+	// Debug API paths for auditing address allocations
+	ListAddressesPath      = "/IpamDriver.ListAddresses"
+	FindAddressPath        = "/IpamDriver.FindAddress"
+	FindAddressByOwnerPath = "/IpamDriver.FindAddressByOwner"
+	ListOrphansPath        = "/IpamDriver.ListOrphanedAddresses"
+	GetUtilizationPath     = "/IpamDriver.GetUtilization"
+
 	// Libnetwork IPAM plugin options
 	OptAddressType        = "RequestAddressType"
 	OptAddressTypeGateway = "com.docker.network.gateway"
@@ -81,6 +88,7 @@ type GetPoolInfoResponse struct {
 	Capacity           int
 	Available          int
 	UnhealthyAddresses []string
+	Exclusions         []string
 }
 
 // Request sent by libnetwork when reserving an address from a pool.
@@ -108,3 +116,92 @@ type ReleaseAddressRequest struct {
 type ReleaseAddressResponse struct {
 	Err string
 }
+
+// Information about an address returned by debug requests.
+type AddressInfo struct {
+	Address     string
+	PoolID      string
+	InUse       bool
+	OwnerID     string
+	ContainerID string
+	NetNsPath   string
+	AllocatedAt string
+	ReleasedAt  string
+	OrphanedAt  string
+	Healthy     bool
+	Epoch       int
+}
+
+// Request sent when listing the addresses in a pool.
+type ListAddressesRequest struct {
+	PoolID string
+}
+
+// Response sent by plugin when returning the addresses in a pool.
+type ListAddressesResponse struct {
+	Err       string
+	Addresses []AddressInfo
+}
+
+// Request sent when looking up an address.
+type FindAddressRequest struct {
+	Address string
+}
+
+// Response sent by plugin when returning information about an address.
+type FindAddressResponse struct {
+	Err     string
+	Address AddressInfo
+}
+
+// Request sent when looking up the addresses of an owner.
+type FindAddressByOwnerRequest struct {
+	OwnerID string
+}
+
+// Response sent by plugin when returning the addresses of an owner.
+type FindAddressByOwnerResponse struct {
+	Err       string
+	Addresses []AddressInfo
+}
+
+// Request sent when listing in-use addresses withdrawn by the address source.
+type ListOrphansRequest struct {
+}
+
+// Response sent by plugin when returning in-use addresses withdrawn by the address source.
+type ListOrphansResponse struct {
+	Err       string
+	Addresses []AddressInfo
+}
+
+// Utilization of an address pool returned by debug requests.
+type PoolUtilization struct {
+	PoolID      string
+	Capacity    int
+	InUse       int
+	Free        int
+	Unhealthy   int
+	Quarantined int
+	Excluded    int
+	Allocations uint64
+	Failures    uint64
+}
+
+// Request sent when querying the utilization of all address pools.
+type GetUtilizationRequest struct {
+}
+
+// Response sent by plugin when returning the utilization of all address pools.
+type GetUtilizationResponse struct {
+	Err         string
+	Capacity    int
+	InUse       int
+	Free        int
+	Unhealthy   int
+	Quarantined int
+	Excluded    int
+	Allocations uint64
+	Failures    uint64
+	Pools       []PoolUtilization
+}
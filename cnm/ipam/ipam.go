@@ -5,6 +5,7 @@ package ipam
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/Azure/azure-container-networking/cnm"
 	"github.com/Azure/azure-container-networking/common"
@@ -69,6 +70,21 @@ func (plugin *ipamPlugin) Start(config *common.PluginConfig) error {
 		return err
 	}
 
+	// Addresses are not reclaimed, because CNM does not record the network namespace
+	// of their owners and whether an owner still exists cannot be determined.
+
+	// Start probing free addresses for conflicts with other hosts.
+	plugin.am.StartProber(0)
+
+	// Reload state changed by other processes sharing the CNM store, such as CNS hosting the CNM
+	// plugins. The CNI plugins keep their state in a separate store under CNIRuntimePath, which no
+	// daemon shares, so state written by CNI is not reloaded here.
+	err = plugin.am.StartStoreWatcher()
+	if err != nil {
+		log.Printf("[ipam] Failed to start store watcher, err:%v.", err)
+		return err
+	}
+
 	// Add protocol handlers.
 	listener := plugin.Listener
 	listener.AddEndpoint(plugin.EndpointType)
@@ -79,6 +95,11 @@ func (plugin *ipamPlugin) Start(config *common.PluginConfig) error {
 	listener.AddHandler(GetPoolInfoPath, plugin.getPoolInfo)
 	listener.AddHandler(RequestAddressPath, plugin.requestAddress)
 	listener.AddHandler(ReleaseAddressPath, plugin.releaseAddress)
+	listener.AddHandler(ListAddressesPath, plugin.listAddresses)
+	listener.AddHandler(FindAddressPath, plugin.findAddress)
+	listener.AddHandler(FindAddressByOwnerPath, plugin.findAddressByOwner)
+	listener.AddHandler(ListOrphansPath, plugin.listOrphans)
+	listener.AddHandler(GetUtilizationPath, plugin.getUtilization)
 
 	// Plugin is ready to be discovered.
 	err = plugin.EnableDiscovery()
@@ -224,8 +245,9 @@ func (plugin *ipamPlugin) getPoolInfo(w http.ResponseWriter, r *http.Request) {
 
 	// Encode response.
 	resp := GetPoolInfoResponse{
-		Capacity:  apInfo.Capacity,
-		Available: apInfo.Available,
+		Capacity:   apInfo.Capacity,
+		Available:  apInfo.Available,
+		Exclusions: apInfo.Exclusions,
 	}
 
 	for _, addr := range apInfo.UnhealthyAddrs {
@@ -309,3 +331,201 @@ func (plugin *ipamPlugin) releaseAddress(w http.ResponseWriter, r *http.Request)
 
 	log.Response(plugin.Name, &resp, err)
 }
+
+// Handles ListAddresses requests.
+func (plugin *ipamPlugin) listAddresses(w http.ResponseWriter, r *http.Request) {
+	var req ListAddressesRequest
+
+	// Decode request.
+	err := plugin.Listener.Decode(w, r, &req)
+	log.Request(plugin.Name, &req, err)
+	if err != nil {
+		return
+	}
+
+	// Process request.
+	poolId, err := ipam.NewAddressPoolIdFromString(req.PoolID)
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	infos, err := plugin.am.ListAddresses(poolId.AsId, poolId.Subnet)
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response.
+	resp := ListAddressesResponse{Addresses: newAddressInfos(infos)}
+
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Response(plugin.Name, &resp, err)
+}
+
+// Handles FindAddress requests.
+func (plugin *ipamPlugin) findAddress(w http.ResponseWriter, r *http.Request) {
+	var req FindAddressRequest
+
+	// Decode request.
+	err := plugin.Listener.Decode(w, r, &req)
+	log.Request(plugin.Name, &req, err)
+	if err != nil {
+		return
+	}
+
+	// Process request.
+	info, err := plugin.am.FindAddress(req.Address)
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response.
+	resp := FindAddressResponse{Address: newAddressInfo(info)}
+
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Response(plugin.Name, &resp, err)
+}
+
+// Handles FindAddressByOwner requests.
+func (plugin *ipamPlugin) findAddressByOwner(w http.ResponseWriter, r *http.Request) {
+	var req FindAddressByOwnerRequest
+
+	// Decode request.
+	err := plugin.Listener.Decode(w, r, &req)
+	log.Request(plugin.Name, &req, err)
+	if err != nil {
+		return
+	}
+
+	// Process request.
+	infos, err := plugin.am.FindAddressByOwner(req.OwnerID)
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response.
+	resp := FindAddressByOwnerResponse{Addresses: newAddressInfos(infos)}
+
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Response(plugin.Name, &resp, err)
+}
+
+// Handles ListOrphanedAddresses requests.
+func (plugin *ipamPlugin) listOrphans(w http.ResponseWriter, r *http.Request) {
+	var req ListOrphansRequest
+
+	// Decode request.
+	err := plugin.Listener.Decode(w, r, &req)
+	log.Request(plugin.Name, &req, err)
+	if err != nil {
+		return
+	}
+
+	// Process request.
+	infos, err := plugin.am.ListOrphanedAddresses()
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response.
+	resp := ListOrphansResponse{Addresses: newAddressInfos(infos)}
+
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Response(plugin.Name, &resp, err)
+}
+
+// Handles GetUtilization requests.
+func (plugin *ipamPlugin) getUtilization(w http.ResponseWriter, r *http.Request) {
+	var req GetUtilizationRequest
+
+	// Decode request.
+	err := plugin.Listener.Decode(w, r, &req)
+	log.Request(plugin.Name, &req, err)
+	if err != nil {
+		return
+	}
+
+	// Process request.
+	u, err := plugin.am.GetUtilization()
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	// Encode response.
+	resp := GetUtilizationResponse{
+		Capacity:    u.Capacity,
+		InUse:       u.InUse,
+		Free:        u.Free,
+		Unhealthy:   u.Unhealthy,
+		Quarantined: u.Quarantined,
+		Excluded:    u.Excluded,
+		Allocations: u.Allocations,
+		Failures:    u.Failures,
+	}
+
+	for _, pu := range u.Pools {
+		resp.Pools = append(resp.Pools, PoolUtilization{
+			PoolID:      ipam.NewAddressPoolId(pu.AsId, pu.PoolId, "").String(),
+			Capacity:    pu.Capacity,
+			InUse:       pu.InUse,
+			Free:        pu.Free,
+			Unhealthy:   pu.Unhealthy,
+			Quarantined: pu.Quarantined,
+			Excluded:    pu.Excluded,
+			Allocations: pu.Allocations,
+			Failures:    pu.Failures,
+		})
+	}
+
+	err = plugin.Listener.Encode(w, &resp)
+
+	log.Response(plugin.Name, &resp, err)
+}
+
+// Converts core IPAM address information to its libnetwork IPAM plugin representation.
+func newAddressInfo(info *ipam.AddressInfo) AddressInfo {
+	ai := AddressInfo{
+		Address:     info.Address.String(),
+		PoolID:      ipam.NewAddressPoolId(info.AsId, info.PoolId, "").String(),
+		InUse:       info.InUse,
+		OwnerID:     info.OwnerID,
+		ContainerID: info.ContainerID,
+		NetNsPath:   info.NetNsPath,
+		Healthy:     !info.Unhealthy,
+		Epoch:       info.Epoch,
+	}
+
+	if !info.AllocatedAt.IsZero() {
+		ai.AllocatedAt = info.AllocatedAt.Format(time.RFC3339)
+	}
+
+	if !info.ReleasedAt.IsZero() {
+		ai.ReleasedAt = info.ReleasedAt.Format(time.RFC3339)
+	}
+
+	if !info.OrphanedAt.IsZero() {
+		ai.OrphanedAt = info.OrphanedAt.Format(time.RFC3339)
+	}
+
+	return ai
+}
+
+// Converts a list of core IPAM address information.
+func newAddressInfos(infos []*ipam.AddressInfo) []AddressInfo {
+	var ais []AddressInfo
+
+	for _, info := range infos {
+		ais = append(ais, newAddressInfo(info))
+	}
+
+	return ais
+}
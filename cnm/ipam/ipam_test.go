@@ -234,6 +234,45 @@ func TestRequestAddress(t *testing.T) {
 	address1 = address.String()
 }
 
+// Tests IpamDriver.ListAddresses and IpamDriver.FindAddress functionality.
+func TestListAndFindAddresses(t *testing.T) {
+	var body bytes.Buffer
+	var listResp ListAddressesResponse
+	var findResp FindAddressResponse
+
+	json.NewEncoder(&body).Encode(&ListAddressesRequest{PoolID: poolId1})
+
+	req, err := http.NewRequest(http.MethodGet, ListAddressesPath, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	err = decodeResponse(w, &listResp)
+
+	if err != nil || listResp.Err != "" || len(listResp.Addresses) == 0 {
+		t.Errorf("ListAddresses response is invalid %+v", listResp)
+	}
+
+	json.NewEncoder(&body).Encode(&FindAddressRequest{Address: address1})
+
+	req, err = http.NewRequest(http.MethodGet, FindAddressPath, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	err = decodeResponse(w, &findResp)
+
+	if err != nil || findResp.Err != "" || !findResp.Address.InUse || findResp.Address.PoolID != poolId1 {
+		t.Errorf("FindAddress response is invalid %+v", findResp)
+	}
+}
+
 // Tests IpamDriver.ReleaseAddress functionality.
 func TestReleaseAddress(t *testing.T) {
 	var body bytes.Buffer
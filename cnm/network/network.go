@@ -4,8 +4,11 @@
 package network
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-container-networking/cnm"
 	"github.com/Azure/azure-container-networking/common"
@@ -75,6 +78,12 @@ func (plugin *netPlugin) Start(config *common.PluginConfig) error {
 		return err
 	}
 
+	// Start collecting stale bridge rules, only reporting them in dry-run mode.
+	ruleCollectionInterval, _ := plugin.GetOption(common.OptRuleCollectionInterval).(int)
+	ruleCollectionDryRun, _ := plugin.GetOption(common.OptRuleCollectionDryRun).(bool)
+	ruleCollectionDryRun = ruleCollectionDryRun || plugin.isDryRun()
+	plugin.nm.StartRuleCollector(time.Duration(ruleCollectionInterval)*time.Second, ruleCollectionDryRun)
+
 	// Add protocol handlers.
 	listener := plugin.Listener
 	listener.AddEndpoint(plugin.EndpointType)
@@ -107,6 +116,31 @@ func (plugin *netPlugin) Stop() {
 	log.Printf("[net] Plugin stopped.")
 }
 
+// isDryRun returns whether requests changing the host are answered with a plan instead.
+func (plugin *netPlugin) isDryRun() bool {
+	dryRun, _ := plugin.GetOption(common.OptDryRun).(bool)
+	return dryRun
+}
+
+// sendPlan logs the changes planned in dry-run mode and fails the request with them,
+// so that libnetwork does not record a network or endpoint that was not created.
+func (plugin *netPlugin) sendPlan(w http.ResponseWriter, plan []string, err error) {
+	if err != nil {
+		plugin.SendErrorResponse(w, err)
+		return
+	}
+
+	if len(plan) == 0 {
+		plan = append(plan, "No changes.")
+	}
+
+	for i, step := range plan {
+		log.Printf("[net] [dry-run] %v: %v", i+1, step)
+	}
+
+	plugin.SendErrorResponse(w, fmt.Errorf("Dry-run mode, no changes were made. Planned changes: %v", strings.Join(plan, " ")))
+}
+
 //
 // Libnetwork remote network API implementation
 // https://github.com/docker/libnetwork/blob/master/docs/remote.md
@@ -165,6 +199,13 @@ func (plugin *netPlugin) createNetwork(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Report the planned changes instead of making them in dry-run mode.
+	if plugin.isDryRun() {
+		plan, err := plugin.nm.PlanNetwork(&nwInfo, "")
+		plugin.sendPlan(w, plan, err)
+		return
+	}
+
 	err = plugin.nm.CreateNetwork(&nwInfo)
 	if err != nil {
 		plugin.SendErrorResponse(w, err)
@@ -190,6 +231,11 @@ func (plugin *netPlugin) deleteNetwork(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Process request.
+	if plugin.isDryRun() {
+		plugin.sendPlan(w, []string{fmt.Sprintf("Delete network %v.", req.NetworkID)}, nil)
+		return
+	}
+
 	err = plugin.nm.DeleteNetwork(req.NetworkID)
 	if err != nil {
 		plugin.SendErrorResponse(w, err)
@@ -231,6 +277,13 @@ func (plugin *netPlugin) createEndpoint(w http.ResponseWriter, r *http.Request)
 		IPAddresses: []net.IPNet{*ipv4Address},
 	}
 
+	// Report the planned changes instead of making them in dry-run mode.
+	if plugin.isDryRun() {
+		plan, err := plugin.nm.PlanEndpoint(&network.NetworkInfo{Id: req.NetworkID}, "", &epInfo)
+		plugin.sendPlan(w, plan, err)
+		return
+	}
+
 	err = plugin.nm.CreateEndpoint(req.NetworkID, &epInfo)
 	if err != nil {
 		plugin.SendErrorResponse(w, err)
@@ -257,6 +310,11 @@ func (plugin *netPlugin) deleteEndpoint(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Process request.
+	if plugin.isDryRun() {
+		plugin.sendPlan(w, []string{fmt.Sprintf("Delete endpoint %v from network %v.", req.EndpointID, req.NetworkID)}, nil)
+		return
+	}
+
 	err = plugin.nm.DeleteEndpoint(req.NetworkID, req.EndpointID)
 	if err != nil {
 		plugin.SendErrorResponse(w, err)
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/Azure/azure-container-networking/cnm/ipam"
 	"github.com/Azure/azure-container-networking/cnm/network"
@@ -36,6 +37,8 @@ var args = common.ArgumentList{
 		ValueMap: map[string]interface{}{
 			common.OptEnvironmentAzure: 0,
 			common.OptEnvironmentMAS:   0,
+			common.OptEnvironmentFile:  0,
+			common.OptEnvironmentCNS:   0,
 		},
 	},
 	{
@@ -82,6 +85,105 @@ var args = common.ArgumentList{
 		Type:         "int",
 		DefaultValue: "",
 	},
+	{
+		Name:         common.OptIpamConfigFile,
+		Shorthand:    common.OptIpamConfigFileAlias,
+		Description:  "Set the IPAM configuration file for the file environment",
+		Type:         "string",
+		DefaultValue: "",
+	},
+	{
+		Name:         common.OptIpamReleaseCooldown,
+		Shorthand:    common.OptIpamReleaseCooldownAlias,
+		Description:  "Set the cooldown before released IPAM addresses are offered again",
+		Type:         "int",
+		DefaultValue: "",
+	},
+	{
+		Name:         common.OptIpamProbe,
+		Shorthand:    common.OptIpamProbeAlias,
+		Description:  "Probe IPAM addresses for conflicts with other hosts",
+		Type:         "bool",
+		DefaultValue: false,
+	},
+	{
+		Name:         common.OptIpamAllocationStrategy,
+		Shorthand:    common.OptIpamAllocationStrategyAlias,
+		Description:  "Set the IPAM address allocation strategy",
+		Type:         "string",
+		DefaultValue: common.OptIpamStrategyLRU,
+		ValueMap: map[string]interface{}{
+			common.OptIpamStrategySequential: 0,
+			common.OptIpamStrategyRandom:     0,
+			common.OptIpamStrategyLRU:        0,
+			common.OptIpamStrategySticky:     0,
+		},
+	},
+	{
+		Name:         common.OptIpamOrphanPolicy,
+		Shorthand:    common.OptIpamOrphanPolicyAlias,
+		Description:  "Set the action taken when an in-use IPAM address is withdrawn by the address source",
+		Type:         "string",
+		DefaultValue: common.OptIpamOrphanPolicyNone,
+		ValueMap: map[string]interface{}{
+			common.OptIpamOrphanPolicyNone:   0,
+			common.OptIpamOrphanPolicyNotify: 0,
+			common.OptIpamOrphanPolicyEvict:  0,
+		},
+	},
+	{
+		Name:         common.OptIpamLowWatermark,
+		Shorthand:    common.OptIpamLowWatermarkAlias,
+		Description:  "Set the percentage of free addresses in an IPAM pool below which an event is raised",
+		Type:         "int",
+		DefaultValue: "",
+	},
+	{
+		Name:         common.OptIpamGlobalStore,
+		Shorthand:    common.OptIpamGlobalStoreAlias,
+		Description:  "Set the shared store file for IPAM global address spaces",
+		Type:         "string",
+		DefaultValue: "",
+	},
+	{
+		Name:         common.OptStoreBackend,
+		Shorthand:    common.OptStoreBackendAlias,
+		Description:  "Set the persistent store backend",
+		Type:         "string",
+		DefaultValue: common.OptStoreBackendJson,
+		ValueMap: map[string]interface{}{
+			common.OptStoreBackendJson: store.BackendJson,
+			common.OptStoreBackendBolt: store.BackendBolt,
+		},
+	},
+	{
+		Name:         common.OptStoreLockTimeout,
+		Shorthand:    common.OptStoreLockTimeoutAlias,
+		Description:  "Set the time in milliseconds to wait for a store locked by another process",
+		Type:         "int",
+		DefaultValue: "",
+	},
+	{
+		Name:         common.OptRuleCollectionInterval,
+		Shorthand:    common.OptRuleCollectionIntervalAlias,
+		Description:  "Set the stale bridge rule collection interval",
+		Type:         "int",
+		DefaultValue: "",
+	},
+	{
+		Name:         common.OptRuleCollectionDryRun,
+		Shorthand:    common.OptRuleCollectionDryRunAlias,
+		Description:  "Report stale bridge rules without removing them",
+		Type:         "bool",
+		DefaultValue: false,
+	},
+	{
+		Name:         common.OptDryRun,
+		Shorthand:    common.OptDryRunAlias,
+		Description:  "Answer requests with the planned changes without making them",
+		Type:         "bool",
+		DefaultValue: false,
+	},
 	{
 		Name:         common.OptVersion,
 		Shorthand:    common.OptVersionAlias,
@@ -107,6 +209,18 @@ func main() {
 	logLevel := common.GetArg(common.OptLogLevel).(int)
 	logTarget := common.GetArg(common.OptLogTarget).(int)
 	ipamQueryInterval, _ := common.GetArg(common.OptIpamQueryInterval).(int)
+	ipamConfigFile := common.GetArg(common.OptIpamConfigFile).(string)
+	ipamReleaseCooldown, _ := common.GetArg(common.OptIpamReleaseCooldown).(int)
+	ipamProbe := common.GetArg(common.OptIpamProbe).(bool)
+	ipamAllocationStrategy := common.GetArg(common.OptIpamAllocationStrategy).(string)
+	ipamOrphanPolicy := common.GetArg(common.OptIpamOrphanPolicy).(string)
+	ipamLowWatermark, _ := common.GetArg(common.OptIpamLowWatermark).(int)
+	ipamGlobalStore := common.GetArg(common.OptIpamGlobalStore).(string)
+	storeBackend := common.GetArg(common.OptStoreBackend).(string)
+	storeLockTimeout, _ := common.GetArg(common.OptStoreLockTimeout).(int)
+	ruleCollectionInterval, _ := common.GetArg(common.OptRuleCollectionInterval).(int)
+	ruleCollectionDryRun := common.GetArg(common.OptRuleCollectionDryRun).(bool)
+	dryRun := common.GetArg(common.OptDryRun).(bool)
 	vers := common.GetArg(common.OptVersion).(bool)
 
 	if vers {
@@ -141,8 +255,13 @@ func main() {
 		return
 	}
 
+	// Set the time to wait for stores locked by other processes.
+	if storeLockTimeout > 0 {
+		store.SetLockTimeout(time.Duration(storeLockTimeout) * time.Millisecond)
+	}
+
 	// Create the key value store.
-	config.Store, err = store.NewJsonFileStore(platform.CNMRuntimePath + name + ".json")
+	config.Store, err = store.NewStore(storeBackend, platform.CNMRuntimePath+name)
 	if err != nil {
 		fmt.Printf("Failed to create store: %v\n", err)
 		return
@@ -161,12 +280,30 @@ func main() {
 	log.Printf("Running on %v", platform.GetOSInfo())
 	common.LogNetworkInterfaces()
 
+	// In dry-run mode, requests are answered with the planned changes, external commands are
+	// logged but not run and the persisted state is read but not written.
+	if dryRun {
+		log.Printf("Running in dry-run mode, no changes are made.")
+		platform.SetExecutor(platform.NewDryRunExecutor(log.Printf))
+		config.Store = store.NewDryRunStore(config.Store, log.Printf)
+	}
+
 	// Set plugin options.
 	netPlugin.SetOption(common.OptAPIServerURL, url)
+	netPlugin.SetOption(common.OptRuleCollectionInterval, ruleCollectionInterval)
+	netPlugin.SetOption(common.OptRuleCollectionDryRun, ruleCollectionDryRun)
+	netPlugin.SetOption(common.OptDryRun, dryRun)
 
 	ipamPlugin.SetOption(common.OptEnvironment, environment)
 	ipamPlugin.SetOption(common.OptAPIServerURL, url)
 	ipamPlugin.SetOption(common.OptIpamQueryInterval, ipamQueryInterval)
+	ipamPlugin.SetOption(common.OptIpamConfigFile, ipamConfigFile)
+	ipamPlugin.SetOption(common.OptIpamReleaseCooldown, ipamReleaseCooldown)
+	ipamPlugin.SetOption(common.OptIpamProbe, ipamProbe)
+	ipamPlugin.SetOption(common.OptIpamAllocationStrategy, ipamAllocationStrategy)
+	ipamPlugin.SetOption(common.OptIpamOrphanPolicy, ipamOrphanPolicy)
+	ipamPlugin.SetOption(common.OptIpamLowWatermark, ipamLowWatermark)
+	ipamPlugin.SetOption(common.OptIpamGlobalStore, ipamGlobalStore)
 
 	// Start plugins.
 	if netPlugin != nil {
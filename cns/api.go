@@ -14,6 +14,7 @@ const (
 	GetIPAddressUtilizationPath = "/network/ip/utilization"
 	GetUnhealthyIPAddressesPath = "/network/ipaddresses/unhealthy"
 	GetHealthReportPath         = "/network/health"
+	RotateStoreKeyPath          = "/network/store/rotatekey"
 	V1Prefix                    = "/v0.1"
 	V2Prefix                    = "/v0.2"
 )
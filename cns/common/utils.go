@@ -2,19 +2,14 @@ package common
 
 import (
 	"fmt"
-	"os/exec"
 
 	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/platform"
 )
 
 func ExecuteShellCommand(command string) error {
 	log.Printf("[Azure-CNS] %s", command)
-	cmd := exec.Command("sh", "-c", command)
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
-	return cmd.Wait()
+	return platform.ExecuteShellCommand(command)
 }
 
 func SetOutboundSNAT(subnet string) error {
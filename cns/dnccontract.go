@@ -1,6 +1,9 @@
 package cns
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 // Container Network Service DNC Contract
 const (
@@ -10,6 +13,7 @@ const (
 	GetNetworkContainerStatus                = "/network/getnetworkcontainerstatus"
 	GetInterfaceForContainer                 = "/network/getinterfaceforcontainer"
 	GetNetworkContainerByOrchestratorContext = "/network/getnetworkcontainerbyorchestratorcontext"
+	GetIPConfigurations                      = "/network/getipconfigurations"
 )
 
 // NetworkContainer Types
@@ -37,6 +41,18 @@ type CreateNetworkContainerRequest struct {
 	Routes                     []Route
 }
 
+// String returns the request with its authorization token redacted, so that requests can be logged.
+func (req CreateNetworkContainerRequest) String() string {
+	// The conversion drops this method, so that formatting does not recurse.
+	type request CreateNetworkContainerRequest
+
+	if req.AuthorizationToken != "" {
+		req.AuthorizationToken = "<redacted>"
+	}
+
+	return fmt.Sprintf("%+v", request(req))
+}
+
 // KubernetesPodInfo is an OrchestratorContext that holds PodName and PodNamespace.
 type KubernetesPodInfo struct {
 	PodName      string
@@ -133,3 +149,18 @@ type NetworkInterface struct {
 	Name      string
 	IPAddress string
 }
+
+// NetworkContainerIPConfiguration specifies the IP configuration of a network container.
+type NetworkContainerIPConfiguration struct {
+	NetworkContainerid         string
+	PrimaryInterfaceIdentifier string
+	IPConfiguration            IPConfiguration
+}
+
+// GetIPConfigurationsResponse describes the IP configurations of all network containers on the node.
+// StateVersion changes whenever a network container is created, updated or deleted.
+type GetIPConfigurationsResponse struct {
+	StateVersion     int
+	IPConfigurations []NetworkContainerIPConfiguration
+	Response         Response
+}
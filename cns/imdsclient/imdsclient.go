@@ -19,7 +19,8 @@ func (imdsClient *ImdsClient) GetNetworkContainerInfoFromHost(networkContainerID
 	queryURL := fmt.Sprintf(hostQueryURLForProgrammedVersion,
 		primaryAddress, networkContainerID, authToken, apiVersion)
 
-	log.Printf("[Azure CNS] Going to query Azure Host for container version @\n %v\n", queryURL)
+	log.Printf("[Azure CNS] Going to query Azure Host for container version @\n %v\n",
+		fmt.Sprintf(hostQueryURLForProgrammedVersion, primaryAddress, networkContainerID, "<redacted>", apiVersion))
 	jsonResponse, err := http.Get(queryURL)
 	if err != nil {
 		return nil, err
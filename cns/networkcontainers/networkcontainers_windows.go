@@ -8,12 +8,12 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
 
 	"github.com/Azure/azure-container-networking/cns"
 	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/platform"
 )
 
 func createOrUpdateInterface(createNetworkContainerRequest cns.CreateNetworkContainerRequest) error {
@@ -75,8 +75,7 @@ func setWeakHostOnInterface(ipAddress string) error {
 		"true"}
 
 	log.Printf("[Azure CNS] Going to enable weak host send/receive on interface: %v", args)
-	c := exec.Command("cmd", args...)
-	bytes, err := c.Output()
+	bytes, err := platform.GetExecutor().Output("cmd", args...)
 
 	if err == nil {
 		log.Printf("[Azure CNS] Successfully updated weak host send/receive on interface %v.\n", string(bytes))
@@ -136,8 +135,7 @@ func createOrUpdateWithOperation(createNetworkContainerRequest cns.CreateNetwork
 		"true"}
 
 	log.Printf("[Azure CNS] Going to create/update network loopback adapter: %v", args)
-	c := exec.Command("cmd", args...)
-	bytes, err := c.Output()
+	bytes, err := platform.GetExecutor().Output("cmd", args...)
 
 	if err == nil {
 		log.Printf("[Azure CNS] Successfully created network loopback adapter %v.\n", string(bytes))
@@ -167,8 +165,7 @@ func deleteInterface(networkContainerID string) error {
 		"DELETE"}
 
 	log.Printf("[Azure CNS] Going to delete network loopback adapter: %v", args)
-	c := exec.Command("cmd", args...)
-	bytes, err := c.Output()
+	bytes, err := platform.GetExecutor().Output("cmd", args...)
 
 	if err == nil {
 		log.Printf("[Azure CNS] Successfully deleted network container %v.\n", string(bytes))
@@ -60,6 +60,7 @@ type httpRestServiceState struct {
 	ContainerStatus                  map[string]containerstatus // NetworkContainerID is key.
 	Networks                         map[string]*networkInfo
 	TimeStamp                        time.Time
+	StateVersion                     int // Incremented on every network container change.
 }
 
 type networkInfo struct {
@@ -148,6 +149,8 @@ func (service *httpRestService) Start(config *common.ServiceConfig) error {
 	listener.AddHandler(cns.GetInterfaceForContainer, service.getInterfaceForContainer)
 	listener.AddHandler(cns.SetOrchestratorType, service.setOrchestratorType)
 	listener.AddHandler(cns.GetNetworkContainerByOrchestratorContext, service.getNetworkContainerByOrchestratorContext)
+	listener.AddHandler(cns.GetIPConfigurations, service.getIPConfigurations)
+	listener.AddHandler(cns.RotateStoreKeyPath, service.rotateStoreKey)
 
 	// handlers for v0.2
 	listener.AddHandler(cns.V2Prefix+cns.SetEnvironmentPath, service.setEnvironment)
@@ -164,6 +167,8 @@ func (service *httpRestService) Start(config *common.ServiceConfig) error {
 	listener.AddHandler(cns.V2Prefix+cns.GetInterfaceForContainer, service.getInterfaceForContainer)
 	listener.AddHandler(cns.V2Prefix+cns.SetOrchestratorType, service.setOrchestratorType)
 	listener.AddHandler(cns.V2Prefix+cns.GetNetworkContainerByOrchestratorContext, service.getNetworkContainerByOrchestratorContext)
+	listener.AddHandler(cns.V2Prefix+cns.GetIPConfigurations, service.getIPConfigurations)
+	listener.AddHandler(cns.V2Prefix+cns.RotateStoreKeyPath, service.rotateStoreKey)
 
 	log.Printf("[Azure CNS]  Listening.")
 	return nil
@@ -756,6 +761,48 @@ func (service *httpRestService) getHealthReport(w http.ResponseWriter, r *http.R
 	log.Response(service.Name, resp, err)
 }
 
+// Handles requests to rotate the key encrypting CNS state at rest.
+func (service *httpRestService) rotateStoreKey(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[Azure CNS] rotateStoreKey")
+	log.Request(service.Name, "rotateStoreKey", nil)
+
+	returnMessage := ""
+	returnCode := 0
+
+	switch r.Method {
+	case "POST":
+		kr, ok := service.store.(store.KeyRotator)
+		if !ok {
+			returnMessage = fmt.Sprintf("[Azure CNS] Error. Store does not support encryption.")
+			returnCode = StoreNotEncrypted
+			break
+		}
+
+		service.lock.Lock()
+		err := kr.RotateKey()
+		service.lock.Unlock()
+
+		if err == store.ErrValueEncrypted {
+			returnMessage = fmt.Sprintf("[Azure CNS] Error. Store is not encrypted.")
+			returnCode = StoreNotEncrypted
+		} else if err != nil {
+			returnMessage = fmt.Sprintf("[Azure CNS] Error. RotateKey failed %v", err.Error())
+			returnCode = UnexpectedError
+		}
+	default:
+		returnMessage = "[Azure CNS] Error. RotateStoreKey did not receive a POST."
+		returnCode = InvalidParameter
+	}
+
+	resp := &cns.Response{
+		ReturnCode: returnCode,
+		Message:    returnMessage,
+	}
+
+	err := service.Listener.Encode(w, &resp)
+	log.Response(service.Name, resp, err)
+}
+
 // saveState writes CNS state to persistent store.
 func (service *httpRestService) saveState() error {
 	log.Printf("[Azure CNS] saveState")
@@ -801,7 +848,13 @@ func (service *httpRestService) restoreState() error {
 		return err
 	}
 
-	log.Printf("[Azure CNS]  Restored state, %+v\n", service.state)
+	if store.RestoredFromBackup(service.store) {
+		log.Printf("[Azure CNS]  Restored state from the previous generation, recent changes may be lost.")
+	}
+
+	// The state holds authorization tokens, so only a summary is logged.
+	log.Printf("[Azure CNS]  Restored state with %v network containers and %v networks, timestamp %v.\n",
+		len(service.state.ContainerStatus), len(service.state.Networks), service.state.TimeStamp)
 	return nil
 }
 
@@ -858,6 +911,8 @@ func (service *httpRestService) saveNetworkContainerGoalState(req cns.CreateNetw
 			CreateNetworkContainerRequest: req,
 			HostVersion:                   hostVersion}
 
+	service.state.StateVersion++
+
 	if req.NetworkContainerType == cns.AzureContainerInstance {
 		switch service.state.OrchestratorType {
 		case cns.Kubernetes:
@@ -1015,6 +1070,50 @@ func (service *httpRestService) getNetworkContainerByOrchestratorContext(w http.
 	log.Response(service.Name, getNetworkContainerResponse, err)
 }
 
+// Handles retrieval of the IP configurations of all network containers on the node.
+func (service *httpRestService) getIPConfigurations(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[Azure CNS] getIPConfigurations")
+	log.Request(service.Name, "getIPConfigurations", nil)
+
+	returnMessage := ""
+	returnCode := 0
+	stateVersion := 0
+	var ipConfigs []cns.NetworkContainerIPConfiguration
+
+	switch r.Method {
+	case "GET":
+		service.lock.Lock()
+		stateVersion = service.state.StateVersion
+		for _, containerStatus := range service.state.ContainerStatus {
+			req := containerStatus.CreateNetworkContainerRequest
+			ipConfigs = append(ipConfigs, cns.NetworkContainerIPConfiguration{
+				NetworkContainerid:         req.NetworkContainerid,
+				PrimaryInterfaceIdentifier: req.PrimaryInterfaceIdentifier,
+				IPConfiguration:            req.IPConfiguration,
+			})
+		}
+		service.lock.Unlock()
+
+	default:
+		returnMessage = "[Azure CNS] Error. GetIPConfigurations did not receive a GET."
+		returnCode = InvalidParameter
+	}
+
+	resp := cns.Response{
+		ReturnCode: returnCode,
+		Message:    returnMessage,
+	}
+
+	ipConfigsResp := &cns.GetIPConfigurationsResponse{
+		StateVersion:     stateVersion,
+		IPConfigurations: ipConfigs,
+		Response:         resp,
+	}
+
+	err := service.Listener.Encode(w, &ipConfigsResp)
+	log.Response(service.Name, ipConfigsResp, err)
+}
+
 func (service *httpRestService) deleteNetworkContainer(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[Azure CNS] deleteNetworkContainer")
 
@@ -1057,6 +1156,8 @@ func (service *httpRestService) deleteNetworkContainer(w http.ResponseWriter, r
 			delete(service.state.ContainerStatus, req.NetworkContainerid)
 		}
 
+		service.state.StateVersion++
+
 		if service.state.ContainerIDByOrchestratorContext != nil {
 			for orchestratorContext, networkContainerID := range service.state.ContainerIDByOrchestratorContext {
 				if networkContainerID == req.NetworkContainerid {
@@ -604,3 +604,17 @@ func TestGetInterfaceForNetworkContainer(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// Tests authorization tokens are redacted when requests are logged.
+func TestAuthorizationTokenIsNotLogged(t *testing.T) {
+	req := cns.CreateNetworkContainerRequest{
+		NetworkContainerid: "ethWebApp",
+		AuthorizationToken: "secret-token",
+	}
+
+	for _, text := range []string{fmt.Sprintf("%+v", &req), fmt.Sprintf("%v", req)} {
+		if bytes.Contains([]byte(text), []byte(req.AuthorizationToken)) {
+			t.Errorf("Formatted request contains the authorization token: %v", text)
+		}
+	}
+}
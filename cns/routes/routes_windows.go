@@ -8,10 +8,10 @@ package routes
 import (
 	"fmt"
 	"net"
-	"os/exec"
 	"strings"
 
 	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/platform"
 )
 
 const (
@@ -53,10 +53,9 @@ func getInterfaceByAddress(address string) (int, error) {
 func getRoutes() ([]Route, error) {
 	log.Printf("[Azure CNS] getRoutes")
 
-	c := exec.Command("cmd", "/C", "route", "print")
 	var routePrintOutput string
 	var routeCount int
-	bytes, err := c.Output()
+	bytes, err := platform.GetExecutor().Output("cmd", "/C", "route", "print")
 	if err == nil {
 		routePrintOutput = string(bytes)
 		log.Debugf("[Azure CNS] Printing Routing table \n %v\n", routePrintOutput)
@@ -163,8 +162,7 @@ func putRoutes(routes []Route) error {
 				fmt.Sprintf("%d", route.ifaceIndex)}
 			log.Printf("[Azure CNS] Adding missing route: %v", args)
 
-			c := exec.Command("cmd", args...)
-			bytes, err := c.Output()
+			bytes, err := platform.GetExecutor().Output("cmd", args...)
 			if err == nil {
 				log.Printf("[Azure CNS] Successfully executed add route: %v\n%v", args, string(bytes))
 			} else {
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/Azure/azure-container-networking/cnm/ipam"
 	"github.com/Azure/azure-container-networking/cnm/network"
@@ -93,6 +94,31 @@ var args = acn.ArgumentList{
 		Type:         "string",
 		DefaultValue: "",
 	},
+	{
+		Name:         acn.OptStoreBackend,
+		Shorthand:    acn.OptStoreBackendAlias,
+		Description:  "Set the persistent store backend",
+		Type:         "string",
+		DefaultValue: acn.OptStoreBackendJson,
+		ValueMap: map[string]interface{}{
+			acn.OptStoreBackendJson: store.BackendJson,
+			acn.OptStoreBackendBolt: store.BackendBolt,
+		},
+	},
+	{
+		Name:         acn.OptStoreLockTimeout,
+		Shorthand:    acn.OptStoreLockTimeoutAlias,
+		Description:  "Set the time in milliseconds to wait for a store locked by another process",
+		Type:         "int",
+		DefaultValue: "",
+	},
+	{
+		Name:         acn.OptStoreKeyFile,
+		Shorthand:    acn.OptStoreKeyFileAlias,
+		Description:  "Set the key file for encrypting CNS state at rest",
+		Type:         "string",
+		DefaultValue: "",
+	},
 	{
 		Name:         acn.OptStopAzureVnet,
 		Shorthand:    acn.OptStopAzureVnetAlias,
@@ -128,6 +154,9 @@ func main() {
 	logTarget := acn.GetArg(acn.OptLogTarget).(int)
 	logDirectory := acn.GetArg(acn.OptLogLocation).(string)
 	ipamQueryInterval, _ := acn.GetArg(acn.OptIpamQueryInterval).(int)
+	storeBackend := acn.GetArg(acn.OptStoreBackend).(string)
+	storeLockTimeout, _ := acn.GetArg(acn.OptStoreLockTimeout).(int)
+	storeKeyFile := acn.GetArg(acn.OptStoreKeyFile).(string)
 	stopcnm = acn.GetArg(acn.OptStopAzureVnet).(bool)
 	vers := acn.GetArg(acn.OptVersion).(bool)
 
@@ -167,14 +196,28 @@ func main() {
 		return
 	}
 
+	// Set the time to wait for stores locked by other processes.
+	if storeLockTimeout > 0 {
+		store.SetLockTimeout(time.Duration(storeLockTimeout) * time.Millisecond)
+	}
+
 	// Create the key value store.
 
-	config.Store, err = store.NewJsonFileStore(platform.CNMRuntimePath + name + ".json")
+	config.Store, err = store.NewStore(storeBackend, platform.CNMRuntimePath+name)
 	if err != nil {
 		fmt.Printf("Failed to create store: %v\n", err)
 		return
 	}
 
+	// Encrypt the state at rest.
+	if storeKeyFile != "" {
+		err = store.EnableEncryption(config.Store, storeKeyFile)
+		if err != nil {
+			fmt.Printf("Failed to enable store encryption: %v\n", err)
+			return
+		}
+	}
+
 	// Create CNS object.
 	httpRestService, err := restserver.NewHTTPRestService(&config)
 	if err != nil {
@@ -220,7 +263,7 @@ func main() {
 		}
 
 		// Create the key value store.
-		pluginConfig.Store, err = store.NewJsonFileStore(platform.CNMRuntimePath + pluginName + ".json")
+		pluginConfig.Store, err = store.NewStore(storeBackend, platform.CNMRuntimePath+pluginName)
 		if err != nil {
 			fmt.Printf("Failed to create store: %v\n", err)
 			return
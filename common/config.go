@@ -10,6 +10,8 @@ const (
 	OptEnvironmentAlias = "e"
 	OptEnvironmentAzure = "azure"
 	OptEnvironmentMAS   = "mas"
+	OptEnvironmentFile  = "file"
+	OptEnvironmentCNS   = "cns"
 
 	// API server URL.
 	OptAPIServerURL      = "api-url"
@@ -42,6 +44,70 @@ const (
 	OptIpamQueryInterval      = "ipam-query-interval"
 	OptIpamQueryIntervalAlias = "i"
 
+	// IPAM configuration file used by the file environment.
+	OptIpamConfigFile      = "ipam-config-file"
+	OptIpamConfigFileAlias = "f"
+
+	// Grace period before leaked IPAM addresses are reclaimed.
+	OptIpamReclaimGracePeriod = "ipam-reclaim-grace-period"
+
+	// Cooldown before released IPAM addresses are offered again.
+	OptIpamReleaseCooldown      = "ipam-release-cooldown"
+	OptIpamReleaseCooldownAlias = "rc"
+
+	// Probe IPAM addresses for conflicts with other hosts.
+	OptIpamProbe      = "ipam-probe"
+	OptIpamProbeAlias = "ap"
+
+	// IPAM address allocation strategy.
+	OptIpamAllocationStrategy      = "ipam-allocation-strategy"
+	OptIpamAllocationStrategyAlias = "as"
+	OptIpamStrategySequential      = "sequential"
+	OptIpamStrategyRandom          = "random"
+	OptIpamStrategyLRU             = "lru"
+	OptIpamStrategySticky          = "sticky"
+
+	// Percentage of free addresses in an IPAM pool below which a low watermark event is raised.
+	OptIpamLowWatermark      = "ipam-low-watermark"
+	OptIpamLowWatermarkAlias = "lw"
+
+	// Shared store for IPAM global address spaces.
+	OptIpamGlobalStore      = "ipam-global-store"
+	OptIpamGlobalStoreAlias = "gs"
+
+	// Action taken when an in-use IPAM address is withdrawn by the address source.
+	OptIpamOrphanPolicy       = "ipam-orphan-policy"
+	OptIpamOrphanPolicyAlias  = "op"
+	OptIpamOrphanPolicyNone   = "none"
+	OptIpamOrphanPolicyNotify = "notify"
+	OptIpamOrphanPolicyEvict  = "evict"
+
+	// Persistent store backend.
+	OptStoreBackend      = "store-backend"
+	OptStoreBackendAlias = "sb"
+	OptStoreBackendJson  = "json"
+	OptStoreBackendBolt  = "bolt"
+
+	// Time in milliseconds to wait for a persistent store locked by another process.
+	OptStoreLockTimeout      = "store-lock-timeout"
+	OptStoreLockTimeoutAlias = "lt"
+
+	// Node-local key file for encrypting the persistent store at rest.
+	OptStoreKeyFile      = "store-key-file"
+	OptStoreKeyFileAlias = "sk"
+
+	// Stale bridge rule collection interval.
+	OptRuleCollectionInterval      = "rule-gc-interval"
+	OptRuleCollectionIntervalAlias = "gi"
+
+	// Stale bridge rule collection dry-run mode.
+	OptRuleCollectionDryRun      = "rule-gc-dry-run"
+	OptRuleCollectionDryRunAlias = "gd"
+
+	// Dry-run mode, answering requests with the planned changes.
+	OptDryRun      = "dry-run"
+	OptDryRunAlias = "dr"
+
 	OptStopAzureVnet      = "stop-azure-cnm"
 	OptStopAzureVnetAlias = "stopcnm"
 
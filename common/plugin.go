@@ -4,6 +4,8 @@
 package common
 
 import (
+	"net"
+
 	"github.com/Azure/azure-container-networking/store"
 )
 
@@ -27,6 +29,7 @@ type PluginApi interface {
 // Network internal interface.
 type NetApi interface {
 	AddExternalInterface(ifName string, subnet string) error
+	HandleOrphanedAddress(address net.IP, evict bool) error
 }
 
 // IPAM internal interface.
@@ -35,12 +38,13 @@ type IpamApi interface {
 
 // Plugin common configuration.
 type PluginConfig struct {
-	Version  string
-	NetApi   NetApi
-	IpamApi  IpamApi
-	Listener *Listener
-	ErrChan  chan error
-	Store    store.KeyValueStore
+	Version     string
+	NetApi      NetApi
+	IpamApi     IpamApi
+	Listener    *Listener
+	ErrChan     chan error
+	Store       store.KeyValueStore
+	GlobalStore store.CasKeyValueStore
 }
 
 // NewPlugin creates a new Plugin object.
@@ -0,0 +1,239 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ebtables
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/platform"
+)
+
+// RuleType identifies the kind of a bridge frame table rule.
+type RuleType int
+
+const (
+	// MAC SNAT rule for unicast traffic leaving an interface.
+	RuleSnatForInterface RuleType = iota
+	// ARP reply rule for a target IP address.
+	RuleArpReply
+	// MAC DNAT rule forwarding ARP replies received on an interface to all ports.
+	RuleDnatForArpReplies
+	// MAC DNAT rule for all traffic received on an interface, used for VEPA mode.
+	// An interface name ending in "+" matches all interfaces with that prefix.
+	RuleDnatForInterface
+	// MAC DNAT rule for IPv4 traffic to an IP address received on an interface.
+	RuleDnatForIPAddress
+)
+
+// Rule describes a bridge frame table rule independently of the backend that programs it.
+type Rule struct {
+	Type          RuleType
+	InterfaceName string
+	IPAddress     net.IP
+	MacAddress    net.HardwareAddr
+}
+
+// Change is the addition or deletion of a rule.
+type Change struct {
+	Action string
+	Rule   *Rule
+}
+
+// Backend programs bridge frame table rules into the kernel.
+type Backend interface {
+	// Name returns the name of the backend.
+	Name() string
+	// Apply applies a set of rule changes atomically.
+	Apply(changes []*Change) error
+	// List returns the rules currently programmed in the kernel.
+	// Rules that were not created through this package are omitted.
+	List() ([]*Rule, error)
+}
+
+// Backend used to program rules.
+var backend Backend
+var backendOnce sync.Once
+
+// String returns the rule in ebtables syntax.
+func (rule *Rule) String() string {
+	switch rule.Type {
+	case RuleSnatForInterface:
+		return fmt.Sprintf(
+			"POSTROUTING -s unicast -o %s -j snat --to-src %s --snat-arp --snat-target ACCEPT",
+			rule.InterfaceName, rule.MacAddress.String())
+	case RuleArpReply:
+		return fmt.Sprintf(
+			"PREROUTING -p ARP --arp-op Request --arp-ip-dst %s -j arpreply --arpreply-mac %s --arpreply-target DROP",
+			rule.IPAddress, rule.MacAddress.String())
+	case RuleDnatForArpReplies:
+		return fmt.Sprintf(
+			"PREROUTING -p ARP -i %s --arp-op Reply -j dnat --to-dst ff:ff:ff:ff:ff:ff --dnat-target ACCEPT",
+			rule.InterfaceName)
+	case RuleDnatForInterface:
+		return fmt.Sprintf(
+			"PREROUTING -i %s -j dnat --to-dst %s --dnat-target ACCEPT",
+			rule.InterfaceName, rule.MacAddress.String())
+	case RuleDnatForIPAddress:
+		return fmt.Sprintf(
+			"PREROUTING -p IPv4 -i %s --ip-dst %s -j dnat --to-dst %s --dnat-target ACCEPT",
+			rule.InterfaceName, rule.IPAddress.String(), rule.MacAddress.String())
+	}
+
+	return ""
+}
+
+// parseRule parses a rule in ebtables syntax, as returned by Rule.String or listed by ebtables.
+// Returns nil if the rule is not one of the rule types created by this package.
+func parseRule(text string) *Rule {
+	var chain, target string
+	var err error
+
+	// Collect the chain, target and option values.
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil
+	}
+	chain = fields[0]
+
+	options := make(map[string]string)
+	for i := 1; i < len(fields); i++ {
+		if !strings.HasPrefix(fields[i], "-") {
+			continue
+		}
+
+		value := ""
+		if i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "-") {
+			value = fields[i+1]
+		}
+
+		if fields[i] == "-j" {
+			target = value
+		} else {
+			options[fields[i]] = value
+		}
+	}
+
+	rule := &Rule{}
+
+	if mac := options["--to-src"] + options["--to-dst"] + options["--arpreply-mac"]; mac != "" {
+		rule.MacAddress, err = parseMAC(mac)
+		if err != nil {
+			return nil
+		}
+	}
+
+	switch {
+	case chain == "POSTROUTING" && target == "snat" && options["-o"] != "":
+		rule.Type = RuleSnatForInterface
+		rule.InterfaceName = options["-o"]
+
+	case chain == "PREROUTING" && target == "arpreply" && options["--arp-ip-dst"] != "":
+		rule.Type = RuleArpReply
+		rule.IPAddress = net.ParseIP(options["--arp-ip-dst"])
+
+	case chain == "PREROUTING" && target == "dnat" && options["--arp-op"] == "Reply" && options["-i"] != "":
+		rule.Type = RuleDnatForArpReplies
+		rule.InterfaceName = options["-i"]
+		rule.MacAddress = nil
+
+	case chain == "PREROUTING" && target == "dnat" && options["--ip-dst"] != "" && options["-i"] != "":
+		rule.Type = RuleDnatForIPAddress
+		rule.InterfaceName = options["-i"]
+		rule.IPAddress = net.ParseIP(options["--ip-dst"])
+
+	case chain == "PREROUTING" && target == "dnat" && options["-p"] == "" && options["-i"] != "":
+		rule.Type = RuleDnatForInterface
+		rule.InterfaceName = options["-i"]
+
+	default:
+		return nil
+	}
+
+	if rule.MacAddress == nil && rule.Type != RuleDnatForArpReplies {
+		return nil
+	}
+
+	if rule.IPAddress == nil && (rule.Type == RuleArpReply || rule.Type == RuleDnatForIPAddress) {
+		return nil
+	}
+
+	return rule
+}
+
+// parseMAC parses a MAC address as printed by ebtables, which omits leading zeros
+// unless rules are listed with --Lmac2.
+func parseMAC(text string) (net.HardwareAddr, error) {
+	octets := strings.Split(text, ":")
+	for i, octet := range octets {
+		if len(octet) == 1 {
+			octets[i] = "0" + octet
+		}
+	}
+
+	return net.ParseMAC(strings.Join(octets, ":"))
+}
+
+// ListRules returns the rules created by this package that are currently programmed in the kernel.
+func ListRules() ([]*Rule, error) {
+	return GetBackend().List()
+}
+
+// SetBackend overrides the backend used to program rules.
+func SetBackend(b Backend) {
+	backendOnce.Do(func() {})
+	backend = b
+}
+
+// GetBackend returns the backend used to program rules, selecting one on first use.
+func GetBackend() Backend {
+	backendOnce.Do(func() {
+		backend = selectBackend()
+		log.Printf("[ebtables] Using %s backend.", backend.Name())
+	})
+
+	return backend
+}
+
+// selectBackend probes the host for the best available backend.
+func selectBackend() Backend {
+	// Prefer the legacy binary when it programs the legacy kernel tables.
+	_, err := exec.LookPath("ebtables")
+	if err == nil && !isEbtablesNft() {
+		return &ebtablesBackend{}
+	}
+
+	// Otherwise talk to nftables directly if the kernel supports it.
+	if isNftablesAvailable() {
+		b := newNftablesBackend()
+
+		// Take over the rules created through ebtables-nft before the upgrade.
+		if err == nil {
+			migrateLegacyRules(b, &ebtablesBackend{builtinChains: true})
+		}
+
+		return b
+	}
+
+	// Fall back to the legacy binary, installing it if it is missing.
+	if err != nil {
+		installEbtables()
+	}
+
+	return &ebtablesBackend{}
+}
+
+// isEbtablesNft returns whether the installed ebtables binary is the nftables-based variant.
+func isEbtablesNft() bool {
+	out, err := platform.GetExecutor().CombinedOutput("ebtables", "--version")
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(string(out), "nf_tables")
+}
@@ -7,18 +7,32 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
-	"os/exec"
+	"os"
 	"strings"
 
 	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/platform"
 )
 
 const (
 	// Ebtables actions.
 	Append = "-A"
 	Delete = "-D"
+
+	// Ebtables tables.
+	natTable = "nat"
+
+	// Chains owned by the legacy backend, jumped to from the built-in chains of the nat table.
+	ebtPreroutingChain  = "AZURE-VNET-PREROUTING"
+	ebtPostroutingChain = "AZURE-VNET-POSTROUTING"
 )
 
+// Owned chains by the built-in chain they are jumped to from.
+var ownedChains = map[string]string{
+	"PREROUTING":  ebtPreroutingChain,
+	"POSTROUTING": ebtPostroutingChain,
+}
+
 // InstallEbtables installs the ebtables package.
 func installEbtables() {
 	version, _ := ioutil.ReadFile("/proc/version")
@@ -35,66 +49,315 @@ func installEbtables() {
 
 // SetSnatForInterface sets a MAC SNAT rule for an interface.
 func SetSnatForInterface(interfaceName string, macAddress net.HardwareAddr, action string) error {
-	command := fmt.Sprintf(
-		"ebtables -t nat %s POSTROUTING -s unicast -o %s -j snat --to-src %s --snat-arp --snat-target ACCEPT",
-		action, interfaceName, macAddress.String())
-
-	return executeShellCommand(command)
+	tx := NewTransaction()
+	tx.SetSnatForInterface(interfaceName, macAddress, action)
+	return tx.Commit()
 }
 
 // SetArpReply sets an ARP reply rule for the given target IP address and MAC address.
 func SetArpReply(ipAddress net.IP, macAddress net.HardwareAddr, action string) error {
-	command := fmt.Sprintf(
-		"ebtables -t nat %s PREROUTING -p ARP --arp-op Request --arp-ip-dst %s -j arpreply --arpreply-mac %s --arpreply-target DROP",
-		action, ipAddress, macAddress.String())
-
-	return executeShellCommand(command)
+	tx := NewTransaction()
+	tx.SetArpReply(ipAddress, macAddress, action)
+	return tx.Commit()
 }
 
 // SetDnatForArpReplies sets a MAC DNAT rule for ARP replies received on an interface.
 func SetDnatForArpReplies(interfaceName string, action string) error {
-	command := fmt.Sprintf(
-		"ebtables -t nat %s PREROUTING -p ARP -i %s --arp-op Reply -j dnat --to-dst ff:ff:ff:ff:ff:ff --dnat-target ACCEPT",
-		action, interfaceName)
-
-	return executeShellCommand(command)
+	tx := NewTransaction()
+	tx.SetDnatForArpReplies(interfaceName, action)
+	return tx.Commit()
 }
 
 // SetVepaMode sets the VEPA mode for a bridge and its ports.
 func SetVepaMode(bridgeName string, downstreamIfNamePrefix string, upstreamMacAddress string, action string) error {
-	if !strings.HasPrefix(bridgeName, downstreamIfNamePrefix) {
-		command := fmt.Sprintf(
-			"ebtables -t nat %s PREROUTING -i %s -j dnat --to-dst %s --dnat-target ACCEPT",
-			action, bridgeName, upstreamMacAddress)
+	tx := NewTransaction()
+	tx.SetVepaMode(bridgeName, downstreamIfNamePrefix, upstreamMacAddress, action)
+	return tx.Commit()
+}
+
+// SetDnatForIPAddress sets a MAC DNAT rule for an IP address.
+func SetDnatForIPAddress(interfaceName string, ipAddress net.IP, macAddress net.HardwareAddr, action string) error {
+	tx := NewTransaction()
+	tx.SetDnatForIPAddress(interfaceName, ipAddress, macAddress, action)
+	return tx.Commit()
+}
+
+//
+// Legacy ebtables backend
+//
+
+// ebtablesBackend programs rules by invoking the ebtables binary.
+//
+// Rules are kept in chains owned by the backend, so that they can be told apart from rules
+// created by other software. Releases before owned chains were introduced created their
+// rules in the built-in chains. Those rules can still be deleted, but are not listed.
+type ebtablesBackend struct {
+	// Whether the backend operates on the built-in chains instead of the owned chains.
+	builtinChains bool
+}
+
+// Name returns the name of the backend.
+func (b *ebtablesBackend) Name() string {
+	return "ebtables"
+}
 
+// Apply applies a set of rule changes atomically.
+//
+// The nat table is saved with ebtables-save, the changes are applied to the saved rules,
+// and the resulting table replaces the kernel table in a single ebtables-restore. If any
+// change fails, the kernel table is left untouched.
+//
+// Callers are expected to serialize changes, e.g. by holding the plugin store lock,
+// since changes made to the nat table between the save and the restore are overwritten.
+func (b *ebtablesBackend) Apply(changes []*Change) error {
+	// A single change is already atomic. It fails if the owned chains do not exist yet,
+	// or if the rule was created in a built-in chain, and is then applied to the saved table.
+	if len(changes) == 1 {
+		command := fmt.Sprintf("ebtables -t %s %s %s", natTable, changes[0].Action, b.ruleSpec(changes[0].Rule))
 		err := executeShellCommand(command)
-		if err != nil {
+		if err == nil || b.builtinChains {
 			return err
 		}
 	}
 
-	command := fmt.Sprintf(
-		"ebtables -t nat %s PREROUTING -i %s+ -j dnat --to-dst %s --dnat-target ACCEPT",
-		action, downstreamIfNamePrefix, upstreamMacAddress)
+	// Save the current nat table.
+	log.Debugf("[ebtables] ebtables-save")
+	saved, err := platform.GetExecutor().Output("ebtables-save")
+	if err != nil {
+		log.Printf("[ebtables] Failed to save nat table, err:%v.", err)
+		return err
+	}
+
+	// Apply the changes to the saved rules.
+	table, err := b.applyChanges(addOwnedChains(getSavedTable(string(saved), natTable)), changes)
+	if err != nil {
+		log.Printf("[ebtables] Failed to apply changes, rolling back, err:%v.", err)
+		return err
+	}
+
+	// Write the resulting table to a file for ebtables-restore.
+	file, err := ioutil.TempFile("", "ebtables")
+	if err != nil {
+		return err
+	}
+	fileName := file.Name()
+	defer os.Remove(fileName)
+
+	_, err = file.WriteString(strings.Join(table, "\n") + "\n")
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Replace the kernel nat table with the resulting table.
+	err = executeShellCommand(fmt.Sprintf("ebtables-restore < %s", fileName))
+	if err != nil {
+		log.Printf("[ebtables] Failed to restore nat table, err:%v.", err)
+		return err
+	}
 
-	return executeShellCommand(command)
+	return nil
 }
 
-// SetDnatForIPAddress sets a MAC DNAT rule for an IP address.
-func SetDnatForIPAddress(interfaceName string, ipAddress net.IP, macAddress net.HardwareAddr, action string) error {
-	command := fmt.Sprintf(
-		"ebtables -t nat %s PREROUTING -p IPv4 -i %s --ip-dst %s -j dnat --to-dst %s --dnat-target ACCEPT",
-		action, interfaceName, ipAddress.String(), macAddress.String())
+// List returns the rules currently programmed in the kernel nat table.
+func (b *ebtablesBackend) List() ([]*Rule, error) {
+	var rules []*Rule
+	var chain string
+
+	log.Debugf("[ebtables] ebtables -t %s -L --Lmac2", natTable)
+	out, err := platform.GetExecutor().Output("ebtables", "-t", natTable, "-L", "--Lmac2")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
 
-	return executeShellCommand(command)
+		// Rules are listed after the header of the chain they belong to.
+		if strings.HasPrefix(line, "Bridge chain:") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 {
+				chain = strings.TrimSuffix(fields[2], ",")
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		rule := b.parseRuleSpec(chain + " " + line)
+		if rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+// getSavedTable returns the lines of the given table in ebtables-save output.
+// Returns an empty table with the built-in nat chains if the table is not found.
+func getSavedTable(saved string, table string) []string {
+	var lines []string
+
+	for _, line := range strings.Split(saved, "\n") {
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "*") {
+			if lines != nil {
+				break
+			}
+
+			if line == "*"+table {
+				lines = append(lines, line)
+			}
+			continue
+		}
+
+		if lines != nil && line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	if lines == nil {
+		lines = []string{"*" + table, ":PREROUTING ACCEPT", ":OUTPUT ACCEPT", ":POSTROUTING ACCEPT"}
+	}
+
+	return lines
+}
+
+// addOwnedChains adds the owned chains, and the jumps to them, to the lines of a saved nat table.
+func addOwnedChains(lines []string) []string {
+	// Chain declarations precede the rules of the table.
+	n := 1
+	for n < len(lines) && strings.HasPrefix(lines[n], ":") {
+		n++
+	}
+
+	var declarations, jumps []string
+	for _, builtin := range []string{"PREROUTING", "POSTROUTING"} {
+		chain := ownedChains[builtin]
+		declaration := fmt.Sprintf(":%s RETURN", chain)
+		jump := fmt.Sprintf("-A %s -j %s", builtin, chain)
+
+		if !containsLine(lines, ":"+chain+" ") {
+			declarations = append(declarations, declaration)
+		}
+
+		if !containsLine(lines, jump) {
+			jumps = append(jumps, jump)
+		}
+	}
+
+	// The jumps are the first rules of the built-in chains.
+	result := append([]string{}, lines[:n]...)
+	result = append(result, declarations...)
+	result = append(result, jumps...)
+	return append(result, lines[n:]...)
+}
+
+// containsLine returns whether any of the lines starts with the given prefix.
+func containsLine(lines []string, prefix string) bool {
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyChanges applies rule changes to the lines of a table in ebtables-save format.
+func (b *ebtablesBackend) applyChanges(lines []string, changes []*Change) ([]string, error) {
+	for _, change := range changes {
+		switch change.Action {
+		case Append:
+			line := fmt.Sprintf("-A %s", b.ruleSpec(change.Rule))
+
+			// Rules are appended before the commit of the table, if any.
+			if n := len(lines); lines[n-1] == "COMMIT" {
+				lines = append(lines[:n-1], line, "COMMIT")
+			} else {
+				lines = append(lines, line)
+			}
+
+		case Delete:
+			i := b.findSavedRule(lines, change.Rule)
+			if i < 0 {
+				return nil, fmt.Errorf("Rule not found: %s", change.Rule)
+			}
+
+			lines = append(lines[:i], lines[i+1:]...)
+
+		default:
+			return nil, fmt.Errorf("Invalid action %s", change.Action)
+		}
+	}
+
+	return lines, nil
+}
+
+// findSavedRule returns the index of the line holding the given rule, or -1 if it is not found.
+// Rules created in the built-in chains by earlier releases are found after those in owned chains.
+func (b *ebtablesBackend) findSavedRule(lines []string, rule *Rule) int {
+	backends := []*ebtablesBackend{b}
+	if !b.builtinChains {
+		backends = append(backends, &ebtablesBackend{builtinChains: true})
+	}
+
+	for _, backend := range backends {
+		for i, line := range lines {
+			if !strings.HasPrefix(line, "-A ") {
+				continue
+			}
+
+			saved := backend.parseRuleSpec(strings.TrimPrefix(line, "-A "))
+			if saved != nil && saved.String() == rule.String() {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// ruleSpec returns a rule in ebtables syntax, in the chain where the backend keeps it.
+func (b *ebtablesBackend) ruleSpec(rule *Rule) string {
+	spec := rule.String()
+	if b.builtinChains {
+		return spec
+	}
+
+	fields := strings.SplitN(spec, " ", 2)
+	if len(fields) != 2 {
+		return spec
+	}
+
+	return ownedChains[fields[0]] + " " + fields[1]
+}
+
+// parseRuleSpec parses a rule in ebtables syntax. Returns nil if the rule is not in a chain
+// where the backend keeps its rules, or if it is not one of the rule types created by this package.
+func (b *ebtablesBackend) parseRuleSpec(spec string) *Rule {
+	if b.builtinChains {
+		return parseRule(spec)
+	}
+
+	fields := strings.SplitN(spec, " ", 2)
+	if len(fields) != 2 {
+		return nil
+	}
+
+	for builtin, chain := range ownedChains {
+		if fields[0] == chain {
+			return parseRule(builtin + " " + fields[1])
+		}
+	}
+
+	return nil
 }
 
 func executeShellCommand(command string) error {
 	log.Debugf("[ebtables] %s", command)
-	cmd := exec.Command("sh", "-c", command)
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
-	return cmd.Wait()
+	return platform.ExecuteShellCommand(command)
 }
@@ -0,0 +1,284 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ebtables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-container-networking/platform"
+)
+
+var (
+	testMac, _ = net.ParseMAC("12:34:56:78:9a:bc")
+	testIP     = net.ParseIP("10.0.0.4")
+)
+
+// Tests that rules are parsed back from their ebtables syntax.
+func TestRulesAreParsedFromString(t *testing.T) {
+	rules := []*Rule{
+		{Type: RuleSnatForInterface, InterfaceName: "eth0", MacAddress: testMac},
+		{Type: RuleArpReply, IPAddress: testIP, MacAddress: testMac},
+		{Type: RuleDnatForArpReplies, InterfaceName: "eth0"},
+		{Type: RuleDnatForInterface, InterfaceName: "az+", MacAddress: testMac},
+		{Type: RuleDnatForIPAddress, InterfaceName: "eth0", IPAddress: testIP, MacAddress: testMac},
+	}
+
+	for _, rule := range rules {
+		parsed := parseRule(rule.String())
+		if parsed == nil {
+			t.Fatalf("Failed to parse rule %v", rule)
+		}
+
+		if parsed.String() != rule.String() {
+			t.Errorf("Parsed rule %v does not match %v", parsed, rule)
+		}
+	}
+}
+
+// Tests that rules listed by the ebtables binary are parsed.
+func TestListedRulesAreParsed(t *testing.T) {
+	listed := "PREROUTING -p ARP --arp-op Request --arp-ip-dst 10.0.0.4 -j arpreply --arpreply-mac 12:34:56:78:9a:bc"
+
+	rule := parseRule(listed)
+	if rule == nil || rule.Type != RuleArpReply || !rule.IPAddress.Equal(testIP) {
+		t.Fatalf("Failed to parse listed rule %v", listed)
+	}
+}
+
+// Tests that unrelated rules are ignored.
+func TestUnknownRulesAreIgnored(t *testing.T) {
+	unknown := []string{
+		"",
+		"PREROUTING -p IPv4 -j ACCEPT",
+		"POSTROUTING -o eth0 -j mark --mark-set 1",
+		"PREROUTING -p IPv4 -i eth0 -j dnat --to-dst 12:34:56:78:9a:bc",
+	}
+
+	for _, text := range unknown {
+		if rule := parseRule(text); rule != nil {
+			t.Errorf("Unexpectedly parsed rule %v from %v", rule, text)
+		}
+	}
+}
+
+// Tests that a transaction is applied to the saved nat table and restored in one step.
+func TestTransactionIsCommittedAtomically(t *testing.T) {
+	executor := platform.NewRecordingExecutor()
+	executor.Outputs["ebtables-save"] = []byte(testSavedTables)
+	platform.SetExecutor(executor)
+	defer platform.SetExecutor(platform.NewExecutor())
+	SetBackend(&ebtablesBackend{})
+
+	tx := NewTransaction()
+	tx.SetSnatForInterface("eth0", testMac, Append)
+	tx.SetArpReply(testIP, testMac, Append)
+
+	err := tx.Commit()
+	if err != nil {
+		t.Fatalf("Failed to commit transaction, err:%v", err)
+	}
+
+	if len(executor.Commands) != 2 ||
+		executor.Commands[0] != "ebtables-save" ||
+		!strings.HasPrefix(executor.Commands[1], "sh -c ebtables-restore < ") {
+		t.Errorf("Unexpected commands:\n%v", executor)
+	}
+
+	// A change that fails rolls back the transaction without restoring the table.
+	executor.Commands = nil
+
+	tx.SetArpReply(testIP, testMac, Append)
+	tx.SetArpReply(net.ParseIP("10.0.0.9"), testMac, Delete)
+
+	err = tx.Commit()
+	if err == nil {
+		t.Errorf("Commit of a transaction deleting a missing rule succeeded")
+	}
+
+	if len(executor.Commands) != 1 {
+		t.Errorf("Unexpected commands after failed change:\n%v", executor)
+	}
+}
+
+// Output of ebtables-save with rules in the nat and filter tables. The ARP reply for 10.0.0.4
+// is in an owned chain, the DNAT rule was created in a built-in chain by an earlier release.
+const testSavedTables = `# Generated by ebtables-save v1.0 on Mon Oct 19 00:00:00 UTC 2026
+*nat
+:PREROUTING ACCEPT
+:OUTPUT ACCEPT
+:POSTROUTING ACCEPT
+:AZURE-VNET-PREROUTING RETURN
+-A PREROUTING -j AZURE-VNET-PREROUTING
+-A PREROUTING -p IPv4 -i eth0 --ip-dst 10.0.0.5 -j dnat --to-dst 2:0:0:0:0:1 --dnat-target ACCEPT
+-A AZURE-VNET-PREROUTING -p ARP --arp-op Request --arp-ip-dst 10.0.0.4 -j arpreply --arpreply-mac 12:34:56:78:9a:bc --arpreply-target DROP
+*filter
+:INPUT ACCEPT
+:FORWARD ACCEPT
+:OUTPUT ACCEPT
+-A FORWARD -j ACCEPT
+`
+
+// Tests that changes are applied to the owned chains of the saved nat table.
+func TestChangesAreAppliedToSavedTable(t *testing.T) {
+	dnatMac, _ := net.ParseMAC("02:00:00:00:00:01")
+	b := &ebtablesBackend{}
+
+	tests := []struct {
+		name    string
+		changes []*Change
+		rules   []string
+		err     bool
+	}{
+		{
+			name:  "no changes",
+			rules: []string{"PREROUTING --ip-dst 10.0.0.5", "AZURE-VNET-PREROUTING -p ARP"},
+		},
+		{
+			name: "append",
+			changes: []*Change{
+				{Append, &Rule{Type: RuleSnatForInterface, InterfaceName: "eth0", MacAddress: testMac}},
+			},
+			rules: []string{"PREROUTING --ip-dst 10.0.0.5", "AZURE-VNET-PREROUTING -p ARP", "AZURE-VNET-POSTROUTING -s unicast -o eth0"},
+		},
+		{
+			name: "delete from owned chain",
+			changes: []*Change{
+				{Delete, &Rule{Type: RuleArpReply, IPAddress: testIP, MacAddress: testMac}},
+			},
+			rules: []string{"PREROUTING --ip-dst 10.0.0.5"},
+		},
+		{
+			name: "delete from built-in chain rule saved without leading zeros",
+			changes: []*Change{
+				{Delete, &Rule{Type: RuleDnatForIPAddress, InterfaceName: "eth0", IPAddress: net.ParseIP("10.0.0.5"), MacAddress: dnatMac}},
+			},
+			rules: []string{"AZURE-VNET-PREROUTING -p ARP"},
+		},
+		{
+			name: "delete missing rule",
+			changes: []*Change{
+				{Delete, &Rule{Type: RuleArpReply, IPAddress: net.ParseIP("10.0.0.9"), MacAddress: testMac}},
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		lines, err := b.applyChanges(addOwnedChains(getSavedTable(testSavedTables, natTable)), test.changes)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: applyChanges succeeded, expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: applyChanges failed, err:%v", test.name, err)
+			continue
+		}
+
+		// Both owned chains are declared once and jumped to first from their built-in chains.
+		expected := []string{
+			"*nat", ":PREROUTING ACCEPT", ":OUTPUT ACCEPT", ":POSTROUTING ACCEPT",
+			":AZURE-VNET-PREROUTING RETURN", ":AZURE-VNET-POSTROUTING RETURN",
+			"-A POSTROUTING -j AZURE-VNET-POSTROUTING", "-A PREROUTING -j AZURE-VNET-PREROUTING",
+		}
+
+		var rules []string
+		for _, line := range lines {
+			if strings.Contains(line, "-j AZURE-VNET-") || !strings.HasPrefix(line, "-A ") {
+				continue
+			}
+			rules = append(rules, line)
+		}
+
+		for _, line := range expected {
+			if !containsLine(lines, line) {
+				t.Errorf("%s: table does not contain %s:\n%s", test.name, line, strings.Join(lines, "\n"))
+			}
+		}
+
+		if len(lines) != len(expected)+len(test.rules) || len(rules) != len(test.rules) {
+			t.Errorf("%s: unexpected table:\n%s", test.name, strings.Join(lines, "\n"))
+			continue
+		}
+
+		for i, rule := range test.rules {
+			fields := strings.SplitN(rule, " ", 2)
+			if !strings.HasPrefix(rules[i], "-A "+fields[0]+" ") || !strings.Contains(rules[i], fields[1]) {
+				t.Errorf("%s: rule %s does not match %s", test.name, rules[i], rule)
+			}
+		}
+	}
+
+	// A host without a saved nat table starts from the built-in chains.
+	lines := getSavedTable("", natTable)
+	if len(lines) != 4 || lines[0] != "*nat" {
+		t.Errorf("Unexpected empty table %v", lines)
+	}
+}
+
+// Tests that a single change is applied with one command, or through the saved table if it fails.
+func TestSingleChangeIsApplied(t *testing.T) {
+	rule := &Rule{Type: RuleArpReply, IPAddress: testIP, MacAddress: testMac}
+	command := "sh -c ebtables -t nat -D AZURE-VNET-PREROUTING " + strings.TrimPrefix(rule.String(), "PREROUTING ")
+
+	executor := platform.NewRecordingExecutor()
+	executor.Outputs["ebtables-save"] = []byte(testSavedTables)
+	platform.SetExecutor(executor)
+	defer platform.SetExecutor(platform.NewExecutor())
+	SetBackend(&ebtablesBackend{})
+
+	err := SetArpReply(testIP, testMac, Delete)
+	if err != nil || len(executor.Commands) != 1 || executor.Commands[0] != command {
+		t.Errorf("Unexpected commands:\n%v\nerr:%v", executor, err)
+	}
+
+	// A rule that is not in an owned chain is deleted from the saved table.
+	executor.Commands = nil
+	executor.Errors[command] = fmt.Errorf("Rule not found")
+
+	err = SetArpReply(testIP, testMac, Delete)
+	if err != nil || len(executor.Commands) != 3 ||
+		executor.Commands[1] != "ebtables-save" ||
+		!strings.HasPrefix(executor.Commands[2], "sh -c ebtables-restore < ") {
+		t.Errorf("Unexpected commands:\n%v\nerr:%v", executor, err)
+	}
+}
+
+// Tests that only rules in owned chains are listed.
+func TestOnlyOwnedRulesAreListed(t *testing.T) {
+	listed := `Bridge table: nat
+
+Bridge chain: PREROUTING, entries: 2, policy: ACCEPT
+-j AZURE-VNET-PREROUTING
+-p ARP --arp-op Request --arp-ip-dst 10.0.0.5 -j arpreply --arpreply-mac 12:34:56:78:9a:bc --arpreply-target DROP
+
+Bridge chain: AZURE-VNET-PREROUTING, entries: 1, policy: RETURN
+-p ARP --arp-op Request --arp-ip-dst 10.0.0.4 -j arpreply --arpreply-mac 12:34:56:78:9a:bc --arpreply-target DROP
+`
+
+	executor := platform.NewRecordingExecutor()
+	executor.Outputs["ebtables -t nat -L --Lmac2"] = []byte(listed)
+	platform.SetExecutor(executor)
+	defer platform.SetExecutor(platform.NewExecutor())
+
+	tests := []struct {
+		name    string
+		backend *ebtablesBackend
+		ip      net.IP
+	}{
+		{"owned chains", &ebtablesBackend{}, testIP},
+		{"built-in chains", &ebtablesBackend{builtinChains: true}, net.ParseIP("10.0.0.5")},
+	}
+
+	for _, test := range tests {
+		rules, err := test.backend.List()
+		if err != nil || len(rules) != 1 || !rules[0].IPAddress.Equal(test.ip) {
+			t.Errorf("%s: listed %v, err:%v", test.name, rules, err)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ebtables
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"unsafe"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/netlink"
+	"github.com/Azure/azure-container-networking/platform"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// The arpreply xtables target may only be used from a table named nat.
+	nftTable = "nat"
+
+	// Base chains owned by this backend.
+	nftPreroutingChain  = "azure-vnet-prerouting"
+	nftPostroutingChain = "azure-vnet-postrouting"
+
+	// Ethernet protocols.
+	ethProtoIPv4 = 0x0800
+	ethProtoArp  = 0x0806
+
+	// ARP operations.
+	arpOpRequest = 1
+	arpOpReply   = 2
+
+	// Header offsets.
+	ethDstOffset     = 0
+	ethSrcOffset     = 6
+	ethTypeOffset    = 12
+	arpOpOffset      = 6
+	arpShaOffset     = 8
+	arpTpaOffset     = 24
+	ipv4DstOffset    = 16
+	ifNameSize       = unix.IFNAMSIZ
+	ebtDrop          = -2
+	nftUserDataType  = 0
+	nftUserDataLimit = 255
+
+	// Rule comments.
+	nftCommentPrefix   = "azure-vnet "
+	nftCompanionSuffix = " arp"
+)
+
+// nftablesBackend programs rules as native nftables bridge family rules over netlink.
+type nftablesBackend struct {
+	nativeEndian binary.ByteOrder
+}
+
+// Creates a new nftables backend.
+func newNftablesBackend() *nftablesBackend {
+	var x uint16 = 0x0102
+	b := &nftablesBackend{nativeEndian: binary.LittleEndian}
+	if *(*byte)(unsafe.Pointer(&x)) == 0x01 {
+		b.nativeEndian = binary.BigEndian
+	}
+
+	return b
+}
+
+// isNftablesAvailable returns whether the kernel supports nftables.
+func isNftablesAvailable() bool {
+	_, err := netlink.GetNftRules(netlink.NFPROTO_BRIDGE, nftTable, nftPreroutingChain)
+	if err != nil && err != unix.ENOENT {
+		log.Printf("[ebtables] nftables is not available, err:%v.", err)
+		return false
+	}
+
+	return true
+}
+
+// Name returns the name of the backend.
+func (b *nftablesBackend) Name() string {
+	return "nftables"
+}
+
+// Apply applies a set of rule changes atomically in a single nftables batch.
+func (b *nftablesBackend) Apply(changes []*Change) error {
+	// Changes are made over netlink rather than by commands, so report them here in dry-run mode.
+	if platform.IsDryRun() {
+		for _, change := range changes {
+			log.Printf("[dry-run] nft %s %s", change.Action, change.Rule)
+		}
+		return nil
+	}
+
+	batch := netlink.NewNftBatch()
+
+	// Make sure the table and base chains exist.
+	batch.AddTable(netlink.NFPROTO_BRIDGE, nftTable)
+	batch.AddChain(&netlink.NftChain{
+		Family:   netlink.NFPROTO_BRIDGE,
+		Table:    nftTable,
+		Name:     nftPreroutingChain,
+		Type:     netlink.NFT_CHAIN_TYPE_FILTER,
+		Hook:     netlink.NF_BR_PRE_ROUTING,
+		Priority: netlink.NF_BR_PRI_NAT_DST_BRIDGED,
+	})
+	batch.AddChain(&netlink.NftChain{
+		Family:   netlink.NFPROTO_BRIDGE,
+		Table:    nftTable,
+		Name:     nftPostroutingChain,
+		Type:     netlink.NFT_CHAIN_TYPE_FILTER,
+		Hook:     netlink.NF_BR_POST_ROUTING,
+		Priority: netlink.NF_BR_PRI_NAT_SRC,
+	})
+
+	// Existing rules by chain, loaded on demand for deletions.
+	existing := make(map[string][]*netlink.NftRule)
+
+	for _, change := range changes {
+		rules := b.translate(change.Rule)
+
+		for _, rule := range rules {
+			switch change.Action {
+			case Append:
+				batch.AddRule(rule)
+
+			case Delete:
+				if _, ok := existing[rule.Chain]; !ok {
+					chainRules, err := netlink.GetNftRules(rule.Family, rule.Table, rule.Chain)
+					if err != nil && err != unix.ENOENT {
+						return err
+					}
+					existing[rule.Chain] = chainRules
+				}
+
+				// Delete the first matching rule, like ebtables does.
+				found := false
+				chainRules := existing[rule.Chain]
+				for i, r := range chainRules {
+					if string(r.UserData) == string(rule.UserData) {
+						batch.DeleteRule(r)
+						existing[rule.Chain] = append(chainRules[:i:i], chainRules[i+1:]...)
+						found = true
+						break
+					}
+				}
+
+				if !found {
+					return fmt.Errorf("Rule not found: %s", change.Rule)
+				}
+
+			default:
+				return fmt.Errorf("Invalid action %s", change.Action)
+			}
+		}
+	}
+
+	err := batch.Commit()
+	if err != nil {
+		log.Printf("[ebtables] Failed to commit nftables batch, err:%v.", err)
+	}
+
+	return err
+}
+
+// migrateLegacyRules moves the rules created through ebtables-nft by earlier releases, which live
+// in the built-in chains of the nat table, into the chains owned by the nftables backend.
+func migrateLegacyRules(b Backend, legacy Backend) {
+	rules, err := legacy.List()
+	if err != nil {
+		log.Printf("[ebtables] Failed to list legacy rules, err:%v.", err)
+		return
+	}
+
+	for _, rule := range rules {
+		err = b.Apply([]*Change{{Action: Append, Rule: rule}})
+		if err != nil {
+			log.Printf("[ebtables] Failed to migrate rule %s, err:%v.", rule, err)
+			continue
+		}
+
+		err = legacy.Apply([]*Change{{Action: Delete, Rule: rule}})
+		if err != nil {
+			log.Printf("[ebtables] Failed to delete legacy rule %s, err:%v.", rule, err)
+			b.Apply([]*Change{{Action: Delete, Rule: rule}})
+			continue
+		}
+
+		log.Printf("[ebtables] Migrated legacy rule %s.", rule)
+	}
+}
+
+// List returns the rules currently programmed by this backend.
+func (b *nftablesBackend) List() ([]*Rule, error) {
+	var rules []*Rule
+
+	for _, chain := range []string{nftPreroutingChain, nftPostroutingChain} {
+		nftRules, err := netlink.GetNftRules(netlink.NFPROTO_BRIDGE, nftTable, chain)
+		if err != nil {
+			if err == unix.ENOENT {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, nftRule := range nftRules {
+			comment := parseComment(nftRule.UserData)
+			if !strings.HasPrefix(comment, nftCommentPrefix) {
+				continue
+			}
+
+			// Skip the companion rules that are part of a single rule.
+			text := strings.TrimPrefix(comment, nftCommentPrefix)
+			if strings.HasSuffix(text, nftCompanionSuffix) {
+				continue
+			}
+
+			rule := parseRule(text)
+			if rule != nil {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// translate returns the nftables rules that implement a rule.
+func (b *nftablesBackend) translate(rule *Rule) []*netlink.NftRule {
+	var rules []*netlink.NftRule
+
+	switch rule.Type {
+	case RuleSnatForInterface:
+		// ARP senders also carry their hardware address in the ARP header.
+		arp := b.newRule(nftPostroutingChain, rule, nftCompanionSuffix)
+		arp.Expressions = concat(
+			matchInterface(netlink.NFT_META_OIFNAME, rule.InterfaceName),
+			matchUnicastSource(),
+			matchEtherType(ethProtoArp),
+			setPayload(netlink.NFT_PAYLOAD_NETWORK_HEADER, arpShaOffset, rule.MacAddress),
+			setPayload(netlink.NFT_PAYLOAD_LL_HEADER, ethSrcOffset, rule.MacAddress),
+			accept())
+
+		snat := b.newRule(nftPostroutingChain, rule, "")
+		snat.Expressions = concat(
+			matchInterface(netlink.NFT_META_OIFNAME, rule.InterfaceName),
+			matchUnicastSource(),
+			setPayload(netlink.NFT_PAYLOAD_LL_HEADER, ethSrcOffset, rule.MacAddress),
+			accept())
+
+		rules = append(rules, arp, snat)
+
+	case RuleArpReply:
+		// There is no native ARP reply statement, so use the xtables target.
+		reply := b.newRule(nftPreroutingChain, rule, "")
+		reply.CompatProtocol = ethProtoArp
+		reply.Expressions = concat(
+			matchEtherType(ethProtoArp),
+			matchPayload(netlink.NFT_PAYLOAD_NETWORK_HEADER, arpOpOffset, uint16Bytes(arpOpRequest)),
+			matchPayload(netlink.NFT_PAYLOAD_NETWORK_HEADER, arpTpaOffset, rule.IPAddress.To4()),
+			[]*netlink.NftExpression{netlink.NftTarget("arpreply", 0, b.arpReplyInfo(rule.MacAddress))})
+
+		rules = append(rules, reply)
+
+	case RuleDnatForArpReplies:
+		broadcast, _ := net.ParseMAC("ff:ff:ff:ff:ff:ff")
+		dnat := b.newRule(nftPreroutingChain, rule, "")
+		dnat.Expressions = concat(
+			matchInterface(netlink.NFT_META_IIFNAME, rule.InterfaceName),
+			matchEtherType(ethProtoArp),
+			matchPayload(netlink.NFT_PAYLOAD_NETWORK_HEADER, arpOpOffset, uint16Bytes(arpOpReply)),
+			setPayload(netlink.NFT_PAYLOAD_LL_HEADER, ethDstOffset, broadcast),
+			setPacketType(unix.PACKET_BROADCAST),
+			accept())
+
+		rules = append(rules, dnat)
+
+	case RuleDnatForInterface:
+		dnat := b.newRule(nftPreroutingChain, rule, "")
+		dnat.Expressions = concat(
+			matchInterface(netlink.NFT_META_IIFNAME, rule.InterfaceName),
+			setPayload(netlink.NFT_PAYLOAD_LL_HEADER, ethDstOffset, rule.MacAddress),
+			setPacketType(unix.PACKET_OTHERHOST),
+			accept())
+
+		rules = append(rules, dnat)
+
+	case RuleDnatForIPAddress:
+		dnat := b.newRule(nftPreroutingChain, rule, "")
+		dnat.Expressions = concat(
+			matchInterface(netlink.NFT_META_IIFNAME, rule.InterfaceName),
+			matchEtherType(ethProtoIPv4),
+			matchPayload(netlink.NFT_PAYLOAD_NETWORK_HEADER, ipv4DstOffset, rule.IPAddress.To4()),
+			setPayload(netlink.NFT_PAYLOAD_LL_HEADER, ethDstOffset, rule.MacAddress),
+			setPacketType(unix.PACKET_OTHERHOST),
+			accept())
+
+		rules = append(rules, dnat)
+	}
+
+	return rules
+}
+
+// newRule creates a new nftables rule in a chain, tagged so that it can be found for deletion.
+func (b *nftablesBackend) newRule(chain string, rule *Rule, suffix string) *netlink.NftRule {
+	// Tag rules with a comment in the format used by the nft tool.
+	comment := nftCommentPrefix + rule.String() + suffix
+	if len(comment) >= nftUserDataLimit {
+		comment = comment[:nftUserDataLimit-1]
+	}
+
+	userData := []byte{nftUserDataType, byte(len(comment) + 1)}
+	userData = append(userData, comment...)
+	userData = append(userData, 0)
+
+	return &netlink.NftRule{
+		Family:   netlink.NFPROTO_BRIDGE,
+		Table:    nftTable,
+		Chain:    chain,
+		UserData: userData,
+	}
+}
+
+// parseComment returns the comment in the user data of a rule.
+func parseComment(userData []byte) string {
+	for len(userData) >= 2 {
+		length := int(userData[1])
+		if len(userData) < 2+length {
+			break
+		}
+
+		if userData[0] == nftUserDataType {
+			return strings.TrimRight(string(userData[2:2+length]), "\x00")
+		}
+
+		userData = userData[2+length:]
+	}
+
+	return ""
+}
+
+// arpReplyInfo returns the arpreply target parameters, a struct ebt_arpreply_info.
+func (b *nftablesBackend) arpReplyInfo(macAddress net.HardwareAddr) []byte {
+	var target int32 = ebtDrop
+
+	info := make([]byte, 12)
+	copy(info[0:6], macAddress)
+	b.nativeEndian.PutUint32(info[8:12], uint32(target))
+	return info
+}
+
+// matchInterface matches the input or output interface name. A trailing "+" matches a prefix.
+func matchInterface(key int, interfaceName string) []*netlink.NftExpression {
+	var name []byte
+
+	if strings.HasSuffix(interfaceName, "+") {
+		name = []byte(strings.TrimSuffix(interfaceName, "+"))
+	} else {
+		name = make([]byte, ifNameSize)
+		copy(name, interfaceName)
+	}
+
+	return []*netlink.NftExpression{
+		netlink.NftMetaLoad(key, netlink.NFT_REG_1),
+		netlink.NftCmpEq(netlink.NFT_REG_1, name),
+	}
+}
+
+// matchUnicastSource matches frames with a unicast source MAC address.
+func matchUnicastSource() []*netlink.NftExpression {
+	return []*netlink.NftExpression{
+		netlink.NftPayloadLoad(netlink.NFT_PAYLOAD_LL_HEADER, ethSrcOffset, 1, netlink.NFT_REG_1),
+		netlink.NftBitwise(netlink.NFT_REG_1, netlink.NFT_REG_1, []byte{0x01}, []byte{0x00}),
+		netlink.NftCmpEq(netlink.NFT_REG_1, []byte{0x00}),
+	}
+}
+
+// matchEtherType matches the ethernet protocol of a frame.
+func matchEtherType(protocol uint16) []*netlink.NftExpression {
+	return matchPayload(netlink.NFT_PAYLOAD_LL_HEADER, ethTypeOffset, uint16Bytes(protocol))
+}
+
+// matchPayload matches packet data at the given offset.
+func matchPayload(base int, offset int, data []byte) []*netlink.NftExpression {
+	return []*netlink.NftExpression{
+		netlink.NftPayloadLoad(base, offset, len(data), netlink.NFT_REG_1),
+		netlink.NftCmpEq(netlink.NFT_REG_1, data),
+	}
+}
+
+// setPayload overwrites packet data at the given offset.
+func setPayload(base int, offset int, data []byte) []*netlink.NftExpression {
+	return []*netlink.NftExpression{
+		netlink.NftImmediateData(netlink.NFT_REG_1, data),
+		netlink.NftPayloadWrite(netlink.NFT_REG_1, base, offset, len(data)),
+	}
+}
+
+// setPacketType sets the packet type of a frame whose destination MAC address was rewritten,
+// like the ebtables dnat target does. Unicast DNAT rules rewrite the destination to endpoint
+// or upstream virtual MAC addresses, never to the address of the bridge itself, so their
+// frames are always destined to other hosts.
+func setPacketType(pktType int) []*netlink.NftExpression {
+	return []*netlink.NftExpression{
+		netlink.NftImmediateData(netlink.NFT_REG_1, []byte{byte(pktType)}),
+		netlink.NftMetaStore(netlink.NFT_META_PKTTYPE, netlink.NFT_REG_1),
+	}
+}
+
+// accept ends rule evaluation and accepts the frame.
+func accept() []*netlink.NftExpression {
+	return []*netlink.NftExpression{netlink.NftImmediateVerdict(netlink.NF_ACCEPT)}
+}
+
+// concat joins lists of expressions.
+func concat(lists ...[]*netlink.NftExpression) []*netlink.NftExpression {
+	var exprs []*netlink.NftExpression
+	for _, list := range lists {
+		exprs = append(exprs, list...)
+	}
+	return exprs
+}
+
+// uint16Bytes returns a uint16 in network byte order.
+func uint16Bytes(value uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, value)
+	return b
+}
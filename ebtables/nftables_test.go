@@ -0,0 +1,296 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ebtables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-container-networking/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Tests that rules are translated into the expected nftables rules.
+func TestRulesAreTranslated(t *testing.T) {
+	b := newNftablesBackend()
+	broadcast, _ := net.ParseMAC("ff:ff:ff:ff:ff:ff")
+
+	ifName := make([]byte, unix.IFNAMSIZ)
+	copy(ifName, "eth0")
+
+	iif := []*netlink.NftExpression{
+		netlink.NftMetaLoad(netlink.NFT_META_IIFNAME, netlink.NFT_REG_1),
+		netlink.NftCmpEq(netlink.NFT_REG_1, ifName),
+	}
+	oif := []*netlink.NftExpression{
+		netlink.NftMetaLoad(netlink.NFT_META_OIFNAME, netlink.NFT_REG_1),
+		netlink.NftCmpEq(netlink.NFT_REG_1, ifName),
+	}
+	unicastSource := []*netlink.NftExpression{
+		netlink.NftPayloadLoad(netlink.NFT_PAYLOAD_LL_HEADER, 6, 1, netlink.NFT_REG_1),
+		netlink.NftBitwise(netlink.NFT_REG_1, netlink.NFT_REG_1, []byte{0x01}, []byte{0x00}),
+		netlink.NftCmpEq(netlink.NFT_REG_1, []byte{0x00}),
+	}
+	arp := []*netlink.NftExpression{
+		netlink.NftPayloadLoad(netlink.NFT_PAYLOAD_LL_HEADER, 12, 2, netlink.NFT_REG_1),
+		netlink.NftCmpEq(netlink.NFT_REG_1, []byte{0x08, 0x06}),
+	}
+	ipv4 := []*netlink.NftExpression{
+		netlink.NftPayloadLoad(netlink.NFT_PAYLOAD_LL_HEADER, 12, 2, netlink.NFT_REG_1),
+		netlink.NftCmpEq(netlink.NFT_REG_1, []byte{0x08, 0x00}),
+	}
+	accept := netlink.NftImmediateVerdict(netlink.NF_ACCEPT)
+
+	// Returns the expressions that write data into the link layer header.
+	setLL := func(offset int, data []byte) []*netlink.NftExpression {
+		return []*netlink.NftExpression{
+			netlink.NftImmediateData(netlink.NFT_REG_1, data),
+			netlink.NftPayloadWrite(netlink.NFT_REG_1, netlink.NFT_PAYLOAD_LL_HEADER, offset, len(data)),
+		}
+	}
+
+	// Returns the expressions that set the packet type.
+	setPktType := func(pktType byte) []*netlink.NftExpression {
+		return []*netlink.NftExpression{
+			netlink.NftImmediateData(netlink.NFT_REG_1, []byte{pktType}),
+			netlink.NftMetaStore(netlink.NFT_META_PKTTYPE, netlink.NFT_REG_1),
+		}
+	}
+
+	tests := []struct {
+		name     string
+		rule     *Rule
+		chain    string
+		compat   uint16
+		suffixes []string
+		exprs    [][]*netlink.NftExpression
+	}{
+		{
+			name:     "snat for interface",
+			rule:     &Rule{Type: RuleSnatForInterface, InterfaceName: "eth0", MacAddress: testMac},
+			chain:    nftPostroutingChain,
+			suffixes: []string{nftCompanionSuffix, ""},
+			exprs: [][]*netlink.NftExpression{
+				concat(oif, unicastSource, arp, []*netlink.NftExpression{
+					netlink.NftImmediateData(netlink.NFT_REG_1, testMac),
+					netlink.NftPayloadWrite(netlink.NFT_REG_1, netlink.NFT_PAYLOAD_NETWORK_HEADER, 8, 6),
+				}, setLL(6, testMac), []*netlink.NftExpression{accept}),
+				concat(oif, unicastSource, setLL(6, testMac), []*netlink.NftExpression{accept}),
+			},
+		},
+		{
+			name:     "arp reply",
+			rule:     &Rule{Type: RuleArpReply, IPAddress: testIP, MacAddress: testMac},
+			chain:    nftPreroutingChain,
+			compat:   ethProtoArp,
+			suffixes: []string{""},
+			exprs: [][]*netlink.NftExpression{
+				concat(arp, []*netlink.NftExpression{
+					netlink.NftPayloadLoad(netlink.NFT_PAYLOAD_NETWORK_HEADER, 6, 2, netlink.NFT_REG_1),
+					netlink.NftCmpEq(netlink.NFT_REG_1, []byte{0, 1}),
+					netlink.NftPayloadLoad(netlink.NFT_PAYLOAD_NETWORK_HEADER, 24, 4, netlink.NFT_REG_1),
+					netlink.NftCmpEq(netlink.NFT_REG_1, []byte{10, 0, 0, 4}),
+					netlink.NftTarget("arpreply", 0, b.arpReplyInfo(testMac)),
+				}),
+			},
+		},
+		{
+			name:     "dnat for arp replies",
+			rule:     &Rule{Type: RuleDnatForArpReplies, InterfaceName: "eth0"},
+			chain:    nftPreroutingChain,
+			suffixes: []string{""},
+			exprs: [][]*netlink.NftExpression{
+				concat(iif, arp, []*netlink.NftExpression{
+					netlink.NftPayloadLoad(netlink.NFT_PAYLOAD_NETWORK_HEADER, 6, 2, netlink.NFT_REG_1),
+					netlink.NftCmpEq(netlink.NFT_REG_1, []byte{0, 2}),
+				}, setLL(0, broadcast), setPktType(unix.PACKET_BROADCAST), []*netlink.NftExpression{accept}),
+			},
+		},
+		{
+			name:     "dnat for interface prefix",
+			rule:     &Rule{Type: RuleDnatForInterface, InterfaceName: "az+", MacAddress: testMac},
+			chain:    nftPreroutingChain,
+			suffixes: []string{""},
+			exprs: [][]*netlink.NftExpression{
+				concat([]*netlink.NftExpression{
+					netlink.NftMetaLoad(netlink.NFT_META_IIFNAME, netlink.NFT_REG_1),
+					netlink.NftCmpEq(netlink.NFT_REG_1, []byte("az")),
+				}, setLL(0, testMac), setPktType(unix.PACKET_OTHERHOST), []*netlink.NftExpression{accept}),
+			},
+		},
+		{
+			name:     "dnat for ip address",
+			rule:     &Rule{Type: RuleDnatForIPAddress, InterfaceName: "eth0", IPAddress: testIP, MacAddress: testMac},
+			chain:    nftPreroutingChain,
+			suffixes: []string{""},
+			exprs: [][]*netlink.NftExpression{
+				concat(iif, ipv4, []*netlink.NftExpression{
+					netlink.NftPayloadLoad(netlink.NFT_PAYLOAD_NETWORK_HEADER, 16, 4, netlink.NFT_REG_1),
+					netlink.NftCmpEq(netlink.NFT_REG_1, []byte{10, 0, 0, 4}),
+				}, setLL(0, testMac), setPktType(unix.PACKET_OTHERHOST), []*netlink.NftExpression{accept}),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		rules := b.translate(test.rule)
+		if len(rules) != len(test.exprs) {
+			t.Errorf("%s: translated into %d rules, expected %d", test.name, len(rules), len(test.exprs))
+			continue
+		}
+
+		for i, rule := range rules {
+			if rule.Family != netlink.NFPROTO_BRIDGE || rule.Table != nftTable || rule.Chain != test.chain {
+				t.Errorf("%s: rule %d is in %d %s %s", test.name, i, rule.Family, rule.Table, rule.Chain)
+			}
+
+			if rule.CompatProtocol != test.compat {
+				t.Errorf("%s: rule %d has compat protocol %x, expected %x", test.name, i, rule.CompatProtocol, test.compat)
+			}
+
+			comment := nftCommentPrefix + test.rule.String() + test.suffixes[i]
+			if parseComment(rule.UserData) != comment {
+				t.Errorf("%s: rule %d has comment %q, expected %q", test.name, i, parseComment(rule.UserData), comment)
+			}
+
+			if !reflect.DeepEqual(rule.Expressions, test.exprs[i]) {
+				t.Errorf("%s: rule %d expressions do not match", test.name, i)
+			}
+		}
+	}
+}
+
+// Tests that rule comments are parsed from rule user data.
+func TestCommentsAreParsed(t *testing.T) {
+	tests := []struct {
+		name     string
+		userData []byte
+		comment  string
+	}{
+		{"empty", nil, ""},
+		{"comment", []byte{0, 4, 'a', 'b', 'c', 0}, "abc"},
+		{"comment after other type", []byte{1, 1, 'x', 0, 3, 'a', 'b', 0}, "ab"},
+		{"truncated", []byte{0, 8, 'a', 'b'}, ""},
+		{"no comment", []byte{1, 2, 'a', 'b'}, ""},
+	}
+
+	for _, test := range tests {
+		if comment := parseComment(test.userData); comment != test.comment {
+			t.Errorf("%s: parsed comment %q, expected %q", test.name, comment, test.comment)
+		}
+	}
+
+	// Comments longer than the user data limit are truncated.
+	rule := &Rule{Type: RuleSnatForInterface, InterfaceName: strings.Repeat("x", 300), MacAddress: testMac}
+	userData := newNftablesBackend().newRule(nftPostroutingChain, rule, "").UserData
+	if len(userData) != nftUserDataLimit+2 || !strings.HasPrefix(parseComment(userData), nftCommentPrefix) {
+		t.Errorf("Unexpected user data of length %d for a long comment", len(userData))
+	}
+}
+
+// Tests that the arpreply target parameters are encoded in the byte order of the host.
+func TestArpReplyInfoIsEncoded(t *testing.T) {
+	tests := []struct {
+		name   string
+		endian binary.ByteOrder
+		target []byte
+	}{
+		{"little endian", binary.LittleEndian, []byte{0xfe, 0xff, 0xff, 0xff}},
+		{"big endian", binary.BigEndian, []byte{0xff, 0xff, 0xff, 0xfe}},
+	}
+
+	for _, test := range tests {
+		b := &nftablesBackend{nativeEndian: test.endian}
+		info := b.arpReplyInfo(testMac)
+
+		if len(info) != 12 || !bytes.Equal(info[0:6], testMac) || !bytes.Equal(info[6:8], []byte{0, 0}) {
+			t.Errorf("%s: unexpected info %v", test.name, info)
+		}
+
+		if !bytes.Equal(info[8:12], test.target) {
+			t.Errorf("%s: target %v, expected %v", test.name, info[8:12], test.target)
+		}
+	}
+}
+
+// Tests that interface names match exactly and names ending in "+" match a prefix.
+func TestInterfacesAreMatched(t *testing.T) {
+	tests := []struct {
+		name          string
+		interfaceName string
+		data          []byte
+	}{
+		{"exact", "eth0", append([]byte("eth0"), make([]byte, unix.IFNAMSIZ-4)...)},
+		{"prefix", "azv+", []byte("azv")},
+	}
+
+	for _, test := range tests {
+		exprs := matchInterface(netlink.NFT_META_IIFNAME, test.interfaceName)
+		expected := []*netlink.NftExpression{
+			netlink.NftMetaLoad(netlink.NFT_META_IIFNAME, netlink.NFT_REG_1),
+			netlink.NftCmpEq(netlink.NFT_REG_1, test.data),
+		}
+
+		if !reflect.DeepEqual(exprs, expected) {
+			t.Errorf("%s: expressions do not match %q", test.name, test.data)
+		}
+	}
+}
+
+// Tests that rules created through ebtables-nft are moved into the chains of the nftables backend.
+func TestLegacyRulesAreMigrated(t *testing.T) {
+	rule := &Rule{Type: RuleArpReply, IPAddress: testIP, MacAddress: testMac}
+	failing := &Rule{Type: RuleArpReply, IPAddress: net.ParseIP("10.0.0.9"), MacAddress: testMac}
+
+	legacy := &fakeBackend{rules: []*Rule{rule, failing}, failDelete: failing.String()}
+	nft := &fakeBackend{}
+
+	migrateLegacyRules(nft, legacy)
+
+	if len(legacy.rules) != 1 || legacy.rules[0] != failing {
+		t.Errorf("Legacy rules after migration: %v", legacy.rules)
+	}
+
+	if len(nft.rules) != 1 || nft.rules[0] != rule {
+		t.Errorf("Migrated rules: %v", nft.rules)
+	}
+}
+
+// fakeBackend keeps rules in memory.
+type fakeBackend struct {
+	rules      []*Rule
+	failDelete string
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) Apply(changes []*Change) error {
+	for _, change := range changes {
+		if change.Action == Append {
+			b.rules = append(b.rules, change.Rule)
+			continue
+		}
+
+		if change.Rule.String() == b.failDelete {
+			return unix.ENOENT
+		}
+
+		for i, r := range b.rules {
+			if r.String() == change.Rule.String() {
+				b.rules = append(b.rules[:i], b.rules[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *fakeBackend) List() ([]*Rule, error) {
+	return append([]*Rule{}, b.rules...), nil
+}
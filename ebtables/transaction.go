@@ -0,0 +1,122 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ebtables
+
+import (
+	"net"
+	"strings"
+)
+
+// Transaction gathers a set of rule changes and commits them atomically.
+// If any change fails, none of the changes are applied.
+type Transaction struct {
+	changes []*Change
+	err     error
+}
+
+// NewTransaction creates a new empty transaction.
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+// SetSnatForInterface adds a MAC SNAT rule change for an interface to the transaction.
+func (tx *Transaction) SetSnatForInterface(interfaceName string, macAddress net.HardwareAddr, action string) {
+	tx.add(action, &Rule{
+		Type:          RuleSnatForInterface,
+		InterfaceName: interfaceName,
+		MacAddress:    macAddress,
+	})
+}
+
+// SetArpReply adds an ARP reply rule change for the given target IP address and MAC address to the transaction.
+func (tx *Transaction) SetArpReply(ipAddress net.IP, macAddress net.HardwareAddr, action string) {
+	tx.add(action, &Rule{
+		Type:       RuleArpReply,
+		IPAddress:  ipAddress,
+		MacAddress: macAddress,
+	})
+}
+
+// SetDnatForArpReplies adds a MAC DNAT rule change for ARP replies received on an interface to the transaction.
+func (tx *Transaction) SetDnatForArpReplies(interfaceName string, action string) {
+	tx.add(action, &Rule{
+		Type:          RuleDnatForArpReplies,
+		InterfaceName: interfaceName,
+	})
+}
+
+// SetVepaMode adds the rule changes for VEPA mode on a bridge and its ports to the transaction.
+func (tx *Transaction) SetVepaMode(bridgeName string, downstreamIfNamePrefix string, upstreamMacAddress string, action string) {
+	macAddress, err := net.ParseMAC(upstreamMacAddress)
+	if err != nil {
+		tx.err = err
+		return
+	}
+
+	if !strings.HasPrefix(bridgeName, downstreamIfNamePrefix) {
+		tx.add(action, &Rule{
+			Type:          RuleDnatForInterface,
+			InterfaceName: bridgeName,
+			MacAddress:    macAddress,
+		})
+	}
+
+	tx.add(action, &Rule{
+		Type:          RuleDnatForInterface,
+		InterfaceName: downstreamIfNamePrefix + "+",
+		MacAddress:    macAddress,
+	})
+}
+
+// SetDnatForIPAddress adds a MAC DNAT rule change for an IP address to the transaction.
+func (tx *Transaction) SetDnatForIPAddress(interfaceName string, ipAddress net.IP, macAddress net.HardwareAddr, action string) {
+	tx.add(action, &Rule{
+		Type:          RuleDnatForIPAddress,
+		InterfaceName: interfaceName,
+		IPAddress:     ipAddress,
+		MacAddress:    macAddress,
+	})
+}
+
+// Add adds a change of an arbitrary rule to the transaction.
+func (tx *Transaction) Add(action string, rule *Rule) {
+	tx.add(action, rule)
+}
+
+// Changes returns the rule changes gathered in the transaction.
+func (tx *Transaction) Changes() []*Change {
+	return tx.changes
+}
+
+// Commit applies all rule changes in the transaction atomically.
+// On failure, none of the changes are applied.
+func (tx *Transaction) Commit() error {
+	if tx.err != nil {
+		return tx.err
+	}
+
+	if len(tx.changes) == 0 {
+		return nil
+	}
+
+	err := GetBackend().Apply(tx.changes)
+	if err != nil {
+		return err
+	}
+
+	tx.changes = nil
+
+	return nil
+}
+
+// Rollback discards all rule changes in the transaction.
+func (tx *Transaction) Rollback() {
+	tx.changes = nil
+	tx.err = nil
+}
+
+// add appends a rule change to the transaction.
+func (tx *Transaction) add(action string, rule *Rule) {
+	tx.changes = append(tx.changes, &Change{Action: action, Rule: rule})
+}
@@ -18,16 +18,24 @@ var (
 	errAddressPoolNotFound     = fmt.Errorf("Address pool not found")
 	errAddressPoolInUse        = fmt.Errorf("Address pool already in use")
 	errAddressPoolNotInUse     = fmt.Errorf("Address pool not in use")
+	errPoolOptionsConflict     = fmt.Errorf("Address pool is in use with different options")
 	errNoAvailableAddressPools = fmt.Errorf("No available address pools")
 	errAddressExists           = fmt.Errorf("Address already exists")
 	errAddressNotFound         = fmt.Errorf("Address not found")
 	errAddressInUse            = fmt.Errorf("Address already in use")
 	errAddressNotInUse         = fmt.Errorf("Address not in use")
+	errAddressExcluded         = fmt.Errorf("Address is excluded from allocation")
 	errNoAvailableAddresses    = fmt.Errorf("No available addresses")
+	errAddressSpaceConflict    = fmt.Errorf("Address space was modified concurrently")
 
 	// Options used by AddressManager.
 	OptInterfaceName      = "azure.interface.name"
 	OptAddressID          = "azure.address.id"
 	OptAddressType        = "azure.address.type"
+	OptContainerID        = "azure.container.id"
+	OptNetNsPath          = "azure.netns.path"
+	OptChildPrefixLength  = "azure.child.prefixlength"
+	OptAllocationStrategy = "azure.allocation.strategy"
+	OptExclusions         = "azure.address.exclusions"
 	OptAddressTypeGateway = "gateway"
 )
@@ -0,0 +1,158 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+)
+
+// AddressInfo contains information about an address in a pool.
+type AddressInfo struct {
+	Address     net.IP
+	AsId        string
+	PoolId      string
+	InUse       bool
+	OwnerID     string
+	ContainerID string
+	NetNsPath   string
+	AllocatedAt time.Time
+	ReleasedAt  time.Time
+	OrphanedAt  time.Time
+	Unhealthy   bool
+	Epoch       int
+}
+
+// ListAddresses returns all addresses in the given address pool, sorted by address.
+func (am *addressManager) ListAddresses(asId, poolId string) ([]*AddressInfo, error) {
+	var infos []*AddressInfo
+
+	am.Lock()
+	defer am.Unlock()
+
+	as, err := am.getAddressSpace(asId)
+	if err != nil {
+		return nil, err
+	}
+
+	ap, child, err := as.getPoolOrChild(poolId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ar := range ap.Addresses {
+		if child != nil && !child.Subnet.Contains(ar.Addr) {
+			continue
+		}
+
+		infos = append(infos, ap.getAddressInfo(ar))
+	}
+
+	sortAddressInfos(infos)
+
+	return infos, nil
+}
+
+// FindAddress returns information about the given address in any address space.
+func (am *addressManager) FindAddress(address string) (*AddressInfo, error) {
+	am.Lock()
+	defer am.Unlock()
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, errInvalidAddress
+	}
+
+	for _, as := range am.AddrSpaces {
+		for _, ap := range as.Pools {
+			if !ap.Subnet.Contains(ip) {
+				continue
+			}
+
+			ar := ap.Addresses[ip.String()]
+			if ar != nil {
+				return ap.getAddressInfo(ar), nil
+			}
+		}
+	}
+
+	return nil, errAddressNotFound
+}
+
+// FindAddressByOwner returns the addresses owned by the given address ID or container ID.
+func (am *addressManager) FindAddressByOwner(id string) ([]*AddressInfo, error) {
+	var infos []*AddressInfo
+
+	am.Lock()
+	defer am.Unlock()
+
+	if id == "" {
+		return nil, errAddressNotFound
+	}
+
+	for _, as := range am.AddrSpaces {
+		for _, ap := range as.Pools {
+			for _, ar := range ap.Addresses {
+				if ar.ID == id ||
+					(ar.Lease != nil && (ar.Lease.OwnerID == id || ar.Lease.ContainerID == id)) {
+					infos = append(infos, ap.getAddressInfo(ar))
+				}
+			}
+		}
+	}
+
+	if len(infos) == 0 {
+		return nil, errAddressNotFound
+	}
+
+	sortAddressInfos(infos)
+
+	return infos, nil
+}
+
+// Returns information about an address record in the pool.
+func (ap *addressPool) getAddressInfo(ar *addressRecord) *AddressInfo {
+	info := &AddressInfo{
+		Address:    ar.Addr,
+		PoolId:     ap.Id,
+		InUse:      ar.InUse || ar.ID != "",
+		OwnerID:    ar.ID,
+		ReleasedAt: ar.ReleasedAt,
+		OrphanedAt: ar.OrphanedAt,
+		Unhealthy:  ar.unhealthy || ar.Conflict,
+		Epoch:      ar.epoch,
+	}
+
+	if ap.as != nil {
+		info.AsId = ap.as.Id
+	}
+
+	// Report the child subnet the address belongs to.
+	for _, cp := range ap.Children {
+		if cp.Subnet.Contains(ar.Addr) {
+			info.PoolId = cp.Id
+			break
+		}
+	}
+
+	if ar.Lease != nil {
+		if info.OwnerID == "" {
+			info.OwnerID = ar.Lease.OwnerID
+		}
+		info.ContainerID = ar.Lease.ContainerID
+		info.NetNsPath = ar.Lease.NetNsPath
+		info.AllocatedAt = ar.Lease.AllocatedAt
+	}
+
+	return info
+}
+
+// Sorts address information by address.
+func sortAddressInfos(infos []*AddressInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return bytes.Compare(infos[i].Address.To16(), infos[j].Address.To16()) < 0
+	})
+}
@@ -150,6 +150,11 @@ func (s *azureSource) refresh() error {
 
 				address := net.ParseIP(a.Address)
 
+				// The well-known IPv6 gateway and DNS host IDs are reserved by the VNET.
+				if ap.IsIPv6 && ap.isReservedAddress(address) {
+					continue
+				}
+
 				_, err = ap.newAddressRecord(&address)
 				if err != nil {
 					log.Printf("[ipam] Failed to create address:%v err:%v.", address, err)
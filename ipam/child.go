@@ -0,0 +1,212 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Default size of child subnets carved out of address pools.
+	defaultIPv4ChildPrefixLength = 28
+	defaultIPv6ChildPrefixLength = 124
+)
+
+// Represents a fixed-size block of addresses carved out of an address pool.
+type childPool struct {
+	Id       string
+	Subnet   net.IPNet
+	RefCount int
+}
+
+// Returns whether a pool request is for a child subnet.
+func isChildPoolRequest(subPoolId string, options map[string]string) bool {
+	return subPoolId != "" || options[OptChildPrefixLength] != ""
+}
+
+// Returns the address pool with the given pool ID, and the child pool if the ID refers to a child subnet.
+func (as *addressSpace) getPoolOrChild(poolId string) (*addressPool, *childPool, error) {
+	if ap := as.Pools[poolId]; ap != nil {
+		return ap, nil, nil
+	}
+
+	for _, ap := range as.Pools {
+		if cp := ap.Children[poolId]; cp != nil {
+			return ap, cp, nil
+		}
+	}
+
+	return nil, nil, errInvalidPoolId
+}
+
+// Returns the prefix length of child subnets requested with the given options.
+func (ap *addressPool) getChildPrefixLength(options map[string]string) (int, error) {
+	ones, bits := ap.Subnet.Mask.Size()
+
+	prefixLength := defaultIPv4ChildPrefixLength
+	if ap.IsIPv6 {
+		prefixLength = defaultIPv6ChildPrefixLength
+	}
+
+	if s := options[OptChildPrefixLength]; s != "" {
+		var err error
+		prefixLength, err = strconv.Atoi(s)
+		if err != nil {
+			return 0, errInvalidConfiguration
+		}
+	}
+
+	if prefixLength <= ones || prefixLength > bits {
+		return 0, errInvalidConfiguration
+	}
+
+	return prefixLength, nil
+}
+
+// Parses a child subnet and validates that it can be carved out of the pool.
+func (ap *addressPool) parseChildSubnet(subPoolId string) (*net.IPNet, error) {
+	ip, subnet, err := net.ParseCIDR(subPoolId)
+	if err != nil || !ip.Equal(subnet.IP) {
+		return nil, errInvalidPoolId
+	}
+
+	ones, _ := ap.Subnet.Mask.Size()
+	childOnes, _ := subnet.Mask.Size()
+
+	if (subnet.IP.To4() == nil) != ap.IsIPv6 || childOnes <= ones || !ap.Subnet.Contains(subnet.IP) {
+		return nil, errInvalidPoolId
+	}
+
+	return subnet, nil
+}
+
+// Returns whether a subnet overlaps any child subnet other than itself.
+func (ap *addressPool) overlapsChild(subnet *net.IPNet) bool {
+	for id, cp := range ap.Children {
+		if id == subnet.String() {
+			continue
+		}
+
+		if cp.Subnet.Contains(subnet.IP) || subnet.Contains(cp.Subnet.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the lowest child subnet of the given size that has a free address and does not overlap others.
+func (ap *addressPool) findFreeChildSubnet(prefixLength int) *net.IPNet {
+	var selected *net.IPNet
+
+	_, bits := ap.Subnet.Mask.Size()
+	mask := net.CIDRMask(prefixLength, bits)
+	excluded := ap.getExcludedRanges()
+
+	for _, ar := range ap.Addresses {
+		if ar.InUse || ar.ID != "" || ar.Conflict || isExcludedAddress(ar.Addr, excluded) {
+			continue
+		}
+
+		subnet := &net.IPNet{IP: ar.Addr.Mask(mask), Mask: mask}
+
+		if ap.Children[subnet.String()] != nil || ap.overlapsChild(subnet) {
+			continue
+		}
+
+		if selected == nil || bytes.Compare(subnet.IP, selected.IP) < 0 {
+			selected = subnet
+		}
+	}
+
+	return selected
+}
+
+// Returns whether the child subnet requested can be carved out of the pool.
+func (ap *addressPool) canRequestChildPool(subPoolId string, options map[string]string) bool {
+	if subPoolId != "" {
+		subnet, err := ap.parseChildSubnet(subPoolId)
+		return err == nil && !ap.overlapsChild(subnet)
+	}
+
+	prefixLength, err := ap.getChildPrefixLength(options)
+	return err == nil && ap.findFreeChildSubnet(prefixLength) != nil
+}
+
+// Requests a specific or any free child subnet from the address pool.
+// Note sharing of child subnets is allowed when specifically requested.
+func (ap *addressPool) requestChildPool(subPoolId string, options map[string]string) (*childPool, error) {
+	var subnet *net.IPNet
+	var err error
+
+	if subPoolId != "" {
+		subnet, err = ap.parseChildSubnet(subPoolId)
+		if err != nil {
+			return nil, err
+		}
+
+		if ap.overlapsChild(subnet) {
+			return nil, errAddressPoolInUse
+		}
+	} else {
+		prefixLength, err := ap.getChildPrefixLength(options)
+		if err != nil {
+			return nil, err
+		}
+
+		subnet = ap.findFreeChildSubnet(prefixLength)
+		if subnet == nil {
+			return nil, errNoAvailableAddressPools
+		}
+	}
+
+	cp := ap.Children[subnet.String()]
+	if cp == nil {
+		cp = &childPool{
+			Id:     subnet.String(),
+			Subnet: *subnet,
+		}
+
+		if ap.Children == nil {
+			ap.Children = make(map[string]*childPool)
+		}
+		ap.Children[cp.Id] = cp
+
+		log.Printf("[ipam] Carved child subnet %v out of pool %v.", cp.Id, ap.Id)
+	}
+
+	cp.RefCount++
+
+	return cp, nil
+}
+
+// Releases a previously requested child subnet back to its address pool.
+func (ap *addressPool) releaseChildPool(cp *childPool) {
+	cp.RefCount--
+
+	if cp.RefCount <= 0 {
+		log.Printf("[ipam] Returning child subnet %v to pool %v.", cp.Id, ap.Id)
+		delete(ap.Children, cp.Id)
+	}
+}
+
+// Returns whether an address belongs to the given child subnet, or to the pool itself if child is nil.
+// Addresses in child subnets are handed out only from their child pool.
+func (ap *addressPool) isInScope(ar *addressRecord, cp *childPool) bool {
+	if cp != nil {
+		return cp.Subnet.Contains(ar.Addr)
+	}
+
+	for _, child := range ap.Children {
+		if child.Subnet.Contains(ar.Addr) {
+			return false
+		}
+	}
+
+	return true
+}
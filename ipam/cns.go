@@ -0,0 +1,178 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"net"
+	"time"
+
+	"github.com/Azure/azure-container-networking/client/cnsclient"
+	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Minimum time interval between consecutive queries.
+	cnsQueryInterval = 10 * time.Second
+)
+
+// Container Networking Service IPAM configuration source.
+type cnsSource struct {
+	name          string
+	sink          addressConfigSink
+	client        *cnsclient.CNSClient
+	queryInterval time.Duration
+	lastRefresh   time.Time
+	stateVersion  int
+	initialized   bool
+}
+
+// Creates the CNS source.
+func newCnsSource(options map[string]interface{}) (*cnsSource, error) {
+	url, _ := options[common.OptCnsURL].(string)
+
+	client, err := cnsclient.NewCnsClient(url)
+	if err != nil {
+		return nil, err
+	}
+
+	i, _ := options[common.OptIpamQueryInterval].(int)
+	queryInterval := time.Duration(i) * time.Second
+	if queryInterval == 0 {
+		queryInterval = cnsQueryInterval
+	}
+
+	return &cnsSource{
+		name:          "CNS",
+		client:        client,
+		queryInterval: queryInterval,
+	}, nil
+}
+
+// Starts the CNS source.
+func (s *cnsSource) start(sink addressConfigSink) error {
+	s.sink = sink
+	return nil
+}
+
+// Stops the CNS source.
+func (s *cnsSource) stop() {
+	s.sink = nil
+	return
+}
+
+// Refreshes configuration.
+func (s *cnsSource) refresh() error {
+
+	// Refresh only if enough time has passed since the last query.
+	if time.Since(s.lastRefresh) < s.queryInterval {
+		return nil
+	}
+	s.lastRefresh = time.Now()
+
+	// Fetch configuration.
+	resp, err := s.client.GetIPConfigurations()
+	if err != nil {
+		return err
+	}
+
+	// Skip if network containers have not changed since the last query.
+	if s.initialized && resp.StateVersion == s.stateVersion {
+		return nil
+	}
+
+	// Configure the local default address space.
+	local, err := s.sink.newAddressSpace(LocalDefaultAddressSpaceId, LocalScope)
+	if err != nil {
+		return err
+	}
+
+	// Query the list of local interfaces.
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	// For each network container...
+	for _, nc := range resp.IPConfigurations {
+		ipConfig := nc.IPConfiguration
+
+		address := net.ParseIP(ipConfig.IPSubnet.IPAddress)
+		if address == nil {
+			log.Printf("[ipam] Failed to parse address:%v of network container:%v.",
+				ipConfig.IPSubnet.IPAddress, nc.NetworkContainerid)
+			continue
+		}
+
+		v6 := (address.To4() == nil)
+		bits := 8 * net.IPv4len
+		if v6 {
+			bits = 8 * net.IPv6len
+		}
+
+		mask := net.CIDRMask(int(ipConfig.IPSubnet.PrefixLength), bits)
+		subnet := &net.IPNet{
+			IP:   address.Mask(mask),
+			Mask: mask,
+		}
+
+		ifName := findInterfaceByAddress(interfaces, nc.PrimaryInterfaceIdentifier)
+
+		// Network containers in the same subnet share a pool.
+		ap, err := local.newAddressPool(ifName, 0, subnet)
+		if err != nil && err != errAddressPoolExists {
+			log.Printf("[ipam] Failed to create pool:%v ifName:%v err:%v.", subnet, ifName, err)
+			continue
+		}
+
+		// Use the gateway and DNS servers configured for the network container.
+		gateways := parseAddresses([]string{ipConfig.GatewayIPAddress}, v6)
+		if len(gateways) > 0 {
+			ap.Gateway = gateways[0]
+		}
+
+		dnsServers := parseAddresses(ipConfig.DNSServers, v6)
+		if len(dnsServers) > 0 {
+			ap.DnsServers = dnsServers
+		}
+
+		_, err = ap.newAddressRecord(&address)
+		if err != nil {
+			log.Printf("[ipam] Failed to create address:%v err:%v.", address, err)
+			continue
+		}
+	}
+
+	// Set the local address space as active.
+	s.sink.setAddressSpace(local)
+
+	s.stateVersion = resp.StateVersion
+	s.initialized = true
+
+	return nil
+}
+
+// Returns the name of the interface that has the given address, or an empty string if none.
+func findInterfaceByAddress(interfaces []net.Interface, address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// Represents an inclusive range of addresses.
+type addressRange struct {
+	first net.IP
+	last  net.IP
+}
+
+// Parses a list of exclusions. Each exclusion is an address, a range of addresses
+// in the form "first-last", or a subnet in CIDR notation.
+func parseExclusions(exclusions []string, v6 bool) ([]addressRange, error) {
+	var ranges []addressRange
+
+	for _, s := range exclusions {
+		var r addressRange
+
+		s = strings.TrimSpace(s)
+
+		if i := strings.Index(s, "-"); i >= 0 {
+			// Range of addresses.
+			r.first = net.ParseIP(strings.TrimSpace(s[:i]))
+			r.last = net.ParseIP(strings.TrimSpace(s[i+1:]))
+		} else if strings.Contains(s, "/") {
+			// Subnet.
+			_, subnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, errInvalidConfiguration
+			}
+			r.first = subnet.IP
+			r.last = make(net.IP, len(subnet.IP))
+			for i := range subnet.IP {
+				r.last[i] = subnet.IP[i] | ^subnet.Mask[i]
+			}
+		} else {
+			// Single address.
+			r.first = net.ParseIP(s)
+			r.last = r.first
+		}
+
+		if r.first == nil || r.last == nil ||
+			(r.first.To4() == nil) != v6 || (r.last.To4() == nil) != v6 ||
+			bytes.Compare(r.first.To16(), r.last.To16()) > 0 {
+			return nil, errInvalidConfiguration
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges, nil
+}
+
+// Parses a comma-separated list of exclusions.
+func parseExclusionList(s string, v6 bool) ([]string, error) {
+	var exclusions []string
+
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			exclusions = append(exclusions, e)
+		}
+	}
+
+	_, err := parseExclusions(exclusions, v6)
+	if err != nil {
+		return nil, err
+	}
+
+	return exclusions, nil
+}
+
+// Returns whether an address falls in the range.
+func (r addressRange) contains(addr net.IP) bool {
+	a := addr.To16()
+	return bytes.Compare(a, r.first.To16()) >= 0 && bytes.Compare(a, r.last.To16()) <= 0
+}
+
+// Returns the ranges of addresses excluded from allocation in the pool,
+// both those configured by the source and those reserved when the pool was requested.
+func (ap *addressPool) getExcludedRanges() []addressRange {
+	var ranges []addressRange
+
+	// Exclusions are validated when they are set.
+	for _, exclusions := range [][]string{ap.Exclusions, ap.Reservations} {
+		r, _ := parseExclusions(exclusions, ap.IsIPv6)
+		ranges = append(ranges, r...)
+	}
+
+	return ranges
+}
+
+// Returns whether an address is in any of the excluded ranges.
+func isExcludedAddress(addr net.IP, ranges []addressRange) bool {
+	for _, r := range ranges {
+		if r.contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
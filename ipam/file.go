@@ -0,0 +1,214 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Default configuration file to read.
+	fileConfigPath = "/etc/azure-vnet/ipam.json"
+
+	// Minimum time interval between consecutive reads.
+	fileQueryInterval = 10 * time.Second
+)
+
+// Static IPAM configuration source backed by a local file.
+type fileSource struct {
+	name          string
+	sink          addressConfigSink
+	path          string
+	queryInterval time.Duration
+	lastRefresh   time.Time
+	lastModTime   time.Time
+}
+
+// File configuration format.
+type fileConfig struct {
+	AddressSpaces []struct {
+		Id    string `json:"id"`
+		Scope string `json:"scope,omitempty"`
+		Pools []struct {
+			Interface  string   `json:"interface,omitempty"`
+			Priority   int      `json:"priority,omitempty"`
+			Subnet     string   `json:"subnet"`
+			Gateway    string   `json:"gateway,omitempty"`
+			DnsServers []string `json:"dnsServers,omitempty"`
+			Strategy   string   `json:"allocationStrategy,omitempty"`
+			Exclusions []string `json:"exclusions,omitempty"`
+			Addresses  []string `json:"addresses"`
+		} `json:"pools"`
+	} `json:"addressSpaces"`
+}
+
+// Creates the file source.
+func newFileSource(options map[string]interface{}) (*fileSource, error) {
+	path, _ := options[common.OptIpamConfigFile].(string)
+	if path == "" {
+		path = fileConfigPath
+	}
+
+	i, _ := options[common.OptIpamQueryInterval].(int)
+	queryInterval := time.Duration(i) * time.Second
+	if queryInterval == 0 {
+		queryInterval = fileQueryInterval
+	}
+
+	return &fileSource{
+		name:          "File",
+		path:          path,
+		queryInterval: queryInterval,
+	}, nil
+}
+
+// Starts the file source.
+func (s *fileSource) start(sink addressConfigSink) error {
+	s.sink = sink
+	return nil
+}
+
+// Stops the file source.
+func (s *fileSource) stop() {
+	s.sink = nil
+	return
+}
+
+// Refreshes configuration.
+func (s *fileSource) refresh() error {
+
+	// Refresh only if enough time has passed since the last read.
+	if time.Since(s.lastRefresh) < s.queryInterval {
+		return nil
+	}
+	s.lastRefresh = time.Now()
+
+	// Skip if the file has not changed since the last read.
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(s.lastModTime) {
+		return nil
+	}
+
+	// Read and decode the configuration.
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var config fileConfig
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %v: %v", s.path, err)
+	}
+
+	// Build all address spaces before applying any of them.
+	var addressSpaces []*addressSpace
+
+	for _, c := range config.AddressSpaces {
+		scope := LocalScope
+		switch c.Scope {
+		case "", "local":
+		case "global":
+			scope = GlobalScope
+		default:
+			return fmt.Errorf("Invalid scope %v for address space %v", c.Scope, c.Id)
+		}
+
+		as, err := s.sink.newAddressSpace(c.Id, scope)
+		if err != nil {
+			return err
+		}
+
+		// For each pool in the address space...
+		for _, p := range c.Pools {
+			_, subnet, err := net.ParseCIDR(p.Subnet)
+			if err != nil {
+				log.Printf("[ipam] Failed to parse subnet:%v err:%v.", p.Subnet, err)
+				continue
+			}
+
+			ap, err := as.newAddressPool(p.Interface, p.Priority, subnet)
+			if err != nil {
+				log.Printf("[ipam] Failed to create pool:%v ifName:%v err:%v.", subnet, p.Interface, err)
+				continue
+			}
+
+			v6 := ap.IsIPv6
+
+			if p.Strategy != "" {
+				_, err = newAllocationStrategy(p.Strategy)
+				if err != nil {
+					log.Printf("[ipam] Invalid allocation strategy:%v for pool:%v.", p.Strategy, subnet)
+				} else {
+					ap.Strategy = p.Strategy
+				}
+			}
+
+			if len(p.Exclusions) > 0 {
+				_, err = parseExclusions(p.Exclusions, v6)
+				if err != nil {
+					log.Printf("[ipam] Invalid exclusions:%v for pool:%v.", p.Exclusions, subnet)
+				} else {
+					ap.Exclusions = p.Exclusions
+				}
+			}
+
+			if p.Gateway != "" {
+				gateways := parseAddresses([]string{p.Gateway}, v6)
+				if len(gateways) == 0 {
+					log.Printf("[ipam] Failed to parse gateway:%v for pool:%v.", p.Gateway, subnet)
+				} else {
+					ap.Gateway = gateways[0]
+				}
+			}
+
+			if len(p.DnsServers) > 0 {
+				dnsServers := parseAddresses(p.DnsServers, v6)
+				if len(dnsServers) == 0 {
+					log.Printf("[ipam] Failed to parse DNS servers:%v for pool:%v.", p.DnsServers, subnet)
+				} else {
+					ap.DnsServers = dnsServers
+				}
+			}
+
+			// For each address in the pool...
+			for _, a := range p.Addresses {
+				address := net.ParseIP(a)
+				if address == nil {
+					log.Printf("[ipam] Failed to parse address:%v.", a)
+					continue
+				}
+
+				_, err = ap.newAddressRecord(&address)
+				if err != nil {
+					log.Printf("[ipam] Failed to create address:%v err:%v.", address, err)
+					continue
+				}
+			}
+		}
+
+		addressSpaces = append(addressSpaces, as)
+	}
+
+	// Set the address spaces as active.
+	for _, as := range addressSpaces {
+		s.sink.setAddressSpace(as)
+	}
+
+	s.lastModTime = info.ModTime()
+
+	return nil
+}
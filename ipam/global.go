@@ -0,0 +1,204 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"encoding/json"
+
+	"github.com/Azure/azure-container-networking/log"
+	"github.com/Azure/azure-container-networking/store"
+)
+
+const (
+	// Global store key prefix for address spaces.
+	globalStoreKeyPrefix = "IPAM/AddressSpaces/"
+
+	// Maximum number of attempts to update a global address space modified concurrently.
+	globalStoreMaxRetries = 10
+)
+
+// Returns whether an address space is shared with other hosts through the global store.
+func (am *addressManager) isShared(as *addressSpace) bool {
+	return am.globalStore != nil && as.Scope == GlobalScope
+}
+
+// Reads the latest version of a global address space from the global store.
+// Local state that is not shared, such as epochs and health, is kept from the local copy.
+// Returns a nil address space if it does not exist yet.
+func (am *addressManager) readGlobalAddressSpace(id string) (*addressSpace, uint64, error) {
+	as := &addressSpace{}
+
+	version, err := am.globalStore.Get(globalStoreKeyPrefix+id, as)
+	if err == store.ErrKeyNotFound {
+		return nil, 0, nil
+	}
+	if err != nil {
+		log.Printf("[ipam] Failed to read global address space %v, err:%v.", id, err)
+		return nil, 0, err
+	}
+
+	as.populate()
+	as.keepLocalState(am.AddrSpaces[id])
+
+	return as, version, nil
+}
+
+// Copies the local state of pools and addresses from an older copy of the address space.
+// Pools and addresses not in the older copy belong to the current epoch.
+func (as *addressSpace) keepLocalState(old *addressSpace) {
+	if old == nil {
+		return
+	}
+
+	as.epoch = old.epoch
+
+	for pk, ap := range as.Pools {
+		oldap := old.Pools[pk]
+		if oldap == nil {
+			ap.epoch = as.epoch
+			continue
+		}
+
+		ap.epoch = oldap.epoch
+
+		for ak, ar := range ap.Addresses {
+			oldar := oldap.Addresses[ak]
+			if oldar == nil {
+				ar.epoch = as.epoch
+				continue
+			}
+
+			ar.epoch = oldar.epoch
+			ar.unhealthy = oldar.unhealthy
+		}
+	}
+}
+
+// Refreshes the global address spaces from the global store.
+func (am *addressManager) refreshGlobalAddressSpaces() {
+	if am.globalStore == nil {
+		return
+	}
+
+	ids := []string{GlobalDefaultAddressSpaceId}
+	for id, as := range am.AddrSpaces {
+		if as.Scope == GlobalScope && id != GlobalDefaultAddressSpaceId {
+			ids = append(ids, id)
+		}
+	}
+
+	for _, id := range ids {
+		as, _, err := am.readGlobalAddressSpace(id)
+		if err == nil && as != nil {
+			am.AddrSpaces[id] = as
+		}
+	}
+}
+
+// Sets a new or updates an existing global address space in the global store.
+func (am *addressManager) setGlobalAddressSpace(newas *addressSpace) ([]*AddressInfo, error) {
+	var orphans []*AddressInfo
+
+	for i := 0; i < globalStoreMaxRetries; i++ {
+		as, version, err := am.readGlobalAddressSpace(newas.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		// Merging consumes the new address space, so merge a copy in case of a retry.
+		update, err := newas.copy()
+		if err != nil {
+			return nil, err
+		}
+
+		if as == nil {
+			as = update
+		} else {
+			orphans = as.merge(update)
+		}
+
+		_, err = am.globalStore.CompareAndSwap(globalStoreKeyPrefix+as.Id, as, version)
+		if err == store.ErrVersionMismatch {
+			log.Printf("[ipam] Global address space %v was modified concurrently, retrying.", as.Id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		am.AddrSpaces[as.Id] = as
+
+		return orphans, nil
+	}
+
+	return nil, errAddressSpaceConflict
+}
+
+// Applies an update to an address space and saves it.
+// Updates to a global address space are applied to its latest version in the global store,
+// and retried if it is modified concurrently by another host.
+func (am *addressManager) updateAddressSpace(id string, update func(as *addressSpace) error) error {
+	as, err := am.getAddressSpace(id)
+	if err != nil {
+		return err
+	}
+
+	if !am.isShared(as) {
+		err = update(as)
+		if err != nil {
+			return err
+		}
+
+		return am.save()
+	}
+
+	for i := 0; i < globalStoreMaxRetries; i++ {
+		as, version, err := am.readGlobalAddressSpace(id)
+		if err != nil {
+			return err
+		}
+		if as == nil {
+			return errInvalidAddressSpace
+		}
+
+		err = update(as)
+		if err != nil {
+			return err
+		}
+
+		_, err = am.globalStore.CompareAndSwap(globalStoreKeyPrefix+id, as, version)
+		if err == store.ErrVersionMismatch {
+			log.Printf("[ipam] Global address space %v was modified concurrently, retrying.", id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		am.AddrSpaces[id] = as
+
+		return am.save()
+	}
+
+	return errAddressSpaceConflict
+}
+
+// Returns a deep copy of the address space.
+func (as *addressSpace) copy() (*addressSpace, error) {
+	var c addressSpace
+
+	b, err := json.Marshal(as)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	c.populate()
+
+	return &c, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"os"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Default time an address lease is protected from reclamation after allocation.
+	defaultReclaimGracePeriod = 5 * time.Minute
+)
+
+// Represents the owner of an in-use address.
+type addressLease struct {
+	OwnerID     string
+	ContainerID string
+	NetNsPath   string
+	AllocatedAt time.Time
+}
+
+// Creates a new lease for an address requested with the given options.
+func newAddressLease(options map[string]string) *addressLease {
+	return &addressLease{
+		OwnerID:     options[OptAddressID],
+		ContainerID: options[OptContainerID],
+		NetNsPath:   options[OptNetNsPath],
+		AllocatedAt: time.Now(),
+	}
+}
+
+// Returns whether the owner of a lease still exists.
+// Leases without a network namespace, such as those of CNM containers, cannot be verified
+// and are assumed to be alive.
+func isLeaseOwnerAlive(lease *addressLease) bool {
+	if lease.NetNsPath == "" {
+		return true
+	}
+
+	_, err := os.Stat(lease.NetNsPath)
+	return err == nil || !os.IsNotExist(err)
+}
+
+// ReclaimAddresses frees in-use addresses whose owner no longer exists.
+func (am *addressManager) ReclaimAddresses() ([]string, error) {
+	am.Lock()
+	defer am.Unlock()
+
+	reclaimed := am.reclaimAddresses()
+	if len(reclaimed) == 0 {
+		return nil, nil
+	}
+
+	err := am.save()
+	if err != nil {
+		return reclaimed, err
+	}
+
+	return reclaimed, nil
+}
+
+// Frees in-use addresses whose lease has outlived the grace period and whose owner no longer exists.
+func (am *addressManager) reclaimAddresses() []string {
+	var reclaimed []string
+
+	for _, as := range am.AddrSpaces {
+		// Owners of addresses in shared address spaces may run on other hosts.
+		if am.isShared(as) {
+			continue
+		}
+
+		for _, ap := range as.Pools {
+			for _, ar := range ap.Addresses {
+				lease := ar.Lease
+				if lease == nil || (!ar.InUse && ar.ID == "") {
+					continue
+				}
+
+				if time.Since(lease.AllocatedAt) < am.reclaimGracePeriod {
+					continue
+				}
+
+				if am.leaseOwnerAlive(lease) {
+					continue
+				}
+
+				log.Printf("[ipam] Audit: reclaiming address %v in pool %v from owner:%v container:%v netns:%v allocated at %v.",
+					ar.Addr, ap.Id, lease.OwnerID, lease.ContainerID, lease.NetNsPath, lease.AllocatedAt)
+
+				ap.reclaimAddress(ar)
+				reclaimed = append(reclaimed, ar.Addr.String())
+			}
+		}
+	}
+
+	return reclaimed
+}
+
+// Marks an address as released, remembering its owner for sticky allocation.
+func (ar *addressRecord) setReleased() {
+	if ar.Lease != nil && ar.Lease.OwnerID != "" {
+		ar.LastID = ar.Lease.OwnerID
+	} else if ar.ID != "" {
+		ar.LastID = ar.ID
+	}
+
+	ar.InUse = false
+	ar.Lease = nil
+	ar.ReleasedAt = time.Now()
+}
+
+// Frees an address regardless of its owner.
+func (ap *addressPool) reclaimAddress(ar *addressRecord) {
+	if ar.ID != "" {
+		delete(ap.addrsByID, ar.ID)
+		ar.ID = ""
+	}
+
+	ar.setReleased()
+
+	// Delete address record if it is no longer available.
+	if ar.epoch < ap.as.epoch {
+		delete(ap.Addresses, ar.Addr.String())
+	}
+}
@@ -20,12 +20,24 @@ const (
 
 // AddressManager manages the set of address spaces and pools allocated to containers.
 type addressManager struct {
-	Version    string
-	TimeStamp  time.Time
-	AddrSpaces map[string]*addressSpace `json:"AddressSpaces"`
-	store      store.KeyValueStore
-	source     addressConfigSource
-	netApi     common.NetApi
+	Version     string
+	TimeStamp   time.Time
+	AddrSpaces  map[string]*addressSpace `json:"AddressSpaces"`
+	store       store.KeyValueStore
+	source      addressConfigSource
+	globalStore store.CasKeyValueStore
+	netApi      common.NetApi
+
+	reclaimGracePeriod  time.Duration
+	releaseCooldown     time.Duration
+	allocationStrategy  string
+	orphanPolicy        string
+	leaseOwnerAlive     func(*addressLease) bool
+	prober              addressProber
+	stopProber          chan bool
+	lowWatermark        int
+	lowWatermarkHandler LowWatermarkHandler
+	stopStoreWatcher    chan struct{}
 	sync.Mutex
 }
 
@@ -44,7 +56,23 @@ type AddressManager interface {
 	GetPoolInfo(asId, poolId string) (*AddressPoolInfo, error)
 
 	RequestAddress(asId, poolId, address string, options map[string]string) (string, error)
+	RequestAddresses(asId, poolId string, count int, options map[string]string) ([]string, error)
 	ReleaseAddress(asId, poolId, address string, options map[string]string) error
+
+	ListAddresses(asId, poolId string) ([]*AddressInfo, error)
+	FindAddress(address string) (*AddressInfo, error)
+	FindAddressByOwner(id string) ([]*AddressInfo, error)
+	ListOrphanedAddresses() ([]*AddressInfo, error)
+
+	ReclaimAddresses() ([]string, error)
+
+	ProbeAddresses() ([]string, error)
+	StartProber(interval time.Duration)
+
+	GetUtilization() (*Utilization, error)
+	SetLowWatermarkHandler(handler LowWatermarkHandler)
+
+	StartStoreWatcher() error
 }
 
 // AddressConfigSource configures the address pools managed by AddressManager.
@@ -63,7 +91,9 @@ type addressConfigSink interface {
 // Creates a new address manager.
 func NewAddressManager() (AddressManager, error) {
 	am := &addressManager{
-		AddrSpaces: make(map[string]*addressSpace),
+		AddrSpaces:         make(map[string]*addressSpace),
+		reclaimGracePeriod: defaultReclaimGracePeriod,
+		leaseOwnerAlive:    isLeaseOwnerAlive,
 	}
 
 	return am, nil
@@ -74,6 +104,7 @@ func (am *addressManager) Initialize(config *common.PluginConfig, options map[st
 	am.Version = config.Version
 	am.store = config.Store
 	am.netApi = config.NetApi
+	am.globalStore = config.GlobalStore
 
 	// Restore persisted state.
 	err := am.restore()
@@ -90,6 +121,16 @@ func (am *addressManager) Initialize(config *common.PluginConfig, options map[st
 // Uninitialize cleans up address manager.
 func (am *addressManager) Uninitialize() {
 	am.StopSource()
+
+	if am.stopProber != nil {
+		close(am.stopProber)
+		am.stopProber = nil
+	}
+
+	if am.stopStoreWatcher != nil {
+		close(am.stopStoreWatcher)
+		am.stopStoreWatcher = nil
+	}
 }
 
 // Restore reads address manager state from persistent store.
@@ -124,18 +165,13 @@ func (am *addressManager) restore() error {
 		}
 	}
 
+	if store.RestoredFromBackup(am.store) {
+		log.Printf("[ipam] Restored state from the previous generation, recent allocations may be lost.")
+	}
+
 	// Populate pointers.
 	for _, as := range am.AddrSpaces {
-		for _, ap := range as.Pools {
-			ap.as = as
-			ap.addrsByID = make(map[string]*addressRecord)
-
-			for _, ar := range ap.Addresses {
-				if ar.ID != "" {
-					ap.addrsByID[ar.ID] = ar
-				}
-			}
-		}
+		as.populate()
 	}
 
 	// if rebooted mark the ip as not in use.
@@ -147,6 +183,7 @@ func (am *addressManager) restore() error {
 
 				for _, ar := range ap.Addresses {
 					ar.InUse = false
+					ar.Lease = nil
 				}
 			}
 		}
@@ -157,6 +194,67 @@ func (am *addressManager) restore() error {
 	return nil
 }
 
+// StartStoreWatcher reloads address manager state each time it is changed in persistent store
+// by another process sharing the store.
+func (am *addressManager) StartStoreWatcher() error {
+	// Skip if a store is not provided.
+	if am.store == nil {
+		return nil
+	}
+
+	stop := make(chan struct{})
+
+	changes, err := am.store.Watch(storeKey, stop)
+	if err != nil {
+		log.Printf("[ipam] Failed to watch store, err:%v.", err)
+		return err
+	}
+
+	am.stopStoreWatcher = stop
+
+	go func() {
+		for range changes {
+			am.Lock()
+			am.reload()
+			am.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+// Reload reads address manager state changed in persistent store by another process.
+func (am *addressManager) reload() error {
+	loaded := &addressManager{}
+
+	err := am.store.Read(storeKey, loaded)
+	if err != nil {
+		log.Printf("[ipam] Failed to reload state, err:%v.", err)
+		return err
+	}
+
+	// Skip changes made by this process.
+	if loaded.TimeStamp.Equal(am.TimeStamp) {
+		return nil
+	}
+
+	for id, as := range loaded.AddrSpaces {
+		as.populate()
+		as.keepLocalState(am.AddrSpaces[id])
+	}
+
+	if loaded.AddrSpaces == nil {
+		loaded.AddrSpaces = make(map[string]*addressSpace)
+	}
+
+	am.AddrSpaces = loaded.AddrSpaces
+	am.TimeStamp = loaded.TimeStamp
+
+	log.Printf("[ipam] Reloaded state changed by another process at %v.", am.TimeStamp)
+
+	return nil
+}
+
 // Save writes address manager state to persistent store.
 func (am *addressManager) save() error {
 	// Skip if a store is not provided.
@@ -182,6 +280,64 @@ func (am *addressManager) StartSource(options map[string]interface{}) error {
 
 	environment, _ := options[common.OptEnvironment].(string)
 
+	// Set grace period before leaked addresses are reclaimed.
+	if i, _ := options[common.OptIpamReclaimGracePeriod].(int); i != 0 {
+		am.reclaimGracePeriod = time.Duration(i) * time.Second
+	}
+
+	// Set cooldown before released addresses are offered again.
+	if i, _ := options[common.OptIpamReleaseCooldown].(int); i != 0 {
+		am.releaseCooldown = time.Duration(i) * time.Second
+	}
+
+	// Set the allocation strategy for pools that do not configure one.
+	if s, _ := options[common.OptIpamAllocationStrategy].(string); s != "" {
+		_, err = newAllocationStrategy(s)
+		if err != nil {
+			log.Printf("[ipam] Invalid allocation strategy %v.", s)
+			return err
+		}
+		am.allocationStrategy = s
+	}
+
+	// Set the action taken when in-use addresses are withdrawn by the source.
+	if s, _ := options[common.OptIpamOrphanPolicy].(string); s != "" {
+		switch s {
+		case common.OptIpamOrphanPolicyNone, common.OptIpamOrphanPolicyNotify, common.OptIpamOrphanPolicyEvict:
+			am.orphanPolicy = s
+		default:
+			log.Printf("[ipam] Invalid orphan policy %v.", s)
+			return errInvalidConfiguration
+		}
+	}
+
+	// Set the percentage of free addresses in a pool below which a low watermark event is raised.
+	if i, _ := options[common.OptIpamLowWatermark].(int); i != 0 {
+		if i < 0 || i > 100 {
+			log.Printf("[ipam] Invalid low watermark %v.", i)
+			return errInvalidConfiguration
+		}
+		am.lowWatermark = i
+	}
+
+	// Share global address spaces with other hosts through the global store.
+	if path, _ := options[common.OptIpamGlobalStore].(string); path != "" && am.globalStore == nil {
+		am.globalStore, err = store.NewJsonCasStore(path)
+		if err != nil {
+			log.Printf("[ipam] Failed to create global store, err:%v.", err)
+			return err
+		}
+	}
+
+	// Enable duplicate address detection.
+	if probe, _ := options[common.OptIpamProbe].(bool); probe && am.prober == nil {
+		am.prober, err = newAddressProber()
+		if err != nil {
+			log.Printf("[ipam] Failed to create address prober, err:%v.", err)
+			return err
+		}
+	}
+
 	switch environment {
 	case common.OptEnvironmentAzure:
 		am.source, err = newAzureSource(options)
@@ -189,6 +345,12 @@ func (am *addressManager) StartSource(options map[string]interface{}) error {
 	case common.OptEnvironmentMAS:
 		am.source, err = newMasSource(options)
 
+	case common.OptEnvironmentFile:
+		am.source, err = newFileSource(options)
+
+	case common.OptEnvironmentCNS:
+		am.source, err = newCnsSource(options)
+
 	case "null":
 		am.source, err = newNullSource()
 
@@ -228,6 +390,8 @@ func (am *addressManager) refreshSource() {
 			log.Printf("[ipam] Source refresh failed, err:%v.\n", err)
 		}
 	}
+
+	am.refreshGlobalAddressSpaces()
 }
 
 //
@@ -260,24 +424,26 @@ func (am *addressManager) GetDefaultAddressSpaces() (string, string) {
 
 // RequestPool reserves an address pool.
 func (am *addressManager) RequestPool(asId, poolId, subPoolId string, options map[string]string, v6 bool) (string, string, error) {
+	var pool *addressPool
+	var child *childPool
+
 	am.Lock()
 	defer am.Unlock()
 
 	am.refreshSource()
 
-	as, err := am.getAddressSpace(asId)
-	if err != nil {
-		return "", "", err
-	}
-
-	pool, err := as.requestPool(poolId, subPoolId, options, v6)
+	err := am.updateAddressSpace(asId, func(as *addressSpace) error {
+		var err error
+		pool, child, err = as.requestPool(poolId, subPoolId, options, v6)
+		return err
+	})
 	if err != nil {
 		return "", "", err
 	}
 
-	err = am.save()
-	if err != nil {
-		return "", "", err
+	// Child subnets are addressed by their own pool ID.
+	if child != nil {
+		return child.Id, child.Subnet.String(), nil
 	}
 
 	return pool.Id, pool.Subnet.String(), nil
@@ -290,17 +456,9 @@ func (am *addressManager) ReleasePool(asId string, poolId string) error {
 
 	am.refreshSource()
 
-	as, err := am.getAddressSpace(asId)
-	if err != nil {
-		return err
-	}
-
-	err = as.releasePool(poolId)
-	if err != nil {
-		return err
-	}
-
-	err = am.save()
+	err := am.updateAddressSpace(asId, func(as *addressSpace) error {
+		return as.releasePool(poolId)
+	})
 	if err != nil {
 		return err
 	}
@@ -318,67 +476,138 @@ func (am *addressManager) GetPoolInfo(asId string, poolId string) (*AddressPoolI
 		return nil, err
 	}
 
-	ap, err := as.getAddressPool(poolId)
+	ap, child, err := as.getPoolOrChild(poolId)
 	if err != nil {
 		return nil, err
 	}
 
-	return ap.getInfo(), nil
+	return ap.getInfo(child), nil
 }
 
 // RequestAddress reserves a new address from the address pool.
 func (am *addressManager) RequestAddress(asId, poolId, address string, options map[string]string) (string, error) {
+	var addr string
+	var event *PoolUtilization
+
 	am.Lock()
 	defer am.Unlock()
 
 	am.refreshSource()
 
-	as, err := am.getAddressSpace(asId)
-	if err != nil {
-		return "", err
-	}
+	probed := am.probeCandidates(asId, poolId, address, 1, options)
 
-	ap, err := as.getAddressPool(poolId)
-	if err != nil {
-		return "", err
-	}
+	err := am.updateAddressSpace(asId, func(as *addressSpace) error {
+		ap, child, err := as.getPoolOrChild(poolId)
+		if err != nil {
+			return err
+		}
 
-	addr, err := ap.requestAddress(address, options)
-	if err != nil {
-		return "", err
-	}
+		policy := am.getAllocationPolicy(ap)
+		policy.probed = probed
 
-	err = am.save()
+		addr, err = ap.requestAddress(address, options, child, policy)
+		if err == errNoAvailableAddresses {
+			// Reclaim addresses leaked by owners that no longer exist and try again.
+			if len(am.reclaimAddresses()) > 0 {
+				addr, err = ap.requestAddress(address, options, child, policy)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		event = am.recordAllocation(ap, 1)
+
+		return nil
+	})
 	if err != nil {
+		am.recordFailure(asId, poolId, err)
 		return "", err
 	}
 
+	am.raiseLowWatermark(event)
+
 	return addr, nil
 }
 
-// ReleaseAddress releases a previously reserved address.
-func (am *addressManager) ReleaseAddress(asId string, poolId string, address string, options map[string]string) error {
+// RequestAddresses reserves count new addresses from the address pool.
+// Either all addresses are reserved, or none are.
+func (am *addressManager) RequestAddresses(asId, poolId string, count int, options map[string]string) ([]string, error) {
+	var addrs []string
+	var event *PoolUtilization
+
 	am.Lock()
 	defer am.Unlock()
 
+	// Addresses with an ID are reserved one at a time.
+	if count <= 0 || (count > 1 && options[OptAddressID] != "") {
+		return nil, errInvalidConfiguration
+	}
+
 	am.refreshSource()
 
-	as, err := am.getAddressSpace(asId)
-	if err != nil {
-		return err
-	}
+	probed := am.probeCandidates(asId, poolId, "", count, options)
 
-	ap, err := as.getAddressPool(poolId)
-	if err != nil {
-		return err
-	}
+	err := am.updateAddressSpace(asId, func(as *addressSpace) error {
+		ap, child, err := as.getPoolOrChild(poolId)
+		if err != nil {
+			return err
+		}
+
+		policy := am.getAllocationPolicy(ap)
+		policy.probed = probed
+		reclaimed := false
+		addrs = nil
+
+		for len(addrs) < count {
+			addr, err := ap.requestAddress("", options, child, policy)
+			if err == errNoAvailableAddresses && !reclaimed {
+				// Reclaim addresses leaked by owners that no longer exist and try again.
+				reclaimed = true
+				if len(am.reclaimAddresses()) > 0 {
+					continue
+				}
+			}
+			if err != nil {
+				// Return the addresses reserved so far to the pool.
+				for _, a := range addrs {
+					ap.cancelAddressRequest(a)
+				}
+				return err
+			}
 
-	err = ap.releaseAddress(address, options)
+			addrs = append(addrs, addr)
+		}
+
+		event = am.recordAllocation(ap, count)
+
+		return nil
+	})
 	if err != nil {
-		return err
+		am.recordFailure(asId, poolId, err)
+		return nil, err
 	}
 
-	err = am.save()
+	am.raiseLowWatermark(event)
+
+	return addrs, nil
+}
+
+// ReleaseAddress releases a previously reserved address.
+func (am *addressManager) ReleaseAddress(asId string, poolId string, address string, options map[string]string) error {
+	am.Lock()
+	defer am.Unlock()
+
+	am.refreshSource()
+
+	err := am.updateAddressSpace(asId, func(as *addressSpace) error {
+		ap, _, err := as.getPoolOrChild(poolId)
+		if err != nil {
+			return err
+		}
+
+		return ap.releaseAddress(address, options)
+	})
 	if err != nil {
 		return err
 	}
@@ -4,11 +4,20 @@
 package ipam
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-container-networking/cns"
 	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/store"
 )
 
 var (
@@ -203,17 +212,17 @@ func TestAddressSpaceUpdate(t *testing.T) {
 		t.Errorf("Cannot find subnet1, err:%+v.", err)
 	}
 
-	_, err = ap.requestAddress(addr11.String(), nil)
+	_, err = ap.requestAddress(addr11.String(), nil, nil, nil)
 	if err != nil {
 		t.Errorf("Cannot find addr11, err:%+v.", err)
 	}
 
-	_, err = ap.requestAddress(addr12.String(), nil)
+	_, err = ap.requestAddress(addr12.String(), nil, nil, nil)
 	if err == nil {
 		t.Errorf("Found addr12.")
 	}
 
-	_, err = ap.requestAddress(addr13.String(), nil)
+	_, err = ap.requestAddress(addr13.String(), nil, nil, nil)
 	if err != nil {
 		t.Errorf("Cannot find addr13, err:%+v.", err)
 	}
@@ -230,12 +239,12 @@ func TestAddressSpaceUpdate(t *testing.T) {
 		t.Errorf("Cannot find subnet3, err:%+v.", err)
 	}
 
-	_, err = ap.requestAddress(addr31.String(), nil)
+	_, err = ap.requestAddress(addr31.String(), nil, nil, nil)
 	if err != nil {
 		t.Errorf("Cannot find addr31, err:%+v.", err)
 	}
 
-	_, err = ap.requestAddress(addr32.String(), nil)
+	_, err = ap.requestAddress(addr32.String(), nil, nil, nil)
 	if err == nil {
 		t.Errorf("Found addr32.")
 	}
@@ -371,3 +380,1096 @@ func TestAddressRequestsFromTheSamePool(t *testing.T) {
 		t.Errorf("ReleasePool failed, err:%v", err)
 	}
 }
+
+// Tests IPv6 pools are requested by address family and report the well-known gateway and DNS servers.
+func TestAddressPoolRequestForIPv6(t *testing.T) {
+	// Start with the test address space.
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	amImpl := am.(*addressManager)
+
+	// Add an IPv6 subnet to the local address space.
+	_, subnet6, _ := net.ParseCIDR("fd00:1::/64")
+	addr6 := net.ParseIP("fd00:1::4")
+
+	localAs, err := amImpl.getAddressSpace(LocalDefaultAddressSpaceId)
+	if err != nil {
+		t.Fatalf("getAddressSpace failed, err:%+v.", err)
+	}
+
+	ap, err := localAs.newAddressPool(anyInterface, anyPriority, subnet6)
+	if err != nil {
+		t.Fatalf("newAddressPool failed, err:%+v.", err)
+	}
+	ap.newAddressRecord(&addr6)
+
+	// Request an IPv6 pool.
+	poolId, subnet, err := am.RequestPool(LocalDefaultAddressSpaceId, "", "", nil, true)
+	if err != nil {
+		t.Fatalf("RequestPool failed, err:%v", err)
+	}
+
+	if subnet != subnet6.String() {
+		t.Errorf("RequestPool returned pool %v instead of %v.", subnet, subnet6)
+	}
+
+	// Test the gateway and DNS servers are derived from the well-known host IDs.
+	apInfo, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if err != nil {
+		t.Fatalf("GetPoolInfo failed, err:%v", err)
+	}
+
+	if !apInfo.IsIPv6 {
+		t.Errorf("GetPoolInfo returned an IPv4 pool.")
+	}
+
+	if !apInfo.Gateway.Equal(net.ParseIP("fd00:1::1")) {
+		t.Errorf("GetPoolInfo returned invalid gateway %v.", apInfo.Gateway)
+	}
+
+	if len(apInfo.DnsServers) != 2 ||
+		!apInfo.DnsServers[0].Equal(net.ParseIP("fd00:1::2")) ||
+		!apInfo.DnsServers[1].Equal(net.ParseIP("fd00:1::3")) {
+		t.Errorf("GetPoolInfo returned invalid DNS servers %v.", apInfo.DnsServers)
+	}
+
+	err = am.ReleasePool(LocalDefaultAddressSpaceId, poolId)
+	if err != nil {
+		t.Errorf("ReleasePool failed, err:%v", err)
+	}
+}
+
+// Tests address spaces are configured from a local file.
+func TestFileSourceConfiguresAddressSpaces(t *testing.T) {
+	config := `{
+		"addressSpaces": [{
+			"id": "local",
+			"pools": [{
+				"interface": "eth0",
+				"subnet": "192.168.10.0/24",
+				"gateway": "192.168.10.254",
+				"dnsServers": ["192.168.10.53"],
+				"addresses": ["192.168.10.4", "192.168.10.5"]
+			}]
+		}]
+	}`
+
+	file, err := ioutil.TempFile("", "ipam")
+	if err != nil {
+		t.Fatalf("Failed to create config file, err:%v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(config)
+	file.Close()
+
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+
+	err = am.StartSource(map[string]interface{}{
+		common.OptEnvironment:    common.OptEnvironmentFile,
+		common.OptIpamConfigFile: file.Name(),
+	})
+	if err != nil {
+		t.Fatalf("StartSource failed, err:%v", err)
+	}
+	defer am.StopSource()
+
+	poolId, subnet, err := am.RequestPool(LocalDefaultAddressSpaceId, "", "", nil, false)
+	if err != nil {
+		t.Fatalf("RequestPool failed, err:%v", err)
+	}
+
+	if subnet != "192.168.10.0/24" {
+		t.Errorf("RequestPool returned unexpected pool %v.", subnet)
+	}
+
+	apInfo, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if err != nil {
+		t.Fatalf("GetPoolInfo failed, err:%v", err)
+	}
+
+	if !apInfo.Gateway.Equal(net.ParseIP("192.168.10.254")) {
+		t.Errorf("GetPoolInfo returned invalid gateway %v.", apInfo.Gateway)
+	}
+
+	if len(apInfo.DnsServers) != 1 || !apInfo.DnsServers[0].Equal(net.ParseIP("192.168.10.53")) {
+		t.Errorf("GetPoolInfo returned invalid DNS servers %v.", apInfo.DnsServers)
+	}
+
+	if apInfo.Capacity != 2 {
+		t.Errorf("GetPoolInfo returned capacity %v instead of 2.", apInfo.Capacity)
+	}
+}
+
+// Tests address pools are configured from CNS network containers.
+func TestCnsSourceConfiguresAddressPools(t *testing.T) {
+	queries := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		resp := cns.GetIPConfigurationsResponse{StateVersion: 1}
+		for _, ip := range []string{"10.1.0.4", "10.1.0.5"} {
+			ipConfig := cns.NetworkContainerIPConfiguration{NetworkContainerid: ip}
+			ipConfig.IPConfiguration.IPSubnet = cns.IPSubnet{IPAddress: ip, PrefixLength: 24}
+			ipConfig.IPConfiguration.GatewayIPAddress = "10.1.0.1"
+			ipConfig.IPConfiguration.DNSServers = []string{"10.1.0.53"}
+			resp.IPConfigurations = append(resp.IPConfigurations, ipConfig)
+		}
+		json.NewEncoder(w).Encode(&resp)
+	}))
+	defer server.Close()
+
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+
+	err = am.StartSource(map[string]interface{}{
+		common.OptEnvironment:       common.OptEnvironmentCNS,
+		common.OptCnsURL:            server.URL,
+		common.OptIpamQueryInterval: -1,
+	})
+	if err != nil {
+		t.Fatalf("StartSource failed, err:%v", err)
+	}
+	defer am.StopSource()
+
+	poolId, subnet, err := am.RequestPool(LocalDefaultAddressSpaceId, "", "", nil, false)
+	if err != nil {
+		t.Fatalf("RequestPool failed, err:%v", err)
+	}
+
+	if subnet != "10.1.0.0/24" {
+		t.Errorf("RequestPool returned unexpected pool %v.", subnet)
+	}
+
+	apInfo, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if err != nil {
+		t.Fatalf("GetPoolInfo failed, err:%v", err)
+	}
+
+	if apInfo.Capacity != 2 || !apInfo.Gateway.Equal(net.ParseIP("10.1.0.1")) {
+		t.Errorf("GetPoolInfo returned unexpected pool info %+v.", apInfo)
+	}
+
+	if queries == 0 {
+		t.Errorf("CNS was not queried.")
+	}
+}
+
+// Tests addresses in the same subnet are configured in a single pool by the MAS source.
+func TestMasSourceConfiguresAddressPools(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Isolation":"none","IPs":[` +
+			`{"IP":"10.1.0.4","Mask":"24","DefaultGateways":["10.1.0.1"]},` +
+			`{"IP":"10.1.0.5","Mask":"255.255.255.0","DefaultGateways":["10.1.0.1"]}]}`))
+	}))
+	defer server.Close()
+
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+
+	err = cleanupTestAddressSpace(am)
+	if err != nil {
+		t.Fatalf("cleanupTestAddressSpace failed, err:%+v.", err)
+	}
+
+	err = am.StartSource(map[string]interface{}{
+		common.OptEnvironment:       common.OptEnvironmentMAS,
+		common.OptIpamQueryUrl:      server.URL,
+		common.OptIpamQueryInterval: -1,
+	})
+	if err != nil {
+		t.Fatalf("StartSource failed, err:%v", err)
+	}
+	defer am.StopSource()
+
+	poolId, subnet, err := am.RequestPool(LocalDefaultAddressSpaceId, "", "", nil, false)
+	if err != nil {
+		t.Fatalf("RequestPool failed, err:%v", err)
+	}
+
+	if subnet != "10.1.0.0/24" {
+		t.Errorf("RequestPool returned unexpected pool %v.", subnet)
+	}
+
+	apInfo, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, poolId)
+	if err != nil {
+		t.Fatalf("GetPoolInfo failed, err:%v", err)
+	}
+
+	if apInfo.Capacity != 2 || !apInfo.Gateway.Equal(net.ParseIP("10.1.0.1")) {
+		t.Errorf("GetPoolInfo returned unexpected pool info %+v.", apInfo)
+	}
+}
+
+// Tests addresses are reclaimed only after their owner's network namespace disappears.
+func TestAddressesAreReclaimedFromDeadOwners(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	amImpl := am.(*addressManager)
+	amImpl.reclaimGracePeriod = 0
+
+	netns, err := ioutil.TempDir("", "netns")
+	if err != nil {
+		t.Fatalf("Failed to create netns placeholder, err:%v", err)
+	}
+	defer os.RemoveAll(netns)
+
+	options := map[string]string{OptContainerID: "container1", OptNetNsPath: netns}
+	address, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", options)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	// Test the address is kept while the network namespace exists.
+	reclaimed, err := am.ReclaimAddresses()
+	if err != nil || len(reclaimed) != 0 {
+		t.Fatalf("ReclaimAddresses reclaimed %v from a live owner, err:%v.", reclaimed, err)
+	}
+
+	// Test the address is reclaimed after the network namespace is gone.
+	os.RemoveAll(netns)
+
+	reclaimed, err = am.ReclaimAddresses()
+	if err != nil {
+		t.Fatalf("ReclaimAddresses failed, err:%v", err)
+	}
+
+	addr, _, _ := net.ParseCIDR(address)
+	if len(reclaimed) != 1 || reclaimed[0] != addr.String() {
+		t.Errorf("ReclaimAddresses reclaimed %v instead of %v.", reclaimed, addr)
+	}
+}
+
+// Tests released addresses are not offered again during the cooldown.
+func TestReleasedAddressesAreQuarantined(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	amImpl := am.(*addressManager)
+	amImpl.releaseCooldown = time.Hour
+
+	// Request and release an address from subnet1.
+	address1, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	addr, _, _ := net.ParseCIDR(address1)
+	err = am.ReleaseAddress(LocalDefaultAddressSpaceId, subnet1.String(), addr.String(), nil)
+	if err != nil {
+		t.Fatalf("ReleaseAddress failed, err:%v", err)
+	}
+
+	// Test the other address is offered next.
+	address2, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	if address2 == address1 {
+		t.Errorf("RequestAddress returned quarantined address %v.", address1)
+	}
+
+	// Test the quarantined address is not offered while in cooldown.
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != errNoAvailableAddresses {
+		t.Errorf("RequestAddress returned err:%v instead of %v.", err, errNoAvailableAddresses)
+	}
+}
+
+// Fake prober that reports conflicts for a set of addresses.
+type fakeAddressProber struct {
+	conflicts map[string]bool
+}
+
+func (p *fakeAddressProber) probe(ifName string, addr net.IP) (bool, error) {
+	return p.conflicts[addr.String()], nil
+}
+
+// Tests addresses in conflict are marked unhealthy, skipped and returned to service once recovered.
+func TestConflictingAddressesAreMarkedUnhealthy(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	prober := &fakeAddressProber{conflicts: map[string]bool{addr11.String(): true}}
+	am.(*addressManager).prober = prober
+
+	// Test the conflicting address is skipped.
+	address, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	addr, _, _ := net.ParseCIDR(address)
+	if !addr.Equal(addr12) {
+		t.Errorf("RequestAddress returned %v instead of %v.", addr, addr12)
+	}
+
+	// Test the conflicting address is reported unhealthy.
+	apInfo, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, subnet1.String())
+	if err != nil {
+		t.Fatalf("GetPoolInfo failed, err:%v", err)
+	}
+
+	if len(apInfo.UnhealthyAddrs) != 1 || !apInfo.UnhealthyAddrs[0].Equal(addr11) {
+		t.Errorf("GetPoolInfo returned unhealthy addresses %v instead of %v.", apInfo.UnhealthyAddrs, addr11)
+	}
+
+	// Test the address is returned to service after the conflict is gone.
+	prober.conflicts = nil
+
+	conflicts, err := am.ProbeAddresses()
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("ProbeAddresses returned conflicts %v, err:%v.", conflicts, err)
+	}
+
+	address, err = am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	addr, _, _ = net.ParseCIDR(address)
+	if !addr.Equal(addr11) {
+		t.Errorf("RequestAddress returned %v instead of %v.", addr, addr11)
+	}
+
+	// Test an expired conflict is probed again when the address is requested.
+	err = am.ReleaseAddress(LocalDefaultAddressSpaceId, subnet1.String(), addr11.String(), nil)
+	if err != nil {
+		t.Fatalf("ReleaseAddress failed, err:%v", err)
+	}
+
+	prober.conflicts = map[string]bool{addr11.String(): true}
+
+	conflicts, err = am.ProbeAddresses()
+	if err != nil || len(conflicts) != 1 {
+		t.Fatalf("ProbeAddresses returned conflicts %v, err:%v.", conflicts, err)
+	}
+
+	prober.conflicts = nil
+	ar := am.(*addressManager).AddrSpaces[LocalDefaultAddressSpaceId].Pools[subnet1.String()].Addresses[addr11.String()]
+	ar.ConflictAt = ar.ConflictAt.Add(-conflictExpiry)
+
+	address, err = am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	addr, _, _ = net.ParseCIDR(address)
+	if !addr.Equal(addr11) || ar.Conflict {
+		t.Errorf("RequestAddress returned %v instead of %v, conflict:%v.", addr, addr11, ar.Conflict)
+	}
+}
+
+// Tests child subnets are carved out of a pool, shared when specifically requested and released.
+func TestChildSubnetsAreCarvedOutOfPools(t *testing.T) {
+	am, err := NewAddressManager()
+	if err != nil {
+		t.Fatalf("NewAddressManager failed, err:%+v.", err)
+	}
+	amImpl := am.(*addressManager)
+
+	// Configure a pool with addresses in two /28 blocks.
+	subnet := net.IPNet{IP: net.IPv4(10, 0, 4, 0), Mask: net.IPv4Mask(255, 255, 255, 0)}
+	as, _ := amImpl.newAddressSpace(LocalDefaultAddressSpaceId, LocalScope)
+	ap, _ := as.newAddressPool(anyInterface, anyPriority, &subnet)
+	for _, a := range []string{"10.0.4.1", "10.0.4.2", "10.0.4.17"} {
+		addr := net.ParseIP(a)
+		ap.newAddressRecord(&addr)
+	}
+	amImpl.setAddressSpace(as)
+
+	options := map[string]string{OptChildPrefixLength: "28"}
+
+	// Test any free child subnet is carved out of the pool.
+	child1, subnet1, err := am.RequestPool(LocalDefaultAddressSpaceId, subnet.String(), "", options, false)
+	if err != nil {
+		t.Fatalf("RequestPool failed, err:%v", err)
+	}
+
+	if subnet1 != "10.0.4.0/28" {
+		t.Errorf("RequestPool returned child subnet %v instead of 10.0.4.0/28.", subnet1)
+	}
+
+	child2, subnet2, err := am.RequestPool(LocalDefaultAddressSpaceId, subnet.String(), "", options, false)
+	if err != nil {
+		t.Fatalf("RequestPool failed, err:%v", err)
+	}
+
+	if subnet2 != "10.0.4.16/28" {
+		t.Errorf("RequestPool returned child subnet %v instead of 10.0.4.16/28.", subnet2)
+	}
+
+	_, _, err = am.RequestPool(LocalDefaultAddressSpaceId, subnet.String(), "", options, false)
+	if err != errNoAvailableAddressPools {
+		t.Errorf("RequestPool returned err:%v instead of %v.", err, errNoAvailableAddressPools)
+	}
+
+	// Test a specific child subnet is shared.
+	child, _, err := am.RequestPool(LocalDefaultAddressSpaceId, subnet.String(), "10.0.4.0/28", nil, false)
+	if err != nil || child != child1 {
+		t.Errorf("RequestPool returned child %v instead of %v, err:%v.", child, child1, err)
+	}
+
+	// Test addresses are allocated only from their child subnet.
+	address, err := am.RequestAddress(LocalDefaultAddressSpaceId, child2, "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	if address != "10.0.4.17/24" {
+		t.Errorf("RequestAddress returned %v instead of 10.0.4.17/24.", address)
+	}
+
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, child2, "", nil)
+	if err != errNoAvailableAddresses {
+		t.Errorf("RequestAddress returned err:%v instead of %v.", err, errNoAvailableAddresses)
+	}
+
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, subnet.String(), "", nil)
+	if err != errNoAvailableAddresses {
+		t.Errorf("RequestAddress returned err:%v instead of %v.", err, errNoAvailableAddresses)
+	}
+
+	// Test a released child subnet is returned to the pool.
+	err = am.ReleaseAddress(LocalDefaultAddressSpaceId, child2, "10.0.4.17", nil)
+	if err != nil {
+		t.Fatalf("ReleaseAddress failed, err:%v", err)
+	}
+
+	err = am.ReleasePool(LocalDefaultAddressSpaceId, child2)
+	if err != nil {
+		t.Fatalf("ReleasePool failed, err:%v", err)
+	}
+
+	address, err = am.RequestAddress(LocalDefaultAddressSpaceId, subnet.String(), "", nil)
+	if err != nil || address != "10.0.4.17/24" {
+		t.Errorf("RequestAddress returned %v instead of 10.0.4.17/24, err:%v.", address, err)
+	}
+}
+
+// Tests addresses are selected according to the allocation strategy of their pool.
+func TestAllocationStrategies(t *testing.T) {
+	am, err := NewAddressManager()
+	if err != nil {
+		t.Fatalf("NewAddressManager failed, err:%+v.", err)
+	}
+	amImpl := am.(*addressManager)
+
+	subnet := net.IPNet{IP: net.IPv4(10, 0, 5, 0), Mask: net.IPv4Mask(255, 255, 255, 0)}
+	as, _ := amImpl.newAddressSpace(LocalDefaultAddressSpaceId, LocalScope)
+	ap, _ := as.newAddressPool(anyInterface, anyPriority, &subnet)
+	for _, a := range []string{"10.0.5.3", "10.0.5.1", "10.0.5.2"} {
+		addr := net.ParseIP(a)
+		ap.newAddressRecord(&addr)
+	}
+	amImpl.setAddressSpace(as)
+
+	// Test the sequential strategy allocates the lowest address first.
+	ap.Strategy = common.OptIpamStrategySequential
+
+	for _, expected := range []string{"10.0.5.1/24", "10.0.5.2/24"} {
+		address, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet.String(), "", nil)
+		if err != nil || address != expected {
+			t.Fatalf("RequestAddress returned %v instead of %v, err:%v.", address, expected, err)
+		}
+	}
+
+	for _, a := range []string{"10.0.5.1", "10.0.5.2"} {
+		err = am.ReleaseAddress(LocalDefaultAddressSpaceId, subnet.String(), a, nil)
+		if err != nil {
+			t.Fatalf("ReleaseAddress failed, err:%v", err)
+		}
+	}
+
+	// Test the sticky strategy reuses the address last allocated to the same owner.
+	ap.Strategy = common.OptIpamStrategySticky
+	options := map[string]string{OptAddressID: "owner2"}
+
+	address, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet.String(), "", options)
+	if err != nil || address != "10.0.5.3/24" {
+		t.Fatalf("RequestAddress returned %v instead of 10.0.5.3/24, err:%v.", address, err)
+	}
+
+	err = am.ReleaseAddress(LocalDefaultAddressSpaceId, subnet.String(), "", options)
+	if err != nil {
+		t.Fatalf("ReleaseAddress failed, err:%v", err)
+	}
+
+	// The least recently used address would be 10.0.5.1.
+	address, err = am.RequestAddress(LocalDefaultAddressSpaceId, subnet.String(), "", options)
+	if err != nil || address != "10.0.5.3/24" {
+		t.Errorf("RequestAddress returned %v instead of 10.0.5.3/24, err:%v.", address, err)
+	}
+}
+
+// Tests addresses can be listed and looked up by address and owner.
+func TestListAndFindAddresses(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+
+	options := map[string]string{OptContainerID: "container1"}
+	address, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", options)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+	addr, _, _ := net.ParseCIDR(address)
+
+	// Test all addresses in the pool are listed.
+	infos, err := am.ListAddresses(LocalDefaultAddressSpaceId, subnet1.String())
+	if err != nil || len(infos) != 2 || !infos[0].Address.Equal(addr11) || !infos[1].Address.Equal(addr12) {
+		t.Fatalf("ListAddresses returned %+v, err:%v.", infos, err)
+	}
+
+	// Test an address is found with its owner.
+	info, err := am.FindAddress(addr.String())
+	if err != nil || !info.InUse || info.ContainerID != "container1" || info.PoolId != subnet1.String() {
+		t.Errorf("FindAddress returned %+v, err:%v.", info, err)
+	}
+
+	infos, err = am.FindAddressByOwner("container1")
+	if err != nil || len(infos) != 1 || !infos[0].Address.Equal(addr) {
+		t.Errorf("FindAddressByOwner returned %+v, err:%v.", infos, err)
+	}
+
+	// Test unknown addresses and owners are not found.
+	_, err = am.FindAddress("10.9.9.9")
+	if err != errAddressNotFound {
+		t.Errorf("FindAddress returned err:%v instead of %v.", err, errAddressNotFound)
+	}
+
+	_, err = am.FindAddressByOwner("container2")
+	if err != errAddressNotFound {
+		t.Errorf("FindAddressByOwner returned err:%v instead of %v.", err, errAddressNotFound)
+	}
+}
+
+// Tests addresses are requested in bulk all-or-nothing.
+func TestRequestAddressesIsAllOrNothing(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+
+	// Test no address is allocated if the pool cannot satisfy the whole request.
+	_, err = am.RequestAddresses(LocalDefaultAddressSpaceId, subnet1.String(), 3, nil)
+	if err != errNoAvailableAddresses {
+		t.Fatalf("RequestAddresses returned err:%v instead of %v.", err, errNoAvailableAddresses)
+	}
+
+	apInfo, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, subnet1.String())
+	if err != nil || apInfo.Available != 2 {
+		t.Fatalf("GetPoolInfo returned %+v after a failed request, err:%v.", apInfo, err)
+	}
+
+	// Test all addresses are allocated if the pool can satisfy the request.
+	addresses, err := am.RequestAddresses(LocalDefaultAddressSpaceId, subnet1.String(), 2, nil)
+	if err != nil || len(addresses) != 2 || addresses[0] == addresses[1] {
+		t.Errorf("RequestAddresses returned %v, err:%v.", addresses, err)
+	}
+}
+
+// Records the orphaned addresses handled by the network manager.
+type fakeNetApi struct {
+	orphans map[string]bool
+}
+
+func (n *fakeNetApi) AddExternalInterface(ifName string, subnet string) error {
+	return nil
+}
+
+func (n *fakeNetApi) HandleOrphanedAddress(address net.IP, evict bool) error {
+	n.orphans[address.String()] = evict
+	return nil
+}
+
+// Tests in-use addresses withdrawn by the source are tracked as orphans.
+func TestOrphanedAddressesAreTracked(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	netApi := &fakeNetApi{orphans: make(map[string]bool)}
+	amImpl := am.(*addressManager)
+	amImpl.netApi = netApi
+	amImpl.orphanPolicy = common.OptIpamOrphanPolicyEvict
+
+	address, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+	addr, _, _ := net.ParseCIDR(address)
+
+	// Withdraw all addresses of subnet1 except the free one.
+	free := addr11
+	if addr.Equal(addr11) {
+		free = addr12
+	}
+
+	as, _ := amImpl.newAddressSpace(LocalDefaultAddressSpaceId, LocalScope)
+	ap, _ := as.newAddressPool(anyInterface, anyPriority, &subnet1)
+	ap.newAddressRecord(&free)
+	amImpl.setAddressSpace(as)
+
+	// Test the withdrawn address is reported and its endpoint evicted.
+	infos, err := am.ListOrphanedAddresses()
+	if err != nil || len(infos) != 1 || !infos[0].Address.Equal(addr) || infos[0].OrphanedAt.IsZero() {
+		t.Fatalf("ListOrphanedAddresses returned %+v, err:%v.", infos, err)
+	}
+
+	if evict, ok := netApi.orphans[addr.String()]; !ok || !evict {
+		t.Errorf("Orphaned address %v was not evicted, orphans:%v.", addr, netApi.orphans)
+	}
+
+	// Test the address is no longer orphaned once the source advertises it again.
+	as, _ = amImpl.newAddressSpace(LocalDefaultAddressSpaceId, LocalScope)
+	ap, _ = as.newAddressPool(anyInterface, anyPriority, &subnet1)
+	ap.newAddressRecord(&addr11)
+	ap.newAddressRecord(&addr12)
+	amImpl.setAddressSpace(as)
+
+	infos, err = am.ListOrphanedAddresses()
+	if err != nil || len(infos) != 0 {
+		t.Errorf("ListOrphanedAddresses returned %+v after the address was advertised again, err:%v.", infos, err)
+	}
+}
+
+// Tests addresses reserved in a pool are not allocated.
+func TestExcludedAddressesAreNotAllocated(t *testing.T) {
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	amImpl := am.(*addressManager)
+
+	// Test invalid exclusions are rejected.
+	options := map[string]string{OptExclusions: "10.0.1.9-10.0.1.1"}
+	_, _, err = am.RequestPool(LocalDefaultAddressSpaceId, subnet1.String(), "", options, false)
+	if err != errInvalidConfiguration {
+		t.Fatalf("RequestPool returned err:%v instead of %v.", err, errInvalidConfiguration)
+	}
+
+	options = map[string]string{OptExclusions: addr11.String()}
+	_, _, err = am.RequestPool(LocalDefaultAddressSpaceId, subnet1.String(), "", options, false)
+	if err != nil {
+		t.Fatalf("RequestPool failed, err:%v", err)
+	}
+
+	// Test the reservation survives a source refresh.
+	as, _ := amImpl.newAddressSpace(LocalDefaultAddressSpaceId, LocalScope)
+	ap, _ := as.newAddressPool(anyInterface, anyPriority, &subnet1)
+	ap.newAddressRecord(&addr11)
+	ap.newAddressRecord(&addr12)
+	amImpl.setAddressSpace(as)
+
+	apInfo, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, subnet1.String())
+	if err != nil || apInfo.Available != 1 || len(apInfo.Exclusions) != 1 || apInfo.Exclusions[0] != addr11.String() {
+		t.Fatalf("GetPoolInfo returned %+v, err:%v.", apInfo, err)
+	}
+
+	// Test the excluded address is not allocated.
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), addr11.String(), nil)
+	if err != errAddressExcluded {
+		t.Errorf("RequestAddress returned err:%v instead of %v.", err, errAddressExcluded)
+	}
+
+	address, err := am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	addr, _, _ := net.ParseCIDR(address)
+	if !addr.Equal(addr12) {
+		t.Errorf("RequestAddress returned %v instead of %v.", addr, addr12)
+	}
+
+	_, err = am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != errNoAvailableAddresses {
+		t.Errorf("RequestAddress returned err:%v instead of %v.", err, errNoAvailableAddresses)
+	}
+
+	// Test a request sharing the pool cannot change its options.
+	for _, options := range []map[string]string{
+		{OptExclusions: addr12.String()},
+		{OptAllocationStrategy: common.OptIpamStrategyRandom},
+	} {
+		_, _, err = am.RequestPool(LocalDefaultAddressSpaceId, subnet1.String(), "", options, false)
+		if err != errPoolOptionsConflict {
+			t.Errorf("RequestPool with options %v returned err:%v instead of %v.", options, err, errPoolOptionsConflict)
+		}
+	}
+
+	options = map[string]string{OptExclusions: addr11.String()}
+	_, _, err = am.RequestPool(LocalDefaultAddressSpaceId, subnet1.String(), "", options, false)
+	if err != nil {
+		t.Fatalf("RequestPool failed, err:%v", err)
+	}
+
+	// Test the reservation ends with the last release of the pool.
+	for i := 0; i < 2; i++ {
+		err = am.ReleasePool(LocalDefaultAddressSpaceId, subnet1.String())
+		if err != nil {
+			t.Fatalf("ReleasePool failed, err:%v", err)
+		}
+	}
+
+	apInfo, err = am.GetPoolInfo(LocalDefaultAddressSpaceId, subnet1.String())
+	if err != nil || len(apInfo.Exclusions) != 0 {
+		t.Errorf("GetPoolInfo returned %+v after the last release, err:%v.", apInfo, err)
+	}
+}
+
+// Tests hosts sharing a global address space allocate distinct addresses.
+func TestGlobalAddressSpaceIsShared(t *testing.T) {
+	var hosts []*addressManager
+	var addrs []string
+
+	fileName := "ipam-global-test.json"
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".bak")
+	defer os.Remove(fileName + ".lock")
+
+	// Create two hosts sharing the same global store.
+	for i := 0; i < 2; i++ {
+		globalStore, err := store.NewJsonCasStore(fileName)
+		if err != nil {
+			t.Fatalf("NewJsonCasStore failed, err:%v", err)
+		}
+
+		am, err := NewAddressManager()
+		if err != nil {
+			t.Fatalf("NewAddressManager failed, err:%v", err)
+		}
+
+		amImpl := am.(*addressManager)
+		amImpl.globalStore = globalStore
+		hosts = append(hosts, amImpl)
+	}
+
+	// The first host configures the global address space.
+	as, _ := hosts[0].newAddressSpace(GlobalDefaultAddressSpaceId, GlobalScope)
+	ap, _ := as.newAddressPool(anyInterface, anyPriority, &subnet1)
+	ap.newAddressRecord(&addr11)
+	ap.newAddressRecord(&addr12)
+
+	err := hosts[0].setAddressSpace(as)
+	if err != nil {
+		t.Fatalf("setAddressSpace failed, err:%v", err)
+	}
+
+	// Test the second host finds the global address space.
+	_, globalId := hosts[1].GetDefaultAddressSpaces()
+	if globalId != GlobalDefaultAddressSpaceId {
+		t.Fatalf("GetDefaultAddressSpaces returned global address space %v.", globalId)
+	}
+
+	// Test each host is allocated a different address.
+	for _, am := range hosts {
+		address, err := am.RequestAddress(GlobalDefaultAddressSpaceId, subnet1.String(), "", nil)
+		if err != nil {
+			t.Fatalf("RequestAddress failed, err:%v", err)
+		}
+		addrs = append(addrs, address)
+	}
+
+	if addrs[0] == addrs[1] {
+		t.Fatalf("Both hosts were allocated address %v.", addrs[0])
+	}
+
+	_, err = hosts[0].RequestAddress(GlobalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != errNoAvailableAddresses {
+		t.Fatalf("RequestAddress returned err:%v instead of %v.", err, errNoAvailableAddresses)
+	}
+
+	// Test an address released by one host can be allocated by the other.
+	addr, _, _ := net.ParseCIDR(addrs[1])
+	err = hosts[1].ReleaseAddress(GlobalDefaultAddressSpaceId, subnet1.String(), addr.String(), nil)
+	if err != nil {
+		t.Fatalf("ReleaseAddress failed, err:%v", err)
+	}
+
+	address, err := hosts[0].RequestAddress(GlobalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil || address != addrs[1] {
+		t.Errorf("RequestAddress returned %v instead of %v, err:%v.", address, addrs[1], err)
+	}
+
+	// Test an in-use address withdrawn from the global address space stays unhealthy after a refresh.
+	as, _ = hosts[0].newAddressSpace(GlobalDefaultAddressSpaceId, GlobalScope)
+	ap, _ = as.newAddressPool(anyInterface, anyPriority, &subnet1)
+	ap.newAddressRecord(&addr12)
+
+	err = hosts[0].setAddressSpace(as)
+	if err != nil {
+		t.Fatalf("setAddressSpace failed, err:%v", err)
+	}
+
+	hosts[0].GetDefaultAddressSpaces()
+
+	apInfo, err := hosts[0].GetPoolInfo(GlobalDefaultAddressSpaceId, subnet1.String())
+	if err != nil || len(apInfo.UnhealthyAddrs) != 1 || !apInfo.UnhealthyAddrs[0].Equal(addr11) {
+		t.Errorf("GetPoolInfo returned %+v instead of unhealthy address %v, err:%v.", apInfo, addr11, err)
+	}
+}
+
+// Tests pool utilization is reported and a low watermark event is raised once.
+func TestUtilizationAndLowWatermark(t *testing.T) {
+	var events []*PoolUtilization
+
+	fileName := "ipam-utilization-test.json"
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".bak")
+
+	kvs, err := store.NewJsonFileStore(fileName)
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	am.(*addressManager).store = kvs
+	am.(*addressManager).lowWatermark = 60
+
+	handler := func(pu *PoolUtilization) {
+		events = append(events, pu)
+	}
+	am.SetLowWatermarkHandler(handler)
+
+	am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+
+	// Test the state is kept across processes, as with CNI.
+	am, err = NewAddressManager()
+	if err != nil {
+		t.Fatalf("NewAddressManager failed, err:%v", err)
+	}
+
+	err = am.Initialize(&common.PluginConfig{Store: kvs}, map[string]interface{}{common.OptIpamLowWatermark: 60})
+	if err != nil {
+		t.Fatalf("Initialize failed, err:%v", err)
+	}
+	am.SetLowWatermarkHandler(handler)
+
+	for i := 0; i < 2; i++ {
+		am.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	}
+
+	// Test the event is raised only when the pool first drops below the watermark.
+	if len(events) != 1 || events[0].PoolId != subnet1.String() || events[0].Free != 1 {
+		t.Errorf("Low watermark events are %+v.", events)
+	}
+
+	u, err := am.GetUtilization()
+	if err != nil {
+		t.Fatalf("GetUtilization failed, err:%v", err)
+	}
+
+	if u.Capacity != 3 || u.InUse != 2 || u.Free != 1 || u.Allocations != 2 || u.Failures != 1 || len(u.Pools) != 2 {
+		t.Errorf("GetUtilization returned %+v.", u)
+	}
+
+	pu := u.Pools[0]
+	if pu.PoolId != subnet1.String() || pu.InUse != 2 || pu.Free != 0 || pu.Failures != 1 {
+		t.Errorf("GetUtilization returned pool %+v.", pu)
+	}
+
+	// Test the failure counters are saved.
+	am, _ = NewAddressManager()
+	am.Initialize(&common.PluginConfig{Store: kvs}, nil)
+
+	u, err = am.GetUtilization()
+	if err != nil || u.Failures != 1 {
+		t.Errorf("GetUtilization returned %+v after restore, err:%v.", u, err)
+	}
+}
+
+// Tests state written by older releases is migrated when restored.
+func TestRestoreMigratesOlderState(t *testing.T) {
+	// State written by release v0.91, which did not record the DNS servers of pools.
+	fixture, err := ioutil.ReadFile("testdata/azure-vnet-ipam-v0.91.json")
+	if err != nil {
+		t.Fatalf("Failed to read fixture, err:%v", err)
+	}
+
+	fileName := "ipam-migration-test.json"
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".bak")
+	defer os.Remove(fileName + ".lock")
+
+	err = ioutil.WriteFile(fileName, fixture, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write fixture, err:%v", err)
+	}
+
+	kvs, err := store.NewJsonFileStore(fileName)
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	am, err := NewAddressManager()
+	if err != nil {
+		t.Fatalf("NewAddressManager failed, err:%v", err)
+	}
+
+	amImpl := am.(*addressManager)
+	amImpl.store = kvs
+
+	err = amImpl.restore()
+	if err != nil {
+		t.Fatalf("restore failed, err:%v", err)
+	}
+
+	apInfo, err := am.GetPoolInfo(LocalDefaultAddressSpaceId, "10.240.0.0/16")
+	if err != nil {
+		t.Fatalf("GetPoolInfo failed, err:%v", err)
+	}
+
+	if len(apInfo.DnsServers) != 1 || !apInfo.DnsServers[0].Equal(dnsHostProxyAddress) || apInfo.Available != 2 {
+		t.Errorf("GetPoolInfo returned %+v after migration.", apInfo)
+	}
+}
+
+// Tests the migration of older state keeps the fields it does not change, including those unknown to this release.
+func TestMigrationKeepsUnknownFields(t *testing.T) {
+	var fixture, migrated struct {
+		IPAM map[string]interface{}
+	}
+
+	buf, err := ioutil.ReadFile("testdata/azure-vnet-ipam-v0.91.json")
+	if err != nil {
+		t.Fatalf("Failed to read fixture, err:%v", err)
+	}
+
+	err = json.Unmarshal(buf, &fixture)
+	if err != nil {
+		t.Fatalf("Failed to decode fixture, err:%v", err)
+	}
+
+	// A field added by a newer release.
+	fixture.IPAM["Unknown"] = "value"
+	raw, _ := json.Marshal(fixture.IPAM)
+
+	raw, err = migratePoolDnsServers(raw)
+	if err != nil {
+		t.Fatalf("migratePoolDnsServers failed, err:%v", err)
+	}
+
+	err = json.Unmarshal([]byte(`{"IPAM":`+string(raw)+`}`), &migrated)
+	if err != nil {
+		t.Fatalf("Failed to decode migrated state, err:%v", err)
+	}
+
+	// Only the DNS servers of pools are added.
+	pools := migrated.IPAM["AddressSpaces"].(map[string]interface{})["local"].(map[string]interface{})["Pools"]
+	pool := pools.(map[string]interface{})["10.240.0.0/16"].(map[string]interface{})
+	if dnsServers, ok := pool["DnsServers"].([]interface{}); !ok || len(dnsServers) != 1 {
+		t.Errorf("Migrated pool has DNS servers %v.", pool["DnsServers"])
+	}
+	delete(pool, "DnsServers")
+
+	if !reflect.DeepEqual(migrated.IPAM, fixture.IPAM) {
+		t.Errorf("Migrated state %+v differs from %+v.", migrated.IPAM, fixture.IPAM)
+	}
+}
+
+// Tests state changed by another process sharing the store is reloaded.
+func TestStateChangedByAnotherProcessIsReloaded(t *testing.T) {
+	fileName := "ipam-reload-test.json"
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".bak")
+
+	kvs, err := store.NewJsonFileStore(fileName)
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	amImpl := am.(*addressManager)
+	amImpl.store = kvs
+	amImpl.save()
+
+	err = am.StartStoreWatcher()
+	if err != nil {
+		t.Fatalf("StartStoreWatcher failed, err:%v", err)
+	}
+	defer am.Uninitialize()
+
+	// Another process allocates an address through its own store.
+	kvs2, _ := store.NewJsonFileStore(fileName)
+	am2, _ := NewAddressManager()
+	err = am2.Initialize(&common.PluginConfig{Store: kvs2}, nil)
+	if err != nil {
+		t.Fatalf("Initialize failed, err:%v", err)
+	}
+
+	address, err := am2.RequestAddress(LocalDefaultAddressSpaceId, subnet1.String(), "", nil)
+	if err != nil {
+		t.Fatalf("RequestAddress failed, err:%v", err)
+	}
+
+	ip, _, _ := net.ParseCIDR(address)
+
+	for i := 0; ; i++ {
+		info, err := am.FindAddress(ip.String())
+		if err == nil && info.InUse {
+			break
+		}
+
+		if i == 50 {
+			t.Fatalf("Address %v allocated by another process was not reloaded, info:%+v err:%v.", ip, info, err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Tests state saved by the address manager itself is not reloaded.
+func TestOwnChangesAreNotReloaded(t *testing.T) {
+	fileName := "ipam-reload-own-test.json"
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".bak")
+
+	kvs, err := store.NewJsonFileStore(fileName)
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	am, err := createAddressManager()
+	if err != nil {
+		t.Fatalf("createAddressManager failed, err:%+v.", err)
+	}
+	amImpl := am.(*addressManager)
+	amImpl.store = kvs
+
+	err = amImpl.save()
+	if err != nil {
+		t.Fatalf("save failed, err:%v", err)
+	}
+
+	as := amImpl.AddrSpaces[LocalDefaultAddressSpaceId]
+
+	err = amImpl.reload()
+	if err != nil {
+		t.Fatalf("reload failed, err:%v", err)
+	}
+
+	if amImpl.AddrSpaces[LocalDefaultAddressSpaceId] != as {
+		t.Errorf("State saved by the address manager itself was reloaded.")
+	}
+}
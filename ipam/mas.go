@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Azure/azure-container-networking/common"
@@ -108,17 +109,41 @@ func (s *masSource) refresh() error {
 	// Add the IP addresses to the local address space.
 	for _, v := range obj.IPs {
 		address := net.ParseIP(v.IP)
+		if address == nil {
+			log.Printf("[ipam] Failed to parse address:%v.", v.IP)
+			continue
+		}
+
+		v6 := (address.To4() == nil)
+
+		mask := parseMask(v.Mask, v6)
+		if mask == nil {
+			log.Printf("[ipam] Failed to parse mask:%v for address:%v.", v.Mask, address)
+			continue
+		}
+
 		subnet := net.IPNet{
-			IP:   net.ParseIP(v.IP),
-			Mask: net.IPMask(net.ParseIP(v.Mask)),
+			IP:   address.Mask(mask),
+			Mask: mask,
 		}
 
 		ap, err := local.newAddressPool("eth0", 0, &subnet)
-		if err != nil {
+		if err != nil && err != errAddressPoolExists {
 			log.Printf("[ipam] Failed to create pool:%v err:%v.", subnet, err)
 			continue
 		}
 
+		// Prefer the gateway and DNS servers advertised by the host agent.
+		gateways := parseAddresses(v.DefaultGateways, v6)
+		if len(gateways) > 0 {
+			ap.Gateway = gateways[0]
+		}
+
+		dnsServers := parseAddresses(v.DnsServers, v6)
+		if len(dnsServers) > 0 {
+			ap.DnsServers = dnsServers
+		}
+
 		_, err = ap.newAddressRecord(&address)
 		if err != nil {
 			log.Printf("[ipam] Failed to create address:%v err:%v.", address, err)
@@ -131,3 +156,45 @@ func (s *masSource) refresh() error {
 
 	return nil
 }
+
+// Parses a subnet mask in either prefix length or address notation.
+func parseMask(s string, v6 bool) net.IPMask {
+	bits := 8 * net.IPv4len
+	if v6 {
+		bits = 8 * net.IPv6len
+	}
+
+	if ones, err := strconv.Atoi(s); err == nil {
+		return net.CIDRMask(ones, bits)
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+
+	if v6 {
+		return net.IPMask(ip.To16())
+	}
+
+	if ip.To4() == nil {
+		return nil
+	}
+
+	return net.IPMask(ip.To4())
+}
+
+// Parses the addresses of the given address family from a list, skipping invalid ones.
+func parseAddresses(list []string, v6 bool) []net.IP {
+	var addresses []net.IP
+
+	for _, s := range list {
+		address := net.ParseIP(s)
+		if address == nil || (address.To4() == nil) != v6 {
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
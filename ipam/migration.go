@@ -0,0 +1,102 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/Azure/azure-container-networking/store"
+)
+
+func init() {
+	store.RegisterMigration(storeKey, 0, migratePoolDnsServers)
+}
+
+// Migrates address manager state to schema version 1.
+// Releases up to v0.91 did not record the DNS servers of pools, and used the defaults for their subnets.
+// The state is migrated as raw JSON, so that fields unknown to this release are kept.
+func migratePoolDnsServers(raw json.RawMessage) (json.RawMessage, error) {
+	var state map[string]json.RawMessage
+	var addrSpaces map[string]map[string]json.RawMessage
+
+	err := json.Unmarshal(raw, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unmarshalField(state, "AddressSpaces", &addrSpaces)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, as := range addrSpaces {
+		var pools map[string]map[string]json.RawMessage
+
+		err = unmarshalField(as, "Pools", &pools)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ap := range pools {
+			var dnsServers []net.IP
+			var subnet net.IPNet
+			var isIPv6 bool
+
+			if ap == nil {
+				continue
+			}
+
+			err = unmarshalField(ap, "DnsServers", &dnsServers)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(dnsServers) != 0 {
+				continue
+			}
+
+			err = unmarshalField(ap, "Subnet", &subnet)
+			if err != nil {
+				return nil, err
+			}
+
+			err = unmarshalField(ap, "IsIPv6", &isIPv6)
+			if err != nil {
+				return nil, err
+			}
+
+			ap["DnsServers"], err = json.Marshal(getDefaultDnsServers(&subnet, isIPv6))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if pools != nil {
+			as["Pools"], err = json.Marshal(pools)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if addrSpaces != nil {
+		state["AddressSpaces"], err = json.Marshal(addrSpaces)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(state)
+}
+
+// Decodes the given field of a raw JSON object, leaving the value unchanged if the field is missing.
+func unmarshalField(fields map[string]json.RawMessage, name string, value interface{}) error {
+	raw, ok := fields[name]
+	if !ok {
+		return nil
+	}
+
+	return json.Unmarshal(raw, value)
+}
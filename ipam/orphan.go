@@ -0,0 +1,50 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"github.com/Azure/azure-container-networking/common"
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// ListOrphanedAddresses returns the in-use addresses that are no longer advertised by the address source.
+func (am *addressManager) ListOrphanedAddresses() ([]*AddressInfo, error) {
+	var infos []*AddressInfo
+
+	am.Lock()
+	defer am.Unlock()
+
+	for _, as := range am.AddrSpaces {
+		for _, ap := range as.Pools {
+			for _, ar := range ap.Addresses {
+				if !ar.OrphanedAt.IsZero() {
+					infos = append(infos, ap.getAddressInfo(ar))
+				}
+			}
+		}
+	}
+
+	sortAddressInfos(infos)
+
+	return infos, nil
+}
+
+// Handles in-use addresses that were withdrawn by the address source.
+func (am *addressManager) handleOrphanedAddresses(orphans []*AddressInfo) {
+	for _, info := range orphans {
+		log.Printf("[ipam] Address %v in pool %v owned by %v is no longer advertised by the source.",
+			info.Address, info.PoolId, info.OwnerID)
+
+		if am.netApi == nil || am.orphanPolicy == "" || am.orphanPolicy == common.OptIpamOrphanPolicyNone {
+			continue
+		}
+
+		evict := am.orphanPolicy == common.OptIpamOrphanPolicyEvict
+
+		err := am.netApi.HandleOrphanedAddress(info.Address, evict)
+		if err != nil {
+			log.Printf("[ipam] Failed to handle orphaned address %v, err:%v.", info.Address, err)
+		}
+	}
+}
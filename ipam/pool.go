@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Azure/azure-container-networking/platform"
@@ -51,17 +52,26 @@ type addressSpace struct {
 
 // Represents a subnet and the set of addresses in it.
 type addressPool struct {
-	as        *addressSpace
-	Id        string
-	IfName    string
-	Subnet    net.IPNet
-	Gateway   net.IP
-	Addresses map[string]*addressRecord
-	addrsByID map[string]*addressRecord
-	IsIPv6    bool
-	Priority  int
-	RefCount  int
-	epoch     int
+	as                *addressSpace
+	Id                string
+	IfName            string
+	Subnet            net.IPNet
+	Gateway           net.IP
+	DnsServers        []net.IP
+	Addresses         map[string]*addressRecord
+	addrsByID         map[string]*addressRecord
+	Children          map[string]*childPool `json:",omitempty"`
+	Strategy          string                `json:",omitempty"`
+	RequestedStrategy string                `json:",omitempty"`
+	Exclusions        []string              `json:",omitempty"`
+	Reservations      []string              `json:",omitempty"`
+	IsIPv6            bool
+	Priority          int
+	RefCount          int
+	Allocations       uint64 `json:",omitempty"`
+	Failures          uint64 `json:",omitempty"`
+	BelowLowWatermark bool   `json:",omitempty"`
+	epoch             int
 }
 
 // AddressPoolInfo contains information about an address pool.
@@ -70,6 +80,7 @@ type AddressPoolInfo struct {
 	Gateway        net.IP
 	DnsServers     []net.IP
 	UnhealthyAddrs []net.IP
+	Exclusions     []string
 	IsIPv6         bool
 	Available      int
 	Capacity       int
@@ -77,11 +88,17 @@ type AddressPoolInfo struct {
 
 // Represents an IP address in a pool.
 type addressRecord struct {
-	ID        string
-	Addr      net.IP
-	InUse     bool
-	unhealthy bool
-	epoch     int
+	ID         string
+	Addr       net.IP
+	InUse      bool
+	Lease      *addressLease `json:",omitempty"`
+	ReleasedAt time.Time
+	LastID     string `json:",omitempty"`
+	OrphanedAt time.Time
+	Conflict   bool
+	ConflictAt time.Time
+	unhealthy  bool
+	epoch      int
 }
 
 //
@@ -143,6 +160,28 @@ func (am *addressManager) newAddressSpace(id string, scope int) (*addressSpace,
 	}, nil
 }
 
+// Populates the pointers and indexes of an address space decoded from its persisted state.
+func (as *addressSpace) populate() {
+	if as.Pools == nil {
+		as.Pools = make(map[string]*addressPool)
+	}
+
+	for _, ap := range as.Pools {
+		ap.as = as
+		ap.addrsByID = make(map[string]*addressRecord)
+
+		if ap.Addresses == nil {
+			ap.Addresses = make(map[string]*addressRecord)
+		}
+
+		for _, ar := range ap.Addresses {
+			if ar.ID != "" {
+				ap.addrsByID[ar.ID] = ar
+			}
+		}
+	}
+}
+
 // Returns the address space with the given ID.
 func (am *addressManager) getAddressSpace(id string) (*addressSpace, error) {
 	as := am.AddrSpaces[id]
@@ -155,11 +194,25 @@ func (am *addressManager) getAddressSpace(id string) (*addressSpace, error) {
 
 // Sets a new or updates an existing address space.
 func (am *addressManager) setAddressSpace(as *addressSpace) error {
+	var orphans []*AddressInfo
+	var err error
+
 	as1, ok := am.AddrSpaces[as.Id]
-	if !ok {
+	if am.isShared(as) {
+		// Global address spaces are merged in the global store.
+		orphans, err = am.setGlobalAddressSpace(as)
+		if err != nil {
+			log.Printf("[ipam] Failed to set global address space %v, err:%v.", as.Id, err)
+			return err
+		}
+	} else if !ok {
 		am.AddrSpaces[as.Id] = as
 	} else {
-		as1.merge(as)
+		orphans = as1.merge(as)
+	}
+
+	if len(orphans) > 0 {
+		am.handleOrphanedAddresses(orphans)
 	}
 
 	// Notify NetPlugin of external interfaces.
@@ -175,7 +228,10 @@ func (am *addressManager) setAddressSpace(as *addressSpace) error {
 }
 
 // Merges a new address space to an existing one.
-func (as *addressSpace) merge(newas *addressSpace) {
+// Returns the in-use addresses that are no longer advertised, if they were not already orphaned.
+func (as *addressSpace) merge(newas *addressSpace) []*AddressInfo {
+	var orphans []*AddressInfo
+
 	// The new epoch after the merge.
 	as.epoch++
 
@@ -204,11 +260,23 @@ func (as *addressSpace) merge(newas *addressSpace) {
 					// This address record already exists.
 					ar.epoch = as.epoch
 					ar.unhealthy = false
+					ar.OrphanedAt = time.Time{}
 				}
 
 				delete(pv.Addresses, ak)
 			}
 
+			// Pick up any change in the gateway and DNS servers advertised by the source.
+			ap.Gateway = pv.Gateway
+			ap.DnsServers = pv.DnsServers
+			if pv.Strategy != "" {
+				ap.Strategy = pv.Strategy
+			}
+
+			// Exclusions configured by the source replace the previous ones.
+			// Those reserved when the pool was requested are kept.
+			ap.Exclusions = pv.Exclusions
+
 			pv.as = nil
 		}
 
@@ -224,10 +292,15 @@ func (as *addressSpace) merge(newas *addressSpace) {
 				if av.epoch == as.epoch {
 					// Pool has at least one valid or in-use address.
 					pv.epoch = as.epoch
-				} else if av.InUse {
+				} else if av.InUse || av.ID != "" {
 					// Address is no longer valid, but still in use.
 					pv.epoch = as.epoch
 					av.unhealthy = true
+
+					if av.OrphanedAt.IsZero() {
+						av.OrphanedAt = time.Now()
+						orphans = append(orphans, pv.getAddressInfo(av))
+					}
 				} else {
 					// This address is no longer available.
 					delete(pv.Addresses, ak)
@@ -242,7 +315,7 @@ func (as *addressSpace) merge(newas *addressSpace) {
 		}
 	}
 
-	return
+	return orphans
 }
 
 // Creates a new addressPool object.
@@ -257,16 +330,17 @@ func (as *addressSpace) newAddressPool(ifName string, priority int, subnet *net.
 	v6 := (subnet.IP.To4() == nil)
 
 	pool = &addressPool{
-		as:        as,
-		Id:        id,
-		IfName:    ifName,
-		Subnet:    *subnet,
-		Gateway:   platform.GenerateAddress(subnet, defaultGatewayHostId),
-		Addresses: make(map[string]*addressRecord),
-		addrsByID: make(map[string]*addressRecord),
-		IsIPv6:    v6,
-		Priority:  priority,
-		epoch:     as.epoch,
+		as:         as,
+		Id:         id,
+		IfName:     ifName,
+		Subnet:     *subnet,
+		Gateway:    generateHostAddress(subnet, defaultGatewayHostId),
+		DnsServers: getDefaultDnsServers(subnet, v6),
+		Addresses:  make(map[string]*addressRecord),
+		addrsByID:  make(map[string]*addressRecord),
+		IsIPv6:     v6,
+		Priority:   priority,
+		epoch:      as.epoch,
 	}
 
 	as.Pools[id] = pool
@@ -274,6 +348,35 @@ func (as *addressSpace) newAddressPool(ifName string, priority int, subnet *net.
 	return pool, nil
 }
 
+// Generates the address with the given host ID in a subnet.
+func generateHostAddress(subnet *net.IPNet, hostId net.IP) net.IP {
+	network := net.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask}
+	if network.IP == nil {
+		network.IP = subnet.IP
+	}
+
+	address := platform.GenerateAddress(&network, hostId)
+	if address.To4() != nil {
+		address = address.To4()
+	}
+
+	return address
+}
+
+// Returns the default DNS servers for a subnet.
+// IPv4 subnets use the Azure DNS host proxy, which is not reachable over IPv6.
+// IPv6 subnets use the well-known DNS host IDs in the subnet instead.
+func getDefaultDnsServers(subnet *net.IPNet, v6 bool) []net.IP {
+	if !v6 {
+		return []net.IP{dnsHostProxyAddress}
+	}
+
+	return []net.IP{
+		generateHostAddress(subnet, dnsPrimaryHostId),
+		generateHostAddress(subnet, dnsSecondaryHostId),
+	}
+}
+
 // Returns the address pool with the given pool ID.
 func (as *addressSpace) getAddressPool(poolId string) (*addressPool, error) {
 	ap := as.Pools[poolId]
@@ -285,11 +388,32 @@ func (as *addressSpace) getAddressPool(poolId string) (*addressPool, error) {
 }
 
 // Requests a new address pool from the address space.
-func (as *addressSpace) requestPool(poolId string, subPoolId string, options map[string]string, v6 bool) (*addressPool, error) {
+// If a child subnet is requested, also returns the child pool carved out of the address pool.
+func (as *addressSpace) requestPool(poolId string, subPoolId string, options map[string]string, v6 bool) (*addressPool, *childPool, error) {
 	var ap *addressPool
+	var cp *childPool
 	var err error
 
-	log.Printf("[ipam] Requesting pool with poolId:%v options:%+v v6:%v.", poolId, options, v6)
+	log.Printf("[ipam] Requesting pool with poolId:%v subPoolId:%v options:%+v v6:%v.", poolId, subPoolId, options, v6)
+
+	child := isChildPoolRequest(subPoolId, options)
+
+	// Validate the allocation strategy requested for the pool.
+	strategy := options[OptAllocationStrategy]
+	if _, err = newAllocationStrategy(strategy); err != nil {
+		log.Printf("[ipam] Invalid allocation strategy %v.", strategy)
+		return nil, nil, err
+	}
+
+	// Validate the addresses requested to be reserved in the pool.
+	var reservations []string
+	if s := options[OptExclusions]; s != "" {
+		reservations, err = parseExclusionList(s, v6)
+		if err != nil {
+			log.Printf("[ipam] Invalid exclusions %v.", s)
+			return nil, nil, err
+		}
+	}
 
 	if poolId != "" {
 		// Return the specific address pool requested.
@@ -306,7 +430,8 @@ func (as *addressSpace) requestPool(poolId string, subPoolId string, options map
 			log.Printf("[ipam] Checking pool %v.", pool.Id)
 
 			// Skip if pool is already in use.
-			if pool.isInUse() {
+			// Pools handing out child subnets are shared by all child subnet requests.
+			if pool.RefCount > 0 || (!child && pool.isInUse()) {
 				log.Printf("[ipam] Pool is in use.")
 				continue
 			}
@@ -323,6 +448,12 @@ func (as *addressSpace) requestPool(poolId string, subPoolId string, options map
 				continue
 			}
 
+			// Skip if the requested child subnet cannot be carved out of the pool.
+			if child && !pool.canRequestChildPool(subPoolId, options) {
+				log.Printf("[ipam] Pool does not have the requested child subnet.")
+				continue
+			}
+
 			log.Printf("[ipam] Pool %v matches requirements.", pool.Id)
 
 			if ap == nil {
@@ -349,12 +480,48 @@ func (as *addressSpace) requestPool(poolId string, subPoolId string, options map
 	}
 
 	if ap != nil {
-		ap.RefCount++
+		if child {
+			cp, err = ap.requestChildPool(subPoolId, options)
+			if err != nil {
+				ap = nil
+			}
+		} else if !ap.acceptsPoolOptions(strategy, reservations) {
+			// Requests sharing a pool cannot change the options of earlier requests.
+			err = errPoolOptionsConflict
+			ap = nil
+		} else {
+			ap.RefCount++
+
+			if strategy != "" {
+				ap.RequestedStrategy = strategy
+			}
+
+			if reservations != nil {
+				ap.Reservations = reservations
+			}
+		}
+	}
+
+	log.Printf("[ipam] Pool request completed with pool:%+v child:%+v err:%v.", ap, cp, err)
+
+	return ap, cp, err
+}
+
+// Returns whether a request with the given options can use the pool alongside its earlier requests.
+func (ap *addressPool) acceptsPoolOptions(strategy string, reservations []string) bool {
+	if ap.RefCount == 0 {
+		return true
+	}
+
+	if strategy != "" && strategy != ap.RequestedStrategy {
+		return false
 	}
 
-	log.Printf("[ipam] Pool request completed with pool:%+v err:%v.", ap, err)
+	if reservations != nil && strings.Join(reservations, ",") != strings.Join(ap.Reservations, ",") {
+		return false
+	}
 
-	return ap, err
+	return true
 }
 
 // Releases a previously requested address pool back to its address space.
@@ -363,13 +530,11 @@ func (as *addressSpace) releasePool(poolId string) error {
 
 	log.Printf("[ipam] Releasing pool with poolId:%v.", poolId)
 
-	ap, ok := as.Pools[poolId]
-	if !ok {
+	ap, cp, _ := as.getPoolOrChild(poolId)
+	if ap == nil {
 		err = errAddressPoolNotFound
-	} else {
-		if !ap.isInUse() {
-			err = errAddressPoolNotInUse
-		}
+	} else if cp == nil && ap.RefCount <= 0 {
+		err = errAddressPoolNotInUse
 	}
 
 	if err != nil {
@@ -377,50 +542,92 @@ func (as *addressSpace) releasePool(poolId string) error {
 		return err
 	}
 
-	ap.RefCount--
+	if cp != nil {
+		ap.releaseChildPool(cp)
+	} else {
+		ap.RefCount--
+
+		// Options requested for the pool end with its last request.
+		if ap.RefCount == 0 {
+			ap.RequestedStrategy = ""
+			ap.Reservations = nil
+		}
+	}
 
 	// Delete address pool if it is no longer available.
 	if ap.epoch < as.epoch && !ap.isInUse() {
-		log.Printf("[ipam] Deleting stale pool with poolId:%v.", poolId)
-		delete(as.Pools, poolId)
+		log.Printf("[ipam] Deleting stale pool with poolId:%v.", ap.Id)
+		delete(as.Pools, ap.Id)
 	}
 
 	return nil
 }
 
-//
 // AddressPool
 //
-// Returns address pool information.
-func (ap *addressPool) getInfo() *AddressPoolInfo {
+// Returns information about the address pool, or about one of its child subnets if child is not nil.
+func (ap *addressPool) getInfo(cp *childPool) *AddressPoolInfo {
 	var available int
+	var capacity int
 	var unhealthyAddrs []net.IP
+	var exclusions []string
+
+	subnet := ap.Subnet
+	if cp != nil {
+		subnet = cp.Subnet
+	}
+
+	excluded := ap.getExcludedRanges()
 
 	for _, ar := range ap.Addresses {
-		if !ar.InUse {
+		if !ap.isInScope(ar, cp) {
+			continue
+		}
+
+		capacity++
+		if !ar.InUse && !isExcludedAddress(ar.Addr, excluded) {
 			available++
 		}
-		if ar.unhealthy {
+		if ar.unhealthy || ar.Conflict {
 			unhealthyAddrs = append(unhealthyAddrs, ar.Addr)
 		}
 	}
 
+	exclusions = append(exclusions, ap.Exclusions...)
+	exclusions = append(exclusions, ap.Reservations...)
+
 	info := &AddressPoolInfo{
-		Subnet:         ap.Subnet,
+		Subnet:         subnet,
 		Gateway:        ap.Gateway,
-		DnsServers:     []net.IP{dnsHostProxyAddress},
+		DnsServers:     ap.DnsServers,
 		UnhealthyAddrs: unhealthyAddrs,
+		Exclusions:     exclusions,
 		IsIPv6:         ap.IsIPv6,
 		Available:      available,
-		Capacity:       len(ap.Addresses),
+		Capacity:       capacity,
 	}
 
 	return info
 }
 
-// Returns if an address pool is currently in use.
+// Returns if an address pool or any of its child subnets is currently in use.
 func (ap *addressPool) isInUse() bool {
-	return ap.RefCount > 0
+	return ap.RefCount > 0 || len(ap.Children) > 0
+}
+
+// Returns whether an address is reserved for the gateway or DNS servers of the pool.
+func (ap *addressPool) isReservedAddress(addr net.IP) bool {
+	if addr.Equal(ap.Gateway) {
+		return true
+	}
+
+	for _, dnsServer := range ap.DnsServers {
+		if addr.Equal(dnsServer) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Creates a new addressRecord object.
@@ -446,8 +653,9 @@ func (ap *addressPool) newAddressRecord(addr *net.IP) (*addressRecord, error) {
 	return ar, nil
 }
 
-// Requests a new address from the address pool.
-func (ap *addressPool) requestAddress(address string, options map[string]string) (string, error) {
+// Requests a new address from the address pool, or from one of its child subnets if child is not nil.
+// Unless an address is specifically requested, it is selected according to the allocation policy.
+func (ap *addressPool) requestAddress(address string, options map[string]string, cp *childPool, policy *allocationPolicy) (string, error) {
 	var ar *addressRecord
 	var addr *net.IPNet
 	var err error
@@ -459,10 +667,14 @@ func (ap *addressPool) requestAddress(address string, options map[string]string)
 	if address != "" {
 		// Return the specific address requested.
 		ar = ap.Addresses[address]
-		if ar == nil {
+		if ar == nil || !ap.isInScope(ar, cp) {
 			err = errAddressNotFound
 			return "", err
 		}
+		if !ar.InUse && ar.ID == "" && isExcludedAddress(ar.Addr, ap.getExcludedRanges()) {
+			err = errAddressExcluded
+			return "", err
+		}
 		if ar.InUse {
 			// Return the same address if IDs match.
 			if id == "" || id != ar.ID {
@@ -481,15 +693,9 @@ func (ap *addressPool) requestAddress(address string, options map[string]string)
 		ar = ap.addrsByID[id]
 	}
 
-	// If no address was found, return any available address.
+	// If no address was found, select an available address that no other host answers for.
 	if ar == nil {
-		for _, ar = range ap.Addresses {
-			if !ar.InUse && ar.ID == "" {
-				break
-			}
-			ar = nil
-		}
-
+		ar = ap.selectProbedAddress(cp, options, policy)
 		if ar == nil {
 			return "", errNoAvailableAddresses
 		}
@@ -502,6 +708,9 @@ func (ap *addressPool) requestAddress(address string, options map[string]string)
 		ar.InUse = true
 	}
 
+	// Record the owner of the address.
+	ar.Lease = newAddressLease(options)
+
 	// Return address in CIDR notation.
 	addr = &net.IPNet{
 		IP:   ar.Addr,
@@ -511,6 +720,75 @@ func (ap *addressPool) requestAddress(address string, options map[string]string)
 	return addr.String(), nil
 }
 
+// Undoes a request for an address in CIDR notation, leaving the address as if it had never been requested.
+func (ap *addressPool) cancelAddressRequest(address string) {
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return
+	}
+
+	ar := ap.Addresses[ip.String()]
+	if ar != nil {
+		ar.InUse = false
+		ar.Lease = nil
+	}
+}
+
+// Returns the available address chosen by the allocation strategy, preferring those just probed
+// and found free.
+func (ap *addressPool) selectAvailableAddress(cp *childPool, options map[string]string, policy *allocationPolicy) *addressRecord {
+	var probed []*addressRecord
+
+	if policy == nil {
+		policy = &allocationPolicy{}
+	}
+
+	// Without a prober, expired conflicts cannot be verified and the addresses are offered as they are.
+	candidates := ap.getAvailableAddresses(cp, policy, policy.prober == nil)
+
+	for _, ar := range candidates {
+		if conflict, ok := policy.probed[ar.Addr.String()]; ok && !conflict {
+			probed = append(probed, ar)
+		}
+	}
+
+	if len(probed) > 0 {
+		candidates = probed
+	}
+
+	return policy.getStrategy().selectAddress(candidates, options)
+}
+
+// Returns the available addresses, skipping those in cooldown, those in conflict with another host
+// and those excluded from allocation. Addresses whose conflict has expired are included if requested.
+func (ap *addressPool) getAvailableAddresses(cp *childPool, policy *allocationPolicy, expiredConflicts bool) []*addressRecord {
+	var candidates []*addressRecord
+
+	excluded := ap.getExcludedRanges()
+
+	for _, ar := range ap.Addresses {
+		if ar.InUse || ar.ID != "" || !ap.isInScope(ar, cp) {
+			continue
+		}
+
+		if ar.Conflict && !(expiredConflicts && isConflictExpired(ar)) {
+			continue
+		}
+
+		if isExcludedAddress(ar.Addr, excluded) {
+			continue
+		}
+
+		if !ar.ReleasedAt.IsZero() && time.Since(ar.ReleasedAt) < policy.cooldown {
+			continue
+		}
+
+		candidates = append(candidates, ar)
+	}
+
+	return candidates
+}
+
 // Releases a previously requested address back to its address pool.
 func (ap *addressPool) releaseAddress(address string, options map[string]string) error {
 	var ar *addressRecord
@@ -546,12 +824,12 @@ func (ap *addressPool) releaseAddress(address string, options map[string]string)
 		return nil
 	}
 
-	if !ar.InUse {
+	if !ar.InUse && ar.ID == "" {
 		log.Printf("Address not in use. Not Returning error")
 		return nil
 	}
 
-	ar.InUse = false
+	ar.setReleased()
 
 	if id != "" && ar.ID == id {
 		delete(ap.addrsByID, ar.ID)
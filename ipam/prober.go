@@ -0,0 +1,241 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"net"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Time to wait for replies to an address probe.
+	probeTimeout = time.Second
+
+	// Default time interval between consecutive probes of free addresses.
+	defaultProbeInterval = 5 * time.Minute
+
+	// Time after which an address in conflict is probed again before it is allocated.
+	conflictExpiry = defaultProbeInterval
+
+	// Maximum number of candidates probed beyond the number of addresses requested.
+	maxExtraProbes = 4
+)
+
+// AddressProber detects addresses that are already in use by another host on a link.
+type addressProber interface {
+	// Probe returns whether another host answers for the address on the interface.
+	probe(ifName string, addr net.IP) (bool, error)
+}
+
+// Represents an address to be probed.
+type probeTarget struct {
+	ap *addressPool
+	ar *addressRecord
+}
+
+// ProbeAddresses probes all free addresses and updates their conflict state.
+// Returns the addresses found to be in conflict.
+func (am *addressManager) ProbeAddresses() ([]string, error) {
+	var targets []probeTarget
+	var conflicts []string
+
+	if am.prober == nil {
+		return nil, nil
+	}
+
+	// Collect free addresses, but probe them without holding the lock.
+	am.Lock()
+	for _, as := range am.AddrSpaces {
+		for _, ap := range as.Pools {
+			if ap.IfName == "" {
+				continue
+			}
+
+			for _, ar := range ap.Addresses {
+				if !ar.InUse && ar.ID == "" {
+					targets = append(targets, probeTarget{ap: ap, ar: ar})
+				}
+			}
+		}
+	}
+	am.Unlock()
+
+	results := make([]bool, len(targets))
+	for i, t := range targets {
+		conflict, err := am.prober.probe(t.ap.IfName, t.ar.Addr)
+		if err != nil {
+			log.Printf("[ipam] Failed to probe address %v on %v, err:%v.", t.ar.Addr, t.ap.IfName, err)
+			results[i] = t.ar.Conflict
+			continue
+		}
+		results[i] = conflict
+	}
+
+	am.Lock()
+	defer am.Unlock()
+
+	changed := false
+	for i, t := range targets {
+		// Skip addresses allocated while probing.
+		if t.ar.InUse || t.ar.ID != "" {
+			continue
+		}
+
+		if results[i] {
+			conflicts = append(conflicts, t.ar.Addr.String())
+		}
+
+		// Conflicts found again are renewed.
+		if results[i] || t.ar.Conflict {
+			t.ap.setConflict(t.ar, results[i])
+			changed = true
+		}
+	}
+
+	if changed {
+		return conflicts, am.save()
+	}
+
+	return conflicts, nil
+}
+
+// StartProber probes free addresses now and then periodically until address manager is uninitialized.
+func (am *addressManager) StartProber(interval time.Duration) {
+	if am.prober == nil {
+		return
+	}
+
+	if interval == 0 {
+		interval = defaultProbeInterval
+	}
+
+	log.Printf("[ipam] Starting address prober with interval %v.", interval)
+
+	stop := make(chan bool)
+	am.stopProber = stop
+
+	go func() {
+		am.ProbeAddresses()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				am.ProbeAddresses()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Probes the addresses a request is most likely to be allocated for conflicts with other hosts.
+// The address manager lock is released while probing. Returns the probe results by address.
+func (am *addressManager) probeCandidates(asId, poolId, address string, count int, options map[string]string) map[string]bool {
+	if am.prober == nil || address != "" || options[OptAddressType] == OptAddressTypeGateway {
+		return nil
+	}
+
+	as, err := am.getAddressSpace(asId)
+	if err != nil {
+		return nil
+	}
+
+	ap, cp, err := as.getPoolOrChild(poolId)
+	if err != nil || ap.IfName == "" {
+		return nil
+	}
+
+	ifName := ap.IfName
+	candidates := ap.getProbeCandidates(cp, options, am.getAllocationPolicy(ap), count+maxExtraProbes)
+
+	am.Unlock()
+	defer am.Lock()
+
+	results := make(map[string]bool)
+	free := 0
+	for _, addr := range candidates {
+		if free == count {
+			break
+		}
+
+		conflict, err := am.prober.probe(ifName, addr)
+		if err != nil {
+			log.Printf("[ipam] Failed to probe address %v on %v, err:%v.", addr, ifName, err)
+			continue
+		}
+
+		results[addr.String()] = conflict
+		if !conflict {
+			free++
+		}
+	}
+
+	return results
+}
+
+// Returns up to n available addresses in the order the allocation strategy selects them,
+// including those whose conflict has expired.
+func (ap *addressPool) getProbeCandidates(cp *childPool, options map[string]string, policy *allocationPolicy, n int) []net.IP {
+	var addrs []net.IP
+
+	strategy := policy.getStrategy()
+	candidates := ap.getAvailableAddresses(cp, policy, true)
+
+	for len(addrs) < n {
+		ar := strategy.selectAddress(candidates, options)
+		if ar == nil {
+			break
+		}
+
+		addrs = append(addrs, ar.Addr)
+
+		for i := range candidates {
+			if candidates[i] == ar {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return addrs
+}
+
+// Records the results of probing candidates and returns an available address, preferring
+// those found free.
+func (ap *addressPool) selectProbedAddress(cp *childPool, options map[string]string, policy *allocationPolicy) *addressRecord {
+	if policy != nil {
+		for addr, conflict := range policy.probed {
+			ar := ap.Addresses[addr]
+			if ar != nil && !ar.InUse && ar.ID == "" {
+				ap.setConflict(ar, conflict)
+			}
+		}
+	}
+
+	return ap.selectAvailableAddress(cp, options, policy)
+}
+
+// Returns whether the conflict of an address is old enough for the address to be probed again.
+func isConflictExpired(ar *addressRecord) bool {
+	return time.Since(ar.ConflictAt) >= conflictExpiry
+}
+
+// Updates the conflict state of an address.
+func (ap *addressPool) setConflict(ar *addressRecord, conflict bool) {
+	if conflict && !ar.Conflict {
+		log.Printf("[ipam] Address %v in pool %v is in use by another host, marking unhealthy.", ar.Addr, ap.Id)
+	} else if !conflict && ar.Conflict {
+		log.Printf("[ipam] Address %v in pool %v is no longer in conflict, marking healthy.", ar.Addr, ap.Id)
+	}
+
+	ar.Conflict = conflict
+	if conflict {
+		ar.ConflictAt = time.Now()
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build linux
+
+package ipam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ARP protocol constants.
+	arpHardwareTypeEthernet = 1
+	arpProtocolTypeIPv4     = 0x0800
+	arpOpRequest            = 1
+	arpOpReply              = 2
+	arpPacketLen            = 28
+
+	// ICMPv6 neighbor discovery constants.
+	icmpv6NeighborSolicitation  = 135
+	icmpv6NeighborAdvertisement = 136
+	ndpOptSourceLinkLayerAddr   = 1
+	ndpHopLimit                 = 255
+)
+
+// Linux address prober that uses ARP for IPv4 and NDP for IPv6.
+type linuxAddressProber struct {
+	timeout time.Duration
+}
+
+// Creates the platform address prober.
+func newAddressProber() (addressProber, error) {
+	return &linuxAddressProber{timeout: probeTimeout}, nil
+}
+
+// Probe returns whether another host answers for the address on the interface.
+func (p *linuxAddressProber) probe(ifName string, addr net.IP) (bool, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return false, err
+	}
+
+	if addr.To4() != nil {
+		return p.probeARP(iface, addr.To4())
+	}
+
+	return p.probeNDP(iface, addr.To16())
+}
+
+// Sends an ARP probe as described in RFC 5227 and waits for a reply from another host.
+func (p *linuxAddressProber) probeARP(iface *net.Interface, addr net.IP) (bool, error) {
+	if len(iface.HardwareAddr) != 6 {
+		return false, fmt.Errorf("Interface %v does not have an Ethernet address", iface.Name)
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  iface.Index,
+	}
+
+	err = unix.Bind(fd, sa)
+	if err != nil {
+		return false, err
+	}
+
+	// Build the probe with an unspecified sender address so that peers do not update their caches.
+	req := make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(req[0:2], arpHardwareTypeEthernet)
+	binary.BigEndian.PutUint16(req[2:4], arpProtocolTypeIPv4)
+	req[4] = 6
+	req[5] = net.IPv4len
+	binary.BigEndian.PutUint16(req[6:8], arpOpRequest)
+	copy(req[8:14], iface.HardwareAddr)
+	copy(req[24:28], addr)
+
+	sa.Halen = 6
+	copy(sa.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	err = unix.Sendto(fd, req, 0, sa)
+	if err != nil {
+		return false, err
+	}
+
+	// Any ARP packet from another host with the probed address as its sender is a conflict.
+	return p.waitForReply(fd, func(b []byte) bool {
+		if len(b) < arpPacketLen {
+			return false
+		}
+
+		op := binary.BigEndian.Uint16(b[6:8])
+		if op != arpOpReply && op != arpOpRequest {
+			return false
+		}
+
+		return !bytes.Equal(b[8:14], iface.HardwareAddr) && net.IP(b[14:18]).Equal(addr)
+	})
+}
+
+// Sends an NDP neighbor solicitation and waits for a neighbor advertisement for the address.
+func (p *linuxAddressProber) probeNDP(iface *net.Interface, addr net.IP) (bool, error) {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+
+	err = unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface.Name)
+	if err != nil {
+		return false, err
+	}
+
+	// Neighbor discovery messages must be sent with the maximum hop limit.
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, ndpHopLimit)
+	if err != nil {
+		return false, err
+	}
+
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ndpHopLimit)
+	if err != nil {
+		return false, err
+	}
+
+	// Build the solicitation. The kernel computes the ICMPv6 checksum.
+	req := make([]byte, 24, 32)
+	req[0] = icmpv6NeighborSolicitation
+	copy(req[8:24], addr)
+	if len(iface.HardwareAddr) == 6 {
+		req = append(req, ndpOptSourceLinkLayerAddr, 1)
+		req = append(req, iface.HardwareAddr...)
+	}
+
+	// Send to the solicited-node multicast address of the target.
+	sa := &unix.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(sa.Addr[:], net.ParseIP("ff02::1:ff00:0"))
+	copy(sa.Addr[13:], addr[13:])
+
+	err = unix.Sendto(fd, req, 0, sa)
+	if err != nil {
+		return false, err
+	}
+
+	return p.waitForReply(fd, func(b []byte) bool {
+		if len(b) < 24 || b[0] != icmpv6NeighborAdvertisement {
+			return false
+		}
+
+		return net.IP(b[8:24]).Equal(addr)
+	})
+}
+
+// Reads packets from a socket until one matches or the probe times out.
+func (p *linuxAddressProber) waitForReply(fd int, match func([]byte) bool) (bool, error) {
+	deadline := time.Now().Add(p.timeout)
+	buf := make([]byte, 1500)
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, nil
+		}
+
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+		if err != nil {
+			return false, err
+		}
+
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if match(buf[:n]) {
+			return true, nil
+		}
+	}
+}
+
+// Converts a 16-bit value from host to network byte order.
+func htons(v uint16) uint16 {
+	return (v << 8) | (v >> 8)
+}
@@ -0,0 +1,23 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build windows
+
+package ipam
+
+import (
+	"net"
+)
+
+// Windows address prober. Duplicate address detection is left to the host network service.
+type windowsAddressProber struct{}
+
+// Creates the platform address prober.
+func newAddressProber() (addressProber, error) {
+	return &windowsAddressProber{}, nil
+}
+
+// Probe returns whether another host answers for the address on the interface.
+func (p *windowsAddressProber) probe(ifName string, addr net.IP) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"bytes"
+	"math/rand"
+	"time"
+
+	"github.com/Azure/azure-container-networking/common"
+)
+
+// AllocationStrategy selects which of the available addresses in a pool is allocated next.
+type allocationStrategy interface {
+	// SelectAddress returns one of the candidates for a request with the given options.
+	selectAddress(candidates []*addressRecord, options map[string]string) *addressRecord
+}
+
+// Controls how addresses are allocated from pools.
+type allocationPolicy struct {
+	strategy allocationStrategy
+	cooldown time.Duration
+	prober   addressProber
+	probed   map[string]bool
+}
+
+// Returns the allocation strategy of the policy, LRU if none is set.
+func (policy *allocationPolicy) getStrategy() allocationStrategy {
+	if policy.strategy == nil {
+		return &lruStrategy{}
+	}
+
+	return policy.strategy
+}
+
+// Creates the allocation strategy with the given name.
+func newAllocationStrategy(name string) (allocationStrategy, error) {
+	switch name {
+	case common.OptIpamStrategySequential:
+		return &sequentialStrategy{}, nil
+	case common.OptIpamStrategyRandom:
+		return &randomStrategy{}, nil
+	case "", common.OptIpamStrategyLRU:
+		return &lruStrategy{}, nil
+	case common.OptIpamStrategySticky:
+		return &stickyStrategy{}, nil
+	default:
+		return nil, errInvalidConfiguration
+	}
+}
+
+// Returns the allocation policy for an address pool.
+func (am *addressManager) getAllocationPolicy(ap *addressPool) *allocationPolicy {
+	name := ap.RequestedStrategy
+	if name == "" {
+		name = ap.Strategy
+	}
+	if name == "" {
+		name = am.allocationStrategy
+	}
+
+	strategy, err := newAllocationStrategy(name)
+	if err != nil {
+		strategy = &lruStrategy{}
+	}
+
+	return &allocationPolicy{
+		strategy: strategy,
+		cooldown: am.releaseCooldown,
+		prober:   am.prober,
+	}
+}
+
+// Returns whether address a sorts before address b.
+func isLowerAddress(a, b *addressRecord) bool {
+	return bytes.Compare(a.Addr.To16(), b.Addr.To16()) < 0
+}
+
+// Returns the lowest candidate address.
+func selectLowestAddress(candidates []*addressRecord) *addressRecord {
+	var selected *addressRecord
+
+	for _, ar := range candidates {
+		if selected == nil || isLowerAddress(ar, selected) {
+			selected = ar
+		}
+	}
+
+	return selected
+}
+
+// Allocates the lowest available address.
+type sequentialStrategy struct{}
+
+func (s *sequentialStrategy) selectAddress(candidates []*addressRecord, options map[string]string) *addressRecord {
+	return selectLowestAddress(candidates)
+}
+
+// Allocates a random available address.
+type randomStrategy struct{}
+
+func (s *randomStrategy) selectAddress(candidates []*addressRecord, options map[string]string) *addressRecord {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// Allocates the address that was released the longest time ago.
+// Addresses that were never released are preferred, and ties are broken by the lowest address.
+type lruStrategy struct{}
+
+func (s *lruStrategy) selectAddress(candidates []*addressRecord, options map[string]string) *addressRecord {
+	var selected *addressRecord
+
+	for _, ar := range candidates {
+		if selected == nil ||
+			ar.ReleasedAt.Before(selected.ReleasedAt) ||
+			(ar.ReleasedAt.Equal(selected.ReleasedAt) && isLowerAddress(ar, selected)) {
+			selected = ar
+		}
+	}
+
+	return selected
+}
+
+// Allocates the address last used by the same owner if it is free, otherwise the least recently used address.
+type stickyStrategy struct {
+	lruStrategy
+}
+
+func (s *stickyStrategy) selectAddress(candidates []*addressRecord, options map[string]string) *addressRecord {
+	if id := options[OptAddressID]; id != "" {
+		for _, ar := range candidates {
+			if ar.LastID == id {
+				return ar
+			}
+		}
+	}
+
+	return s.lruStrategy.selectAddress(candidates, options)
+}
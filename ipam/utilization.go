@@ -0,0 +1,173 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package ipam
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// PoolUtilization contains utilization information about an address pool.
+type PoolUtilization struct {
+	AsId        string
+	PoolId      string
+	Capacity    int
+	InUse       int
+	Free        int
+	Unhealthy   int
+	Quarantined int
+	Excluded    int
+	Allocations uint64
+	Failures    uint64
+}
+
+// Utilization contains utilization information about all address pools.
+type Utilization struct {
+	Pools       []*PoolUtilization
+	Capacity    int
+	InUse       int
+	Free        int
+	Unhealthy   int
+	Quarantined int
+	Excluded    int
+	Allocations uint64
+	Failures    uint64
+}
+
+// LowWatermarkHandler is called when the share of free addresses in a pool drops below the low watermark.
+// It is called with the address manager locked, so it must not call back into the address manager.
+type LowWatermarkHandler func(pu *PoolUtilization)
+
+// GetUtilization returns utilization information about all address pools.
+func (am *addressManager) GetUtilization() (*Utilization, error) {
+	u := &Utilization{}
+
+	am.Lock()
+	defer am.Unlock()
+
+	for _, as := range am.AddrSpaces {
+		for _, ap := range as.Pools {
+			pu := am.getPoolUtilization(ap)
+
+			u.Pools = append(u.Pools, pu)
+			u.Capacity += pu.Capacity
+			u.InUse += pu.InUse
+			u.Free += pu.Free
+			u.Unhealthy += pu.Unhealthy
+			u.Quarantined += pu.Quarantined
+			u.Excluded += pu.Excluded
+			u.Allocations += pu.Allocations
+			u.Failures += pu.Failures
+		}
+	}
+
+	sort.Slice(u.Pools, func(i, j int) bool {
+		if u.Pools[i].AsId != u.Pools[j].AsId {
+			return u.Pools[i].AsId < u.Pools[j].AsId
+		}
+		return u.Pools[i].PoolId < u.Pools[j].PoolId
+	})
+
+	return u, nil
+}
+
+// SetLowWatermarkHandler sets the handler called when a pool runs low on free addresses.
+func (am *addressManager) SetLowWatermarkHandler(handler LowWatermarkHandler) {
+	am.Lock()
+	defer am.Unlock()
+
+	am.lowWatermarkHandler = handler
+}
+
+// Returns utilization information about an address pool.
+func (am *addressManager) getPoolUtilization(ap *addressPool) *PoolUtilization {
+	pu := &PoolUtilization{
+		PoolId:      ap.Id,
+		Capacity:    len(ap.Addresses),
+		Allocations: ap.Allocations,
+		Failures:    ap.Failures,
+	}
+
+	if ap.as != nil {
+		pu.AsId = ap.as.Id
+	}
+
+	excluded := ap.getExcludedRanges()
+
+	for _, ar := range ap.Addresses {
+		if ar.unhealthy || ar.Conflict {
+			pu.Unhealthy++
+		}
+
+		switch {
+		case ar.InUse || ar.ID != "":
+			pu.InUse++
+		case isExcludedAddress(ar.Addr, excluded):
+			pu.Excluded++
+		case ar.Conflict:
+		case !ar.ReleasedAt.IsZero() && time.Since(ar.ReleasedAt) < am.releaseCooldown:
+			pu.Quarantined++
+		default:
+			pu.Free++
+		}
+	}
+
+	return pu
+}
+
+// Records addresses allocated from a pool, and updates whether the pool is below the low watermark.
+// Returns the pool utilization if the pool just dropped below the low watermark. The event is raised
+// by the caller once the allocation is committed.
+func (am *addressManager) recordAllocation(ap *addressPool, count int) *PoolUtilization {
+	ap.Allocations += uint64(count)
+
+	if am.lowWatermark == 0 {
+		return nil
+	}
+
+	pu := am.getPoolUtilization(ap)
+	low := pu.Capacity > 0 && pu.Free*100 < pu.Capacity*am.lowWatermark
+
+	// Raise the event only once each time the pool drops below the watermark.
+	dropped := low && !ap.BelowLowWatermark
+	ap.BelowLowWatermark = low
+
+	if dropped {
+		return pu
+	}
+
+	return nil
+}
+
+// Records a failed address request in a pool. The failure is committed on its own,
+// because the changes of the failed request are not.
+func (am *addressManager) recordFailure(asId, poolId string, err error) {
+	log.Printf("[ipam] Address request from pool %v failed, err:%v.", poolId, err)
+
+	am.updateAddressSpace(asId, func(as *addressSpace) error {
+		ap, _, err := as.getPoolOrChild(poolId)
+		if err != nil {
+			return err
+		}
+
+		ap.Failures++
+
+		return nil
+	})
+}
+
+// Raises a low watermark event for a pool, if any.
+func (am *addressManager) raiseLowWatermark(pu *PoolUtilization) {
+	if pu == nil {
+		return
+	}
+
+	log.Printf("[ipam] Pool %v is running low on addresses, %v of %v free.", pu.PoolId, pu.Free, pu.Capacity)
+
+	if am.lowWatermarkHandler != nil {
+		am.lowWatermarkHandler(pu)
+	}
+}
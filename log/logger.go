@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"sync"
 
 	"github.com/Azure/azure-container-networking/platform"
 )
@@ -52,6 +53,7 @@ type Logger struct {
 	maxFileCount int
 	callCount    int
 	directory    string
+	mutex        sync.Mutex
 }
 
 // NewLogger creates a new Logger.
@@ -129,7 +131,7 @@ func (logger *Logger) rotate() {
 	fileName := logger.getLogFileName()
 	fileInfo, err := os.Stat(fileName)
 	if err != nil {
-		logger.Printf("[log] Failed to query log file info %+v.", err)
+		logger.l.Printf("[log] Failed to query log file info %+v.", err)
 		return
 	}
 
@@ -175,7 +177,11 @@ func (logger *Logger) Response(tag string, response interface{}, err error) {
 }
 
 // Logf logs a formatted string.
+// Plugins log from several goroutines, so calls are serialized.
 func (logger *Logger) logf(format string, args ...interface{}) {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
 	if logger.callCount%rotationCheckFrq == 0 {
 		logger.rotate()
 	}
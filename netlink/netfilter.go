@@ -0,0 +1,451 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Netfilter protocol families.
+const (
+	NFPROTO_BRIDGE = 7
+)
+
+// nftables protocol constants used by callers.
+const (
+	NF_BR_PRE_ROUTING          = 0
+	NF_BR_POST_ROUTING         = 4
+	NF_BR_PRI_NAT_DST_BRIDGED  = -300
+	NF_BR_PRI_NAT_SRC          = 300
+	NFT_CHAIN_TYPE_FILTER      = "filter"
+	NFT_PAYLOAD_LL_HEADER      = 0
+	NFT_PAYLOAD_NETWORK_HEADER = 1
+	NFT_META_IIFNAME           = 6
+	NFT_META_OIFNAME           = 7
+	NFT_META_PKTTYPE           = 8
+	NFT_REG_VERDICT            = 0
+	NFT_REG_1                  = 1
+	NF_DROP                    = 0
+	NF_ACCEPT                  = 1
+)
+
+// nftables message types and attributes.
+const (
+	sizeofNfGenMsg      = 4
+	nfnlSubsysNftables  = 10
+	nfnlMsgBatchBegin   = 0x10
+	nfnlMsgBatchEnd     = 0x11
+	nftMsgNewTable      = 0
+	nftMsgNewChain      = 3
+	nftMsgNewRule       = 6
+	nftMsgGetRule       = 7
+	nftMsgDelRule       = 8
+	nftaTableName       = 1
+	nftaChainTable      = 1
+	nftaChainName       = 3
+	nftaChainHook       = 4
+	nftaChainType       = 7
+	nftaHookHooknum     = 1
+	nftaHookPriority    = 2
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleHandle      = 3
+	nftaRuleExpressions = 4
+	nftaRuleCompat      = 5
+	nftaRuleUserdata    = 7
+	nftaRuleCompatProto = 1
+	nftaRuleCompatFlags = 2
+	nftaListElem        = 1
+	nftaExprName        = 1
+	nftaExprData        = 2
+	nftaDataValue       = 1
+	nftaDataVerdict     = 2
+	nftaVerdictCode     = 1
+	nftaMetaDreg        = 1
+	nftaMetaKey         = 2
+	nftaMetaSreg        = 3
+	nftaCmpSreg         = 1
+	nftaCmpOp           = 2
+	nftaCmpData         = 3
+	nftCmpEq            = 0
+	nftaPayloadDreg     = 1
+	nftaPayloadBase     = 2
+	nftaPayloadOffset   = 3
+	nftaPayloadLen      = 4
+	nftaPayloadSreg     = 5
+	nftaBitwiseSreg     = 1
+	nftaBitwiseDreg     = 2
+	nftaBitwiseLen      = 3
+	nftaBitwiseMask     = 4
+	nftaBitwiseXor      = 5
+	nftaImmediateDreg   = 1
+	nftaImmediateData   = 2
+	nftaTargetName      = 1
+	nftaTargetRev       = 2
+	nftaTargetInfo      = 3
+)
+
+// NftChain represents an nftables base chain.
+type NftChain struct {
+	Family   int
+	Table    string
+	Name     string
+	Type     string
+	Hook     int
+	Priority int
+}
+
+// NftRule represents an nftables rule.
+type NftRule struct {
+	Family      int
+	Table       string
+	Chain       string
+	Handle      uint64
+	Expressions []*NftExpression
+	// Ethernet protocol the rule is restricted to, required by some xtables targets.
+	CompatProtocol uint16
+	UserData       []byte
+}
+
+// NftExpression represents an nftables rule expression.
+type NftExpression struct {
+	name  string
+	attrs []*attribute
+}
+
+// NftBatch is a set of nftables changes applied atomically by the kernel.
+type NftBatch struct {
+	msgs []*message
+}
+
+//
+// Netfilter generic message
+//
+
+// Netfilter generic message header
+type nfGenMsg struct {
+	family  uint8
+	version uint8
+	resId   uint16
+}
+
+// Creates a new netfilter generic message header.
+func newNfGenMsg(family int, resId uint16) *nfGenMsg {
+	return &nfGenMsg{
+		family:  uint8(family),
+		version: unix.NFNETLINK_V0,
+		resId:   resId,
+	}
+}
+
+// Serializes a netfilter generic message header.
+func (nfgen *nfGenMsg) serialize() []byte {
+	b := make([]byte, nfgen.length())
+	b[0] = nfgen.family
+	b[1] = nfgen.version
+	binary.BigEndian.PutUint16(b[2:4], nfgen.resId)
+	return b
+}
+
+// Returns the length of a netfilter generic message header.
+func (nfgen *nfGenMsg) length() int {
+	return sizeofNfGenMsg
+}
+
+// Creates a new nftables request message.
+func newNftRequest(msgType int, family int, flags int) *message {
+	req := newRequest((nfnlSubsysNftables<<8)|msgType, flags)
+	req.addPayload(newNfGenMsg(family, 0))
+	return req
+}
+
+// Creates a new attribute with a big-endian uint32 value, as used by nftables.
+func newAttributeUint32BE(attrType int, value uint32) *attribute {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return newAttribute(attrType, buf)
+}
+
+// Creates a new attribute with a big-endian uint64 value, as used by nftables.
+func newAttributeUint64BE(attrType int, value uint64) *attribute {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return newAttribute(attrType, buf)
+}
+
+// Creates a new attribute that holds nested attributes.
+func newAttributeNested(attrType int, children ...*attribute) *attribute {
+	attr := newAttribute(attrType|unix.NLA_F_NESTED, nil)
+	for _, child := range children {
+		attr.addNested(child)
+	}
+	return attr
+}
+
+// Creates a new nftables data attribute with a value.
+func newAttributeNftData(attrType int, data []byte) *attribute {
+	return newAttributeNested(attrType, newAttribute(nftaDataValue, data))
+}
+
+// Parses a sequence of netlink attributes.
+func parseAttributes(b []byte) ([]*attribute, error) {
+	var attrs []*attribute
+
+	for len(b) >= unix.SizeofNlAttr {
+		length := int(encoder.Uint16(b[0:2]))
+		if length < unix.SizeofNlAttr || length > len(b) {
+			return nil, fmt.Errorf("Invalid netlink attribute")
+		}
+
+		attrType := encoder.Uint16(b[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		attr := newAttribute(int(attrType), b[unix.SizeofNlAttr:length])
+		attr.Len = uint16(length)
+		attrs = append(attrs, attr)
+
+		aligned := (length + unix.NLA_ALIGNTO - 1) & ^(unix.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+
+	return attrs, nil
+}
+
+//
+// nftables expressions
+//
+
+// Creates a new expression.
+func newNftExpression(name string, attrs ...*attribute) *NftExpression {
+	return &NftExpression{name: name, attrs: attrs}
+}
+
+// Serializes an expression into a list element attribute.
+func (expr *NftExpression) attribute() *attribute {
+	return newAttributeNested(
+		nftaListElem,
+		newAttributeStringZ(nftaExprName, expr.name),
+		newAttributeNested(nftaExprData, expr.attrs...))
+}
+
+// NftMetaLoad loads packet metadata into a register.
+func NftMetaLoad(key int, dreg int) *NftExpression {
+	return newNftExpression("meta",
+		newAttributeUint32BE(nftaMetaKey, uint32(key)),
+		newAttributeUint32BE(nftaMetaDreg, uint32(dreg)))
+}
+
+// NftMetaStore sets packet metadata from a register.
+func NftMetaStore(key int, sreg int) *NftExpression {
+	return newNftExpression("meta",
+		newAttributeUint32BE(nftaMetaKey, uint32(key)),
+		newAttributeUint32BE(nftaMetaSreg, uint32(sreg)))
+}
+
+// NftCmpEq continues evaluation only if a register equals the given data.
+func NftCmpEq(sreg int, data []byte) *NftExpression {
+	return newNftExpression("cmp",
+		newAttributeUint32BE(nftaCmpSreg, uint32(sreg)),
+		newAttributeUint32BE(nftaCmpOp, nftCmpEq),
+		newAttributeNftData(nftaCmpData, data))
+}
+
+// NftPayloadLoad loads packet data into a register.
+func NftPayloadLoad(base int, offset int, length int, dreg int) *NftExpression {
+	return newNftExpression("payload",
+		newAttributeUint32BE(nftaPayloadDreg, uint32(dreg)),
+		newAttributeUint32BE(nftaPayloadBase, uint32(base)),
+		newAttributeUint32BE(nftaPayloadOffset, uint32(offset)),
+		newAttributeUint32BE(nftaPayloadLen, uint32(length)))
+}
+
+// NftPayloadWrite writes a register into packet data.
+func NftPayloadWrite(sreg int, base int, offset int, length int) *NftExpression {
+	return newNftExpression("payload",
+		newAttributeUint32BE(nftaPayloadSreg, uint32(sreg)),
+		newAttributeUint32BE(nftaPayloadBase, uint32(base)),
+		newAttributeUint32BE(nftaPayloadOffset, uint32(offset)),
+		newAttributeUint32BE(nftaPayloadLen, uint32(length)))
+}
+
+// NftBitwise computes (sreg & mask) ^ xor into a register.
+func NftBitwise(sreg int, dreg int, mask []byte, xor []byte) *NftExpression {
+	return newNftExpression("bitwise",
+		newAttributeUint32BE(nftaBitwiseSreg, uint32(sreg)),
+		newAttributeUint32BE(nftaBitwiseDreg, uint32(dreg)),
+		newAttributeUint32BE(nftaBitwiseLen, uint32(len(mask))),
+		newAttributeNftData(nftaBitwiseMask, mask),
+		newAttributeNftData(nftaBitwiseXor, xor))
+}
+
+// NftImmediateData loads constant data into a register.
+func NftImmediateData(dreg int, data []byte) *NftExpression {
+	return newNftExpression("immediate",
+		newAttributeUint32BE(nftaImmediateDreg, uint32(dreg)),
+		newAttributeNftData(nftaImmediateData, data))
+}
+
+// NftImmediateVerdict ends evaluation with the given verdict.
+func NftImmediateVerdict(code int) *NftExpression {
+	return newNftExpression("immediate",
+		newAttributeUint32BE(nftaImmediateDreg, NFT_REG_VERDICT),
+		newAttributeNested(nftaImmediateData,
+			newAttributeNested(nftaDataVerdict,
+				newAttributeUint32BE(nftaVerdictCode, uint32(int32(code))))))
+}
+
+// NftTarget invokes an xtables target through the nftables compatibility layer.
+func NftTarget(name string, revision int, info []byte) *NftExpression {
+	return newNftExpression("target",
+		newAttributeStringZ(nftaTargetName, name),
+		newAttributeUint32BE(nftaTargetRev, uint32(revision)),
+		newAttribute(nftaTargetInfo, info))
+}
+
+//
+// nftables batches
+//
+
+// NewNftBatch creates a new empty batch.
+func NewNftBatch() *NftBatch {
+	return &NftBatch{}
+}
+
+// AddTable adds the creation of a table, if it does not already exist, to the batch.
+func (b *NftBatch) AddTable(family int, name string) {
+	req := newNftRequest(nftMsgNewTable, family, unix.NLM_F_CREATE|unix.NLM_F_ACK)
+	req.addPayload(newAttributeStringZ(nftaTableName, name))
+	b.msgs = append(b.msgs, req)
+}
+
+// AddChain adds the creation of a base chain, if it does not already exist, to the batch.
+func (b *NftBatch) AddChain(chain *NftChain) {
+	req := newNftRequest(nftMsgNewChain, chain.Family, unix.NLM_F_CREATE|unix.NLM_F_ACK)
+	req.addPayload(newAttributeStringZ(nftaChainTable, chain.Table))
+	req.addPayload(newAttributeStringZ(nftaChainName, chain.Name))
+	req.addPayload(newAttributeNested(nftaChainHook,
+		newAttributeUint32BE(nftaHookHooknum, uint32(chain.Hook)),
+		newAttributeUint32BE(nftaHookPriority, uint32(int32(chain.Priority)))))
+	req.addPayload(newAttributeStringZ(nftaChainType, chain.Type))
+	b.msgs = append(b.msgs, req)
+}
+
+// AddRule adds the appending of a rule to its chain to the batch.
+func (b *NftBatch) AddRule(rule *NftRule) {
+	req := newNftRequest(nftMsgNewRule, rule.Family, unix.NLM_F_CREATE|unix.NLM_F_APPEND|unix.NLM_F_ACK)
+	req.addPayload(newAttributeStringZ(nftaRuleTable, rule.Table))
+	req.addPayload(newAttributeStringZ(nftaRuleChain, rule.Chain))
+
+	exprs := newAttributeNested(nftaRuleExpressions)
+	for _, expr := range rule.Expressions {
+		exprs.addNested(expr.attribute())
+	}
+	req.addPayload(exprs)
+
+	if rule.CompatProtocol != 0 {
+		// The kernel stores the protocol as-is in the ebtables entry, which expects network byte order.
+		proto := []byte{byte(rule.CompatProtocol >> 8), byte(rule.CompatProtocol)}
+		req.addPayload(newAttributeNested(nftaRuleCompat,
+			newAttributeUint32BE(nftaRuleCompatProto, uint32(encoder.Uint16(proto))),
+			newAttributeUint32BE(nftaRuleCompatFlags, 0)))
+	}
+
+	if rule.UserData != nil {
+		req.addPayload(newAttribute(nftaRuleUserdata, rule.UserData))
+	}
+
+	b.msgs = append(b.msgs, req)
+}
+
+// DeleteRule adds the deletion of a rule, identified by its handle, to the batch.
+func (b *NftBatch) DeleteRule(rule *NftRule) {
+	req := newNftRequest(nftMsgDelRule, rule.Family, unix.NLM_F_ACK)
+	req.addPayload(newAttributeStringZ(nftaRuleTable, rule.Table))
+	req.addPayload(newAttributeStringZ(nftaRuleChain, rule.Chain))
+	req.addPayload(newAttributeUint64BE(nftaRuleHandle, rule.Handle))
+	b.msgs = append(b.msgs, req)
+}
+
+// Commit sends the batch to the kernel. Either all changes are applied or none.
+func (b *NftBatch) Commit() error {
+	if len(b.msgs) == 0 {
+		return nil
+	}
+
+	s, err := getNetfilterSocket()
+	if err != nil {
+		return err
+	}
+
+	err = s.sendBatchAndWaitForAcks(b.messages())
+	if err == nil {
+		b.msgs = nil
+	}
+
+	return err
+}
+
+// Returns the messages of the batch enclosed in batch begin and end messages.
+func (b *NftBatch) messages() []*message {
+	begin := newRequest(nfnlMsgBatchBegin, 0)
+	begin.addPayload(newNfGenMsg(unix.AF_UNSPEC, nfnlSubsysNftables))
+
+	end := newRequest(nfnlMsgBatchEnd, 0)
+	end.addPayload(newNfGenMsg(unix.AF_UNSPEC, nfnlSubsysNftables))
+
+	msgs := append([]*message{begin}, b.msgs...)
+	return append(msgs, end)
+}
+
+// GetNftRules returns the handles and user data of the rules in a chain.
+func GetNftRules(family int, table string, chain string) ([]*NftRule, error) {
+	s, err := getNetfilterSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	req := newNftRequest(nftMsgGetRule, family, unix.NLM_F_DUMP|unix.NLM_F_ACK)
+	req.addPayload(newAttributeStringZ(nftaRuleTable, table))
+	req.addPayload(newAttributeStringZ(nftaRuleChain, chain))
+
+	msgs, err := s.sendAndWaitForResponse(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*NftRule
+	for _, msg := range msgs {
+		if len(msg.data) < sizeofNfGenMsg {
+			continue
+		}
+
+		attrs, err := parseAttributes(msg.data[sizeofNfGenMsg:])
+		if err != nil {
+			return nil, err
+		}
+
+		rule := &NftRule{
+			Family: family,
+			Table:  table,
+			Chain:  chain,
+		}
+
+		for _, attr := range attrs {
+			switch attr.Type {
+			case nftaRuleHandle:
+				rule.Handle = binary.BigEndian.Uint64(attr.value)
+			case nftaRuleUserdata:
+				rule.UserData = attr.value
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
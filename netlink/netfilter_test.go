@@ -0,0 +1,315 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package netlink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the nested attributes of a parsed attribute.
+func parseNested(t *testing.T, attr *attribute) []*attribute {
+	attrs, err := parseAttributes(attr.value)
+	if err != nil {
+		t.Fatalf("Failed to parse nested attributes of %v, err:%v", attr.Type, err)
+	}
+	return attrs
+}
+
+// Parses a single serialized attribute.
+func parseOne(t *testing.T, b []byte) *attribute {
+	attrs, err := parseAttributes(b)
+	if err != nil || len(attrs) != 1 {
+		t.Fatalf("Failed to parse attribute %v, attrs:%v err:%v", b, attrs, err)
+	}
+	return attrs[0]
+}
+
+// Tests that nftables attributes are serialized in network byte order and parsed back.
+func TestNftAttributesAreSerialized(t *testing.T) {
+	tests := []struct {
+		name  string
+		attr  *attribute
+		typ   uint16
+		value []byte
+	}{
+		{"uint32", newAttributeUint32BE(1, 0x01020304), 1, []byte{1, 2, 3, 4}},
+		{"uint64", newAttributeUint64BE(3, 0x0102030405060708), 3, []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"string", newAttributeStringZ(2, "nat"), 2, []byte("nat\x00")},
+		{"padded", newAttribute(7, []byte{1, 2, 3, 4, 5}), 7, []byte{1, 2, 3, 4, 5, 0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		b := test.attr.serialize()
+		if len(b)%unix.NLA_ALIGNTO != 0 || len(b) != test.attr.length() {
+			t.Errorf("%s: serialized length %d is not aligned or does not match %d", test.name, len(b), test.attr.length())
+		}
+
+		attr := parseOne(t, b)
+		if attr.Type != test.typ || !bytes.Equal(attr.value, test.value) {
+			t.Errorf("%s: parsed type %d value %v, expected type %d value %v",
+				test.name, attr.Type, attr.value, test.typ, test.value)
+		}
+	}
+}
+
+// Tests that nested attributes are flagged as nested and parsed back.
+func TestNftNestedAttributesAreSerialized(t *testing.T) {
+	attr := newAttributeNftData(nftaCmpData, []byte{0xaa, 0xbb})
+
+	b := attr.serialize()
+	if encoder.Uint16(b[2:4])&unix.NLA_F_NESTED == 0 {
+		t.Errorf("Nested attribute is not flagged, type:%x", encoder.Uint16(b[2:4]))
+	}
+
+	parsed := parseOne(t, b)
+	if parsed.Type != nftaCmpData {
+		t.Errorf("Parsed type %d, expected %d", parsed.Type, nftaCmpData)
+	}
+
+	children := parseNested(t, parsed)
+	if len(children) != 1 || children[0].Type != nftaDataValue ||
+		!bytes.Equal(children[0].value, []byte{0xaa, 0xbb, 0, 0}) {
+		t.Errorf("Unexpected children %+v", children)
+	}
+}
+
+// Tests that malformed attributes are rejected.
+func TestInvalidAttributesAreRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"length below header", []byte{2, 0, 1, 0}},
+		{"length beyond buffer", []byte{16, 0, 1, 0, 0, 0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		b := make([]byte, len(test.b))
+		copy(b, test.b)
+		encoder.PutUint16(b[0:2], uint16(test.b[0]))
+
+		_, err := parseAttributes(b)
+		if err == nil {
+			t.Errorf("%s: parseAttributes succeeded", test.name)
+		}
+	}
+
+	// Trailing bytes shorter than an attribute header are ignored.
+	attrs, err := parseAttributes([]byte{0, 0})
+	if err != nil || len(attrs) != 0 {
+		t.Errorf("Unexpected attrs %v for short buffer, err:%v", attrs, err)
+	}
+}
+
+// Tests that expressions are serialized as named list elements.
+func TestNftExpressionsAreSerialized(t *testing.T) {
+	tests := []struct {
+		name  string
+		expr  *NftExpression
+		attrs map[uint16][]byte
+	}{
+		{
+			name:  "meta load",
+			expr:  NftMetaLoad(NFT_META_IIFNAME, NFT_REG_1),
+			attrs: map[uint16][]byte{nftaMetaKey: {0, 0, 0, 6}, nftaMetaDreg: {0, 0, 0, 1}},
+		},
+		{
+			name:  "meta store",
+			expr:  NftMetaStore(NFT_META_PKTTYPE, NFT_REG_1),
+			attrs: map[uint16][]byte{nftaMetaKey: {0, 0, 0, 8}, nftaMetaSreg: {0, 0, 0, 1}},
+		},
+		{
+			name:  "cmp",
+			expr:  NftCmpEq(NFT_REG_1, []byte{8, 0}),
+			attrs: map[uint16][]byte{nftaCmpSreg: {0, 0, 0, 1}, nftaCmpOp: {0, 0, 0, 0}, nftaCmpData: nil},
+		},
+		{
+			name: "payload load",
+			expr: NftPayloadLoad(NFT_PAYLOAD_NETWORK_HEADER, 16, 4, NFT_REG_1),
+			attrs: map[uint16][]byte{
+				nftaPayloadDreg: {0, 0, 0, 1}, nftaPayloadBase: {0, 0, 0, 1},
+				nftaPayloadOffset: {0, 0, 0, 16}, nftaPayloadLen: {0, 0, 0, 4},
+			},
+		},
+		{
+			name: "payload write",
+			expr: NftPayloadWrite(NFT_REG_1, NFT_PAYLOAD_LL_HEADER, 0, 6),
+			attrs: map[uint16][]byte{
+				nftaPayloadSreg: {0, 0, 0, 1}, nftaPayloadBase: {0, 0, 0, 0},
+				nftaPayloadOffset: {0, 0, 0, 0}, nftaPayloadLen: {0, 0, 0, 6},
+			},
+		},
+		{
+			name:  "verdict",
+			expr:  NftImmediateVerdict(NF_ACCEPT),
+			attrs: map[uint16][]byte{nftaImmediateDreg: {0, 0, 0, 0}, nftaImmediateData: nil},
+		},
+		{
+			name:  "target",
+			expr:  NftTarget("arpreply", 0, []byte{1, 2, 3, 4}),
+			attrs: map[uint16][]byte{nftaTargetName: []byte("arpreply\x00"), nftaTargetRev: {0, 0, 0, 0}, nftaTargetInfo: {1, 2, 3, 4}},
+		},
+	}
+
+	for _, test := range tests {
+		elem := parseOne(t, test.expr.attribute().serialize())
+		if elem.Type != nftaListElem {
+			t.Errorf("%s: element type %d, expected %d", test.name, elem.Type, nftaListElem)
+			continue
+		}
+
+		fields := parseNested(t, elem)
+		if len(fields) != 2 || fields[0].Type != nftaExprName || fields[1].Type != nftaExprData {
+			t.Errorf("%s: unexpected element fields %+v", test.name, fields)
+			continue
+		}
+
+		if name := string(bytes.TrimRight(fields[0].value, "\x00")); name != test.expr.name {
+			t.Errorf("%s: expression name %q, expected %q", test.name, name, test.expr.name)
+		}
+
+		data := parseNested(t, fields[1])
+		if len(data) != len(test.attrs) {
+			t.Errorf("%s: %d attributes, expected %d", test.name, len(data), len(test.attrs))
+		}
+
+		for _, attr := range data {
+			expected, ok := test.attrs[attr.Type]
+			if !ok {
+				t.Errorf("%s: unexpected attribute %d", test.name, attr.Type)
+				continue
+			}
+
+			// Nested values are checked by the nested attribute test.
+			if expected != nil && !bytes.HasPrefix(attr.value, expected) {
+				t.Errorf("%s: attribute %d value %v, expected %v", test.name, attr.Type, attr.value, expected)
+			}
+		}
+	}
+}
+
+// Tests that batches are enclosed in begin and end messages and acked per change.
+func TestNftBatchIsEncoded(t *testing.T) {
+	batch := NewNftBatch()
+	batch.AddTable(NFPROTO_BRIDGE, "nat")
+	batch.AddChain(&NftChain{
+		Family:   NFPROTO_BRIDGE,
+		Table:    "nat",
+		Name:     "test",
+		Type:     NFT_CHAIN_TYPE_FILTER,
+		Hook:     NF_BR_PRE_ROUTING,
+		Priority: NF_BR_PRI_NAT_DST_BRIDGED,
+	})
+	batch.AddRule(&NftRule{
+		Family:         NFPROTO_BRIDGE,
+		Table:          "nat",
+		Chain:          "test",
+		Expressions:    []*NftExpression{NftImmediateVerdict(NF_ACCEPT)},
+		CompatProtocol: 0x0806,
+		UserData:       []byte{0, 2, 'a', 0},
+	})
+	batch.DeleteRule(&NftRule{Family: NFPROTO_BRIDGE, Table: "nat", Chain: "test", Handle: 42})
+
+	msgs := batch.messages()
+
+	tests := []struct {
+		msgType int
+		attrs   []uint16
+	}{
+		{nfnlMsgBatchBegin, nil},
+		{nfnlSubsysNftables<<8 | nftMsgNewTable, []uint16{nftaTableName}},
+		{nfnlSubsysNftables<<8 | nftMsgNewChain, []uint16{nftaChainTable, nftaChainName, nftaChainHook, nftaChainType}},
+		{nfnlSubsysNftables<<8 | nftMsgNewRule, []uint16{nftaRuleTable, nftaRuleChain, nftaRuleExpressions, nftaRuleCompat, nftaRuleUserdata}},
+		{nfnlSubsysNftables<<8 | nftMsgDelRule, []uint16{nftaRuleTable, nftaRuleChain, nftaRuleHandle}},
+		{nfnlMsgBatchEnd, nil},
+	}
+
+	if len(msgs) != len(tests) {
+		t.Fatalf("Batch has %d messages, expected %d", len(msgs), len(tests))
+	}
+
+	s := &socket{}
+	buffer, sent, pending := s.serializeBatch(msgs)
+
+	// Batch delimiters do not request acks, changes do.
+	if len(sent) != len(tests) || len(pending) != len(tests)-2 {
+		t.Errorf("Batch sent %d messages with %d pending acks", len(sent), len(pending))
+	}
+
+	for i, test := range tests {
+		msg := msgs[i]
+		if int(msg.Type) != test.msgType || msg.Flags&unix.NLM_F_REQUEST == 0 {
+			t.Errorf("Message %d has type %x flags %x, expected type %x", i, msg.Type, msg.Flags, test.msgType)
+		}
+
+		if int(encoder.Uint32(buffer[0:4])) != int(msg.Len) || encoder.Uint32(buffer[8:12]) != msg.Seq {
+			t.Errorf("Message %d is not serialized in order", i)
+		}
+
+		b := buffer[unix.NLMSG_HDRLEN:msg.Len]
+		buffer = buffer[msg.Len:]
+
+		// Batch delimiters address the nftables subsystem in their resource ID.
+		if test.attrs == nil {
+			if resId := b[2:4]; resId[0] != 0 || resId[1] != nfnlSubsysNftables {
+				t.Errorf("Message %d has resource ID %v", i, resId)
+			}
+			continue
+		}
+
+		if b[0] != NFPROTO_BRIDGE {
+			t.Errorf("Message %d has family %d", i, b[0])
+		}
+
+		attrs, err := parseAttributes(b[sizeofNfGenMsg:])
+		if err != nil || len(attrs) != len(test.attrs) {
+			t.Errorf("Message %d has attributes %+v, err:%v", i, attrs, err)
+			continue
+		}
+
+		for j, attr := range attrs {
+			if attr.Type != test.attrs[j] {
+				t.Errorf("Message %d attribute %d has type %d, expected %d", i, j, attr.Type, test.attrs[j])
+			}
+		}
+	}
+
+	if len(buffer) != 0 {
+		t.Errorf("Batch has %d trailing bytes", len(buffer))
+	}
+}
+
+// Tests that the compat protocol of a rule is encoded in network byte order.
+func TestNftRuleCompatProtocolIsEncoded(t *testing.T) {
+	batch := NewNftBatch()
+	batch.AddRule(&NftRule{Family: NFPROTO_BRIDGE, Table: "nat", Chain: "test", CompatProtocol: 0x0806})
+
+	b := batch.msgs[0].serialize()
+	attrs, _ := parseAttributes(b[unix.NLMSG_HDRLEN+sizeofNfGenMsg:])
+
+	for _, attr := range attrs {
+		if attr.Type != nftaRuleCompat {
+			continue
+		}
+
+		compat := parseNested(t, attr)
+		if len(compat) != 2 || compat[0].Type != nftaRuleCompatProto {
+			t.Fatalf("Unexpected compat attributes %+v", compat)
+		}
+
+		// The kernel decodes the value as a big-endian u32 and stores it as is in a __be16 field.
+		field := make([]byte, 2)
+		encoder.PutUint16(field, uint16(binary.BigEndian.Uint32(compat[0].value)))
+		if proto := binary.BigEndian.Uint16(field); proto != 0x0806 {
+			t.Errorf("Compat protocol %x, expected 0806 in network byte order, raw:%v", proto, compat[0].value)
+		}
+		return
+	}
+
+	t.Errorf("Rule has no compat attribute")
+}
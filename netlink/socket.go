@@ -22,8 +22,9 @@ type socket struct {
 	sync.Mutex
 }
 
-// Default netlink socket.
+// Default netlink sockets.
 var s *socket
+var nfs *socket
 var m sync.Mutex
 
 // Returns a reference to the default netlink socket.
@@ -34,23 +35,38 @@ func getSocket() (*socket, error) {
 	defer m.Unlock()
 
 	if s == nil {
-		s, err = newSocket()
+		s, err = newSocket(unix.NETLINK_ROUTE)
 	}
 
 	return s, err
 }
 
-// ResetSocket deletes the default netlink socket.
+// Returns a reference to the default netfilter netlink socket.
+func getNetfilterSocket() (*socket, error) {
+	var err error
+
+	m.Lock()
+	defer m.Unlock()
+
+	if nfs == nil {
+		nfs, err = newSocket(unix.NETLINK_NETFILTER)
+	}
+
+	return nfs, err
+}
+
+// ResetSocket deletes the default netlink sockets.
 func ResetSocket() {
 	m.Lock()
 	defer m.Unlock()
 
 	s = nil
+	nfs = nil
 }
 
 // Creates a new netlink socket object.
-func newSocket() (*socket, error) {
-	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
+func newSocket(protocol int) (*socket, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, protocol)
 	if err != nil {
 		log.Debugf("[netlink] Failed to create socket, err=%v\n", err)
 		return nil, err
@@ -108,6 +124,76 @@ func (s *socket) sendAndWaitForAck(msg *message) error {
 	return err
 }
 
+// Sends a batch of netlink messages and blocks until all of them are acknowledged.
+// Returns the first error reported for any message in the batch.
+func (s *socket) sendBatchAndWaitForAcks(msgs []*message) error {
+	var firstErr error
+
+	s.Lock()
+	defer s.Unlock()
+
+	buffer, sent, pending := s.serializeBatch(msgs)
+
+	err := unix.Sendto(s.fd, buffer, 0, &s.sa)
+	log.Debugf("[netlink] Sent batch of %d messages, err=%v\n", len(msgs), err)
+	if err != nil {
+		return err
+	}
+
+	// Wait for an ack or an error for each message that requested one.
+	for len(pending) > 0 {
+		nlMsgs, err := s.receive()
+		if err != nil {
+			log.Printf("[netlink] Receive err=%v\n", err)
+			return err
+		}
+
+		for _, nlMsg := range nlMsgs {
+			if nlMsg.Header.Type != unix.NLMSG_ERROR || !sent[nlMsg.Header.Seq] {
+				log.Printf("[netlink] Ignoring unexpected message %+v\n", nlMsg.Header)
+				continue
+			}
+
+			errCode := int32(encoder.Uint32(nlMsg.Data[0:4]))
+			if errCode != 0 {
+				err = syscall.Errno(-errCode)
+				log.Printf("[netlink] Received %+v, err=%v\n", nlMsg.Header, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+
+				// Errors on messages that did not request an ack abort the whole batch.
+				if !pending[nlMsg.Header.Seq] {
+					return firstErr
+				}
+			}
+
+			delete(pending, nlMsg.Header.Seq)
+		}
+	}
+
+	return firstErr
+}
+
+// Serializes a batch of netlink messages into a single buffer. Returns the buffer, the sequence
+// numbers of all messages and the sequence numbers of the messages that requested an ack.
+func (s *socket) serializeBatch(msgs []*message) ([]byte, map[uint32]bool, map[uint32]bool) {
+	var buffer []byte
+
+	sent := make(map[uint32]bool)
+	pending := make(map[uint32]bool)
+	for _, msg := range msgs {
+		msg.Seq = atomic.AddUint32(&s.seq, 1)
+		sent[msg.Seq] = true
+		if (msg.Flags & unix.NLM_F_ACK) != 0 {
+			pending[msg.Seq] = true
+		}
+		buffer = append(buffer, msg.serialize()...)
+	}
+
+	return buffer, sent, pending
+}
+
 // Receives a netlink message.
 func (s *socket) receive() ([]syscall.NetlinkMessage, error) {
 	buffer := make([]byte, unix.Getpagesize())
@@ -4,6 +4,7 @@
 package network
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/Azure/azure-container-networking/log"
@@ -39,6 +40,19 @@ type RouteInfo struct {
 	Gw  net.IP
 }
 
+// PlanEndpoint returns the changes newEndpoint would make, without making them.
+func (nw *network) planEndpoint(epInfo *EndpointInfo) ([]string, error) {
+	// Call the platform implementation.
+	plan, err := nw.planEndpointImpl(epInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	plan = append(plan, fmt.Sprintf("Save endpoint %v in network %v.", epInfo.Id, nw.Id))
+
+	return plan, nil
+}
+
 // NewEndpoint creates a new endpoint in the network.
 func (nw *network) newEndpoint(epInfo *EndpointInfo) (*endpoint, error) {
 	var ep *endpoint
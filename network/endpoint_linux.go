@@ -94,21 +94,34 @@ func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 	}
 
 	// Setup rules for IP addresses on the container interface.
+	tx := ebtables.NewTransaction()
 	for _, ipAddr := range epInfo.IPAddresses {
 		// Add ARP reply rule.
 		log.Printf("[net] Adding ARP reply rule for IP address %v on %v.", ipAddr.String(), contIfName)
-		err = ebtables.SetArpReply(ipAddr.IP, nw.getArpReplyAddress(containerIf.HardwareAddr), ebtables.Append)
-		if err != nil {
-			return nil, err
-		}
+		tx.SetArpReply(ipAddr.IP, nw.getArpReplyAddress(containerIf.HardwareAddr), ebtables.Append)
 
 		// Add MAC address translation rule.
 		log.Printf("[net] Adding MAC DNAT rule for IP address %v on %v.", ipAddr.String(), contIfName)
-		err = ebtables.SetDnatForIPAddress(nw.extIf.Name, ipAddr.IP, containerIf.HardwareAddr, ebtables.Append)
+		tx.SetDnatForIPAddress(nw.extIf.Name, ipAddr.IP, containerIf.HardwareAddr, ebtables.Append)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("[net] Failed to add rules for IP addresses on %v, err:%v.", contIfName, err)
+		return nil, err
+	}
+
+	// On failure, delete the rules for IP addresses.
+	defer func() {
 		if err != nil {
-			return nil, err
+			tx := ebtables.NewTransaction()
+			for _, ipAddr := range epInfo.IPAddresses {
+				tx.SetArpReply(ipAddr.IP, nw.getArpReplyAddress(containerIf.HardwareAddr), ebtables.Delete)
+				tx.SetDnatForIPAddress(nw.extIf.Name, ipAddr.IP, containerIf.HardwareAddr, ebtables.Delete)
+			}
+			tx.Commit()
 		}
-	}
+	}()
 
 	// If a network namespace for the container interface is specified...
 	if epInfo.NetNsPath != "" {
@@ -208,6 +221,48 @@ func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 	return ep, nil
 }
 
+// planEndpointImpl returns the changes newEndpointImpl would make, without making them.
+func (nw *network) planEndpointImpl(epInfo *EndpointInfo) ([]string, error) {
+	if nw.Endpoints[epInfo.Id] != nil {
+		return nil, errEndpointExists
+	}
+
+	hostIfName := fmt.Sprintf("%s%s", hostVEthInterfacePrefix, epInfo.Id[:7])
+	contIfName := fmt.Sprintf("%s%s-2", hostVEthInterfacePrefix, epInfo.Id[:7])
+
+	plan := []string{
+		fmt.Sprintf("Create veth pair %v %v.", hostIfName, contIfName),
+		fmt.Sprintf("Set link %v state up.", hostIfName),
+		fmt.Sprintf("Set link %v master %v.", hostIfName, nw.extIf.BridgeName),
+	}
+
+	// The MAC address of the container interface is known only once it is created.
+	for _, ipAddr := range epInfo.IPAddresses {
+		plan = append(plan,
+			fmt.Sprintf("Add ARP reply rule for IP address %v on %v.", ipAddr.IP, contIfName),
+			fmt.Sprintf("Add MAC DNAT rule on %v for IP address %v to %v.", nw.extIf.Name, ipAddr.IP, contIfName))
+	}
+
+	if epInfo.NetNsPath != "" {
+		plan = append(plan, fmt.Sprintf("Set link %v netns %v.", contIfName, epInfo.NetNsPath))
+	}
+
+	if epInfo.IfName != "" {
+		plan = append(plan, fmt.Sprintf("Set link %v name %v.", contIfName, epInfo.IfName))
+		contIfName = epInfo.IfName
+	}
+
+	for _, ipAddr := range epInfo.IPAddresses {
+		plan = append(plan, fmt.Sprintf("Add IP address %v to link %v.", ipAddr.String(), contIfName))
+	}
+
+	for _, route := range epInfo.Routes {
+		plan = append(plan, fmt.Sprintf("Add IP route to %v via %v on link %v.", route.Dst.String(), route.Gw, contIfName))
+	}
+
+	return plan, nil
+}
+
 // deleteEndpointImpl deletes an existing endpoint from the network.
 func (nw *network) deleteEndpointImpl(ep *endpoint) error {
 	// Delete the veth pair by deleting one of the peer interfaces.
@@ -0,0 +1,53 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build linux
+
+package network
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// Tests an endpoint is planned on a network that is planned but not created yet.
+func TestPlanEndpointOnPlannedNetwork(t *testing.T) {
+	nm := &networkManager{ExternalInterfaces: make(map[string]*externalInterface)}
+
+	_, ipNet, _ := net.ParseCIDR("10.0.0.4/16")
+	ipNet.IP = net.ParseIP("10.0.0.4")
+	nwInfo := &NetworkInfo{Id: "azure", Mode: opModeBridge, BridgeName: "azure0"}
+	epInfo := &EndpointInfo{
+		Id:          "0123456789abcdef",
+		NetNsPath:   "/var/run/netns/test",
+		IfName:      "eth0",
+		IPAddresses: []net.IPNet{*ipNet},
+	}
+
+	_, err := nm.PlanEndpoint(nwInfo, "", epInfo)
+	if err != errNetworkNotFound {
+		t.Errorf("PlanEndpoint returned err:%v for a network that is not planned.", err)
+	}
+
+	plan, err := nm.PlanEndpoint(nwInfo, "eth1", epInfo)
+	if err != nil {
+		t.Fatalf("PlanEndpoint failed, err:%v", err)
+	}
+
+	expected := []string{
+		"Create veth pair azveth0123456 azveth0123456-2.",
+		"Set link azveth0123456 state up.",
+		"Set link azveth0123456 master azure0.",
+		"Add ARP reply rule for IP address 10.0.0.4 on azveth0123456-2.",
+		"Add MAC DNAT rule on eth1 for IP address 10.0.0.4 to azveth0123456-2.",
+		"Set link azveth0123456-2 netns /var/run/netns/test.",
+		"Set link azveth0123456-2 name eth0.",
+		"Add IP address 10.0.0.4/16 to link eth0.",
+		"Save endpoint 0123456789abcdef in network azure.",
+	}
+
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("PlanEndpoint returned %q, expected %q.", plan, expected)
+	}
+}
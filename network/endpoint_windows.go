@@ -7,6 +7,7 @@ package network
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"strings"
 
@@ -123,6 +124,26 @@ func (nw *network) newEndpointImpl(epInfo *EndpointInfo) (*endpoint, error) {
 	return ep, nil
 }
 
+// planEndpointImpl returns the changes newEndpointImpl would make, without making them.
+func (nw *network) planEndpointImpl(epInfo *EndpointInfo) ([]string, error) {
+	infraEpName, workloadEpName := ConstructEpName(epInfo.ContainerID, epInfo.NetNsPath, epInfo.IfName)
+
+	if workloadEpName == "" && nw.Endpoints[infraEpName] != nil {
+		return nil, nil
+	}
+
+	plan := []string{fmt.Sprintf("Create HNS endpoint %v in HNS network %v.", infraEpName, nw.Id)}
+
+	// HNS currently supports only one IP address per endpoint.
+	if epInfo.IPAddresses != nil {
+		plan = append(plan, fmt.Sprintf("Assign IP address %v to HNS endpoint %v.", epInfo.IPAddresses[0].String(), infraEpName))
+	}
+
+	plan = append(plan, fmt.Sprintf("Attach HNS endpoint %v to container %v.", infraEpName, epInfo.ContainerID))
+
+	return plan, nil
+}
+
 // deleteEndpointImpl deletes an existing endpoint from the network.
 func (nw *network) deleteEndpointImpl(ep *endpoint) error {
 	// Delete the HNS endpoint.
@@ -0,0 +1,139 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build linux
+
+package network
+
+import (
+	"net"
+
+	"github.com/Azure/azure-container-networking/ebtables"
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// collectStaleRules finds bridge rules that are not owned by any known network or endpoint,
+// and removes them unless dryRun is set. The caller must hold the store lock. Returns the stale rules.
+func (nm *networkManager) collectStaleRules(dryRun bool) ([]string, error) {
+	var stale []string
+
+	owned := nm.getOwnedRules()
+
+	// Include endpoints persisted by other processes.
+	persisted := &networkManager{}
+	err := nm.store.Read(storeKey, persisted)
+	if err == nil {
+		for rule := range persisted.getOwnedRules() {
+			owned[rule] = true
+		}
+	}
+
+	rules, err := ebtables.ListRules()
+	if err != nil {
+		log.Printf("[net] Failed to list bridge rules, err:%v.", err)
+		return nil, err
+	}
+
+	tx := ebtables.NewTransaction()
+	for _, rule := range findStaleRules(rules, owned) {
+		log.Printf("[net] Found stale bridge rule %v.", rule)
+		stale = append(stale, rule.String())
+
+		if !dryRun {
+			tx.Add(ebtables.Delete, rule)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("[net] Failed to delete stale bridge rules, err:%v.", err)
+		return stale, err
+	}
+
+	return stale, nil
+}
+
+// findStaleRules returns the rules that are not in the given set of owned rules.
+func findStaleRules(rules []*ebtables.Rule, owned map[string]bool) []*ebtables.Rule {
+	var stale []*ebtables.Rule
+
+	for _, rule := range rules {
+		if !owned[rule.String()] {
+			stale = append(stale, rule)
+		}
+	}
+
+	return stale
+}
+
+// getOwnedRules returns the set of bridge rules expected for all known networks and endpoints.
+func (nm *networkManager) getOwnedRules() map[string]bool {
+	owned := make(map[string]bool)
+
+	add := func(rule *ebtables.Rule) {
+		owned[rule.String()] = true
+	}
+
+	for _, extIf := range nm.ExternalInterfaces {
+		// Rules for the external interface exist only while it is connected to a bridge.
+		if extIf.BridgeName == "" {
+			continue
+		}
+
+		add(&ebtables.Rule{
+			Type:          ebtables.RuleSnatForInterface,
+			InterfaceName: extIf.Name,
+			MacAddress:    extIf.MacAddress,
+		})
+
+		if len(extIf.IPAddresses) > 0 {
+			add(&ebtables.Rule{
+				Type:       ebtables.RuleArpReply,
+				IPAddress:  extIf.IPAddresses[0].IP,
+				MacAddress: extIf.MacAddress,
+			})
+		}
+
+		add(&ebtables.Rule{
+			Type:          ebtables.RuleDnatForArpReplies,
+			InterfaceName: extIf.Name,
+		})
+
+		for _, nw := range extIf.Networks {
+			if nw.Mode == opModeTunnel {
+				virtualMac, _ := net.ParseMAC(virtualMacAddress)
+
+				add(&ebtables.Rule{
+					Type:          ebtables.RuleDnatForInterface,
+					InterfaceName: extIf.BridgeName,
+					MacAddress:    virtualMac,
+				})
+
+				add(&ebtables.Rule{
+					Type:          ebtables.RuleDnatForInterface,
+					InterfaceName: commonInterfacePrefix + "+",
+					MacAddress:    virtualMac,
+				})
+			}
+
+			for _, ep := range nw.Endpoints {
+				for _, ipAddr := range ep.IPAddresses {
+					add(&ebtables.Rule{
+						Type:       ebtables.RuleArpReply,
+						IPAddress:  ipAddr.IP,
+						MacAddress: nw.getArpReplyAddress(ep.MacAddress),
+					})
+
+					add(&ebtables.Rule{
+						Type:          ebtables.RuleDnatForIPAddress,
+						InterfaceName: extIf.Name,
+						IPAddress:     ipAddr.IP,
+						MacAddress:    ep.MacAddress,
+					})
+				}
+			}
+		}
+	}
+
+	return owned
+}
@@ -0,0 +1,194 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build linux
+
+package network
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-container-networking/ebtables"
+	"github.com/Azure/azure-container-networking/store"
+)
+
+var (
+	testExtMac, _ = net.ParseMAC("12:34:56:78:9a:bc")
+	testEpMac, _  = net.ParseMAC("12:34:56:78:9a:01")
+	testEpMac2, _ = net.ParseMAC("12:34:56:78:9a:02")
+)
+
+// fakeBackend records the rules programmed through it.
+type fakeBackend struct {
+	rules []*ebtables.Rule
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) Apply(changes []*ebtables.Change) error {
+	for _, change := range changes {
+		if change.Action != ebtables.Delete {
+			b.rules = append(b.rules, change.Rule)
+			continue
+		}
+
+		for i, rule := range b.rules {
+			if rule.String() == change.Rule.String() {
+				b.rules = append(b.rules[:i], b.rules[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *fakeBackend) List() ([]*ebtables.Rule, error) {
+	return b.rules, nil
+}
+
+// Returns a network manager with a bridge network holding an endpoint with the given address.
+func newTestNetworkManager(epId string, ip string, mac net.HardwareAddr) *networkManager {
+	ep := &endpoint{
+		Id:          epId,
+		MacAddress:  mac,
+		IPAddresses: []net.IPNet{{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}},
+	}
+
+	extIf := &externalInterface{
+		Name:        "eth0",
+		BridgeName:  "azure0",
+		MacAddress:  testExtMac,
+		IPAddresses: []*net.IPNet{{IP: net.ParseIP("10.0.0.4"), Mask: net.CIDRMask(24, 32)}},
+		Networks: map[string]*network{
+			"azure": {Id: "azure", Mode: opModeBridge, Endpoints: map[string]*endpoint{epId: ep}},
+		},
+	}
+
+	return &networkManager{ExternalInterfaces: map[string]*externalInterface{"eth0": extIf}}
+}
+
+// Tests that rules owned by known networks and endpoints, in memory or persisted by
+// other processes, are kept and all other rules are collected.
+func TestCollectStaleRules(t *testing.T) {
+	fileName := "network-gc-test.json"
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".bak")
+	defer os.Remove(fileName + ".lock")
+
+	kvs, err := store.NewJsonFileStore(fileName)
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	// The endpoint ep2 was added by another process sharing the store.
+	err = kvs.Write(storeKey, newTestNetworkManager("ep2", "10.0.0.6", testEpMac2))
+	if err != nil {
+		t.Fatalf("Failed to write state, err:%v", err)
+	}
+
+	nm := newTestNetworkManager("ep1", "10.0.0.5", testEpMac)
+	nm.store = kvs
+
+	tests := []struct {
+		name  string
+		rule  *ebtables.Rule
+		stale bool
+	}{
+		{"snat for interface", &ebtables.Rule{Type: ebtables.RuleSnatForInterface, InterfaceName: "eth0", MacAddress: testExtMac}, false},
+		{"arp reply for interface", &ebtables.Rule{Type: ebtables.RuleArpReply, IPAddress: net.ParseIP("10.0.0.4"), MacAddress: testExtMac}, false},
+		{"dnat for arp replies", &ebtables.Rule{Type: ebtables.RuleDnatForArpReplies, InterfaceName: "eth0"}, false},
+		{"arp reply for endpoint", &ebtables.Rule{Type: ebtables.RuleArpReply, IPAddress: net.ParseIP("10.0.0.5"), MacAddress: testEpMac}, false},
+		{"dnat for endpoint", &ebtables.Rule{Type: ebtables.RuleDnatForIPAddress, InterfaceName: "eth0", IPAddress: net.ParseIP("10.0.0.5"), MacAddress: testEpMac}, false},
+		{"dnat for persisted endpoint", &ebtables.Rule{Type: ebtables.RuleDnatForIPAddress, InterfaceName: "eth0", IPAddress: net.ParseIP("10.0.0.6"), MacAddress: testEpMac2}, false},
+		{"arp reply for deleted endpoint", &ebtables.Rule{Type: ebtables.RuleArpReply, IPAddress: net.ParseIP("10.0.0.7"), MacAddress: testEpMac}, true},
+		{"dnat with wrong mac", &ebtables.Rule{Type: ebtables.RuleDnatForIPAddress, InterfaceName: "eth0", IPAddress: net.ParseIP("10.0.0.5"), MacAddress: testEpMac2}, true},
+		{"snat for other interface", &ebtables.Rule{Type: ebtables.RuleSnatForInterface, InterfaceName: "eth1", MacAddress: testExtMac}, true},
+		{"tunnel dnat in bridge mode", &ebtables.Rule{Type: ebtables.RuleDnatForInterface, InterfaceName: "azure0", MacAddress: testExtMac}, true},
+	}
+
+	backend := &fakeBackend{}
+	for _, test := range tests {
+		backend.rules = append(backend.rules, test.rule)
+	}
+	ebtables.SetBackend(backend)
+
+	stale, err := nm.CollectStaleRules(false)
+	if err != nil {
+		t.Fatalf("CollectStaleRules failed, err:%v", err)
+	}
+
+	collected := make(map[string]bool)
+	for _, rule := range stale {
+		collected[rule] = true
+	}
+
+	remaining := make(map[string]bool)
+	for _, rule := range backend.rules {
+		remaining[rule.String()] = true
+	}
+
+	for _, test := range tests {
+		if collected[test.rule.String()] != test.stale {
+			t.Errorf("%s: rule collected %v, expected %v", test.name, !test.stale, test.stale)
+		}
+
+		if remaining[test.rule.String()] == test.stale {
+			t.Errorf("%s: rule remaining %v, expected %v", test.name, test.stale, !test.stale)
+		}
+	}
+
+	// The store is unlocked after collection.
+	err = kvs.Lock(false)
+	if err != nil {
+		t.Errorf("Failed to lock store after collection, err:%v", err)
+	}
+	kvs.Unlock()
+}
+
+// Tests that short-lived processes collect stale rules only when the last collection is older than the interval.
+func TestCollectStaleRulesIfDue(t *testing.T) {
+	fileName := "network-gc-due-test.json"
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".bak")
+	defer os.Remove(fileName + ".lock")
+
+	kvs, err := store.NewJsonFileStore(fileName)
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	// The CNI plugin holds the store lock for the whole command.
+	err = kvs.Lock(true)
+	if err != nil {
+		t.Fatalf("Failed to lock store, err:%v", err)
+	}
+	defer kvs.Unlock()
+
+	nm := newTestNetworkManager("ep1", "10.0.0.5", testEpMac)
+	nm.store = kvs
+
+	staleRule := &ebtables.Rule{Type: ebtables.RuleArpReply, IPAddress: net.ParseIP("10.0.0.7"), MacAddress: testEpMac}
+	backend := &fakeBackend{rules: []*ebtables.Rule{staleRule}}
+	ebtables.SetBackend(backend)
+
+	stale, err := nm.CollectStaleRulesIfDue(time.Hour, false)
+	if err != nil || len(stale) != 1 || len(backend.rules) != 0 {
+		t.Fatalf("CollectStaleRulesIfDue collected %v, err:%v", stale, err)
+	}
+
+	// The collection time is persisted for the next process.
+	nm = newTestNetworkManager("ep1", "10.0.0.5", testEpMac)
+	nm.store = kvs
+	kvs.Read(storeKey, nm)
+
+	backend.rules = []*ebtables.Rule{staleRule}
+
+	stale, err = nm.CollectStaleRulesIfDue(time.Hour, false)
+	if err != nil || len(stale) != 0 || len(backend.rules) != 1 {
+		t.Errorf("CollectStaleRulesIfDue collected %v before the interval elapsed, err:%v", stale, err)
+	}
+}
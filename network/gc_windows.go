@@ -0,0 +1,12 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build windows
+
+package network
+
+// collectStaleRules finds bridge rules that are not owned by any known network or endpoint.
+// The caller must hold the store lock. Windows does not program bridge rules.
+func (nm *networkManager) collectStaleRules(dryRun bool) ([]string, error) {
+	return nil, nil
+}
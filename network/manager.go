@@ -4,6 +4,7 @@
 package network
 
 import (
+	"net"
 	"sync"
 	"time"
 
@@ -16,6 +17,9 @@ import (
 const (
 	// Network store key.
 	storeKey = "Network"
+
+	// Default interval between stale bridge rule collections.
+	defaultRuleCollectionInterval = 5 * time.Minute
 )
 
 // NetworkManager manages the set of container networking resources.
@@ -23,7 +27,9 @@ type networkManager struct {
 	Version            string
 	TimeStamp          time.Time
 	ExternalInterfaces map[string]*externalInterface
+	RuleCollectionTime time.Time
 	store              store.KeyValueStore
+	stopRuleCollector  chan bool
 	sync.Mutex
 }
 
@@ -33,16 +39,23 @@ type NetworkManager interface {
 	Uninitialize()
 
 	AddExternalInterface(ifName string, subnet string) error
+	HandleOrphanedAddress(address net.IP, evict bool) error
 
 	CreateNetwork(nwInfo *NetworkInfo) error
+	PlanNetwork(nwInfo *NetworkInfo, ifName string) ([]string, error)
 	DeleteNetwork(networkId string) error
 	GetNetworkInfo(networkId string) (*NetworkInfo, error)
 
 	CreateEndpoint(networkId string, epInfo *EndpointInfo) error
+	PlanEndpoint(nwInfo *NetworkInfo, ifName string, epInfo *EndpointInfo) ([]string, error)
 	DeleteEndpoint(networkId string, endpointId string) error
 	GetEndpointInfo(networkId string, endpointId string) (*EndpointInfo, error)
 	AttachEndpoint(networkId string, endpointId string, sandboxKey string) (*endpoint, error)
 	DetachEndpoint(networkId string, endpointId string) error
+
+	CollectStaleRules(dryRun bool) ([]string, error)
+	CollectStaleRulesIfDue(interval time.Duration, dryRun bool) ([]string, error)
+	StartRuleCollector(interval time.Duration, dryRun bool)
 }
 
 // Creates a new network manager.
@@ -66,6 +79,10 @@ func (nm *networkManager) Initialize(config *common.PluginConfig) error {
 
 // Uninitialize cleans up network manager.
 func (nm *networkManager) Uninitialize() {
+	if nm.stopRuleCollector != nil {
+		close(nm.stopRuleCollector)
+		nm.stopRuleCollector = nil
+	}
 }
 
 // Restore reads network manager state from persistent store.
@@ -91,6 +108,10 @@ func (nm *networkManager) restore() error {
 		}
 	}
 
+	if store.RestoredFromBackup(nm.store) {
+		log.Printf("[net] Restored state from the previous generation, recent networks and endpoints may be lost.")
+	}
+
 	modTime, err := nm.store.GetModificationTime()
 	if err == nil {
 		log.Printf("[net] Store timestamp is %v.", modTime)
@@ -178,6 +199,43 @@ func (nm *networkManager) AddExternalInterface(ifName string, subnet string) err
 	return nil
 }
 
+// HandleOrphanedAddress handles an endpoint address that was withdrawn by the address source.
+// The endpoint owning the address is deleted if evict is set.
+func (nm *networkManager) HandleOrphanedAddress(address net.IP, evict bool) error {
+	nm.Lock()
+	defer nm.Unlock()
+
+	for _, extIf := range nm.ExternalInterfaces {
+		for _, nw := range extIf.Networks {
+			for _, ep := range nw.Endpoints {
+				for _, ipAddr := range ep.IPAddresses {
+					if !ipAddr.IP.Equal(address) {
+						continue
+					}
+
+					log.Printf("[net] Address %v of endpoint %v in network %v was withdrawn by the address source.",
+						address, ep.Id, nw.Id)
+
+					if !evict {
+						return nil
+					}
+
+					log.Printf("[net] Evicting endpoint %v.", ep.Id)
+
+					err := nw.deleteEndpoint(ep.Id)
+					if err != nil {
+						return err
+					}
+
+					return nm.save()
+				}
+			}
+		}
+	}
+
+	return errEndpointNotFound
+}
+
 // CreateNetwork creates a new container network.
 func (nm *networkManager) CreateNetwork(nwInfo *NetworkInfo) error {
 	nm.Lock()
@@ -196,6 +254,16 @@ func (nm *networkManager) CreateNetwork(nwInfo *NetworkInfo) error {
 	return nil
 }
 
+// PlanNetwork returns the changes CreateNetwork would make, without making them.
+// ifName names the host interface for the network if it was not added as an external interface yet.
+// The bridge name and mode of the planned network are set in nwInfo.
+func (nm *networkManager) PlanNetwork(nwInfo *NetworkInfo, ifName string) ([]string, error) {
+	nm.Lock()
+	defer nm.Unlock()
+
+	return nm.planNetwork(nwInfo, ifName)
+}
+
 // DeleteNetwork deletes an existing container network.
 func (nm *networkManager) DeleteNetwork(networkId string) error {
 	nm.Lock()
@@ -260,6 +328,32 @@ func (nm *networkManager) CreateEndpoint(networkId string, epInfo *EndpointInfo)
 	return nil
 }
 
+// PlanEndpoint returns the changes CreateEndpoint would make, without making them.
+// If the network does not exist yet, nwInfo and ifName describe the network planned by PlanNetwork.
+func (nm *networkManager) PlanEndpoint(nwInfo *NetworkInfo, ifName string, epInfo *EndpointInfo) ([]string, error) {
+	nm.Lock()
+	defer nm.Unlock()
+
+	nw, err := nm.getNetwork(nwInfo.Id)
+	if err != nil {
+		if ifName == "" {
+			return nil, err
+		}
+
+		nw = &network{
+			Id:        nwInfo.Id,
+			Mode:      nwInfo.Mode,
+			Endpoints: make(map[string]*endpoint),
+			extIf: &externalInterface{
+				Name:       ifName,
+				BridgeName: nwInfo.BridgeName,
+			},
+		}
+	}
+
+	return nw.planEndpoint(epInfo)
+}
+
 // DeleteEndpoint deletes an existing container endpoint.
 func (nm *networkManager) DeleteEndpoint(networkId string, endpointId string) error {
 	nm.Lock()
@@ -356,3 +450,83 @@ func (nm *networkManager) DetachEndpoint(networkId string, endpointId string) er
 
 	return nil
 }
+
+// CollectStaleRules removes bridge rules left behind by networks and endpoints that no longer exist.
+// In dry-run mode, stale rules are only reported. Returns the stale rules.
+func (nm *networkManager) CollectStaleRules(dryRun bool) ([]string, error) {
+	nm.Lock()
+	defer nm.Unlock()
+
+	// Without persisted state every rule would look stale.
+	if nm.store == nil {
+		return nil, nil
+	}
+
+	// Hold the store lock across the snapshot and the commit, so that processes sharing
+	// the store cannot add endpoints, and their rules, in between.
+	err := nm.store.Lock(true)
+	if err != nil {
+		log.Printf("[net] Failed to lock store, err:%v.", err)
+		return nil, err
+	}
+	defer nm.store.Unlock()
+
+	return nm.collectStaleRules(dryRun)
+}
+
+// CollectStaleRulesIfDue collects stale bridge rules if the last collection recorded in persistent
+// store is older than the given interval. It is meant for short-lived processes, such as the CNI
+// plugin, that cannot run a periodic collector. The caller must hold the store lock.
+func (nm *networkManager) CollectStaleRulesIfDue(interval time.Duration, dryRun bool) ([]string, error) {
+	nm.Lock()
+	defer nm.Unlock()
+
+	if nm.store == nil {
+		return nil, nil
+	}
+
+	if interval == 0 {
+		interval = defaultRuleCollectionInterval
+	}
+
+	if time.Since(nm.RuleCollectionTime) < interval {
+		return nil, nil
+	}
+
+	stale, err := nm.collectStaleRules(dryRun)
+	if err != nil {
+		return stale, err
+	}
+
+	nm.RuleCollectionTime = time.Now()
+
+	return stale, nm.save()
+}
+
+// StartRuleCollector collects stale bridge rules now and then periodically until network manager is uninitialized.
+func (nm *networkManager) StartRuleCollector(interval time.Duration, dryRun bool) {
+	if interval == 0 {
+		interval = defaultRuleCollectionInterval
+	}
+
+	log.Printf("[net] Starting stale rule collector with interval %v dryRun %v.", interval, dryRun)
+
+	stop := make(chan bool)
+	nm.stopRuleCollector = stop
+
+	go func() {
+		nm.CollectStaleRules(dryRun)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				nm.CollectStaleRules(dryRun)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Azure/azure-container-networking/platform"
+	"github.com/Azure/azure-container-networking/store"
+)
+
+// Tests state written by older releases is restored.
+func TestRestoreOlderState(t *testing.T) {
+	// State written by release v0.91.
+	fixture, err := ioutil.ReadFile("testdata/azure-vnet-v0.91.json")
+	if err != nil {
+		t.Fatalf("Failed to read fixture, err:%v", err)
+	}
+
+	fileName := "network-restore-test.json"
+	defer os.Remove(fileName)
+	defer os.Remove(fileName + ".bak")
+	defer os.Remove(fileName + ".lock")
+
+	err = ioutil.WriteFile(fileName, fixture, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write fixture, err:%v", err)
+	}
+
+	kvs, err := store.NewJsonFileStore(fileName)
+	if err != nil {
+		t.Fatalf("NewJsonFileStore failed, err:%v", err)
+	}
+
+	nm := &networkManager{
+		ExternalInterfaces: make(map[string]*externalInterface),
+		store:              kvs,
+	}
+
+	err = nm.restore()
+	if err != nil {
+		t.Fatalf("restore failed, err:%v", err)
+	}
+
+	nwInfo, err := nm.GetNetworkInfo("azure")
+	if err != nil {
+		t.Fatalf("GetNetworkInfo failed, err:%v", err)
+	}
+
+	if len(nwInfo.Subnets) != 1 ||
+		nwInfo.Subnets[0].Family != platform.AfINET ||
+		nwInfo.Subnets[0].Prefix.String() != "10.240.0.0/16" ||
+		nwInfo.BridgeName != "azure0" {
+		t.Errorf("GetNetworkInfo returned %+v after restore.", nwInfo)
+	}
+
+	epInfo, err := nm.GetEndpointInfo("azure", "0ee5a6a5-eth0")
+	if err != nil {
+		t.Fatalf("GetEndpointInfo failed, err:%v", err)
+	}
+
+	if len(epInfo.IPAddresses) != 1 || epInfo.IPAddresses[0].String() != "10.240.0.5/16" {
+		t.Errorf("GetEndpointInfo returned %+v after restore.", epInfo)
+	}
+}
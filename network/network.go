@@ -4,6 +4,7 @@
 package network
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/Azure/azure-container-networking/log"
@@ -115,6 +116,54 @@ func (nm *networkManager) findExternalInterfaceBySubnet(subnet string) *external
 	return nil
 }
 
+// PlanNetwork returns the changes newNetwork would make, without making them.
+// ifName names the host interface for the network if it was not added as an external interface yet.
+func (nm *networkManager) planNetwork(nwInfo *NetworkInfo, ifName string) ([]string, error) {
+	var plan []string
+
+	// Set defaults.
+	if nwInfo.Mode == "" {
+		nwInfo.Mode = opModeDefault
+	}
+
+	if len(nwInfo.Subnets) == 0 {
+		return nil, errSubnetNotFound
+	}
+
+	// Find the external interface for this subnet.
+	subnet := nwInfo.Subnets[0].Prefix.String()
+	extIf := nm.findExternalInterfaceBySubnet(subnet)
+	if extIf == nil && ifName != "" && nm.ExternalInterfaces[ifName] == nil {
+		// Plan on an external interface that is not recorded.
+		plan = append(plan, fmt.Sprintf("Add external interface %v for subnet %v.", ifName, subnet))
+		extIf = &externalInterface{
+			Name:     ifName,
+			Networks: make(map[string]*network),
+			Subnets:  []string{subnet},
+		}
+	}
+
+	if extIf == nil {
+		return nil, errSubnetNotFound
+	}
+
+	// Make sure this network does not already exist.
+	if extIf.Networks[nwInfo.Id] != nil {
+		return nil, errNetworkExists
+	}
+
+	// Call the OS-specific implementation.
+	implPlan, err := nm.planNetworkImpl(nwInfo, extIf)
+	if err != nil {
+		return nil, err
+	}
+
+	plan = append(plan, implPlan...)
+	plan = append(plan, fmt.Sprintf("Save network %v on interface %v.", nwInfo.Id, extIf.Name))
+
+	return plan, nil
+}
+
 // NewNetwork creates a new container network.
 func (nm *networkManager) newNetwork(nwInfo *NetworkInfo) (*network, error) {
 	var nw *network
@@ -53,6 +53,18 @@ func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInt
 	return nw, nil
 }
 
+// PlanNetworkImpl returns the changes newNetworkImpl would make, without making them.
+func (nm *networkManager) planNetworkImpl(nwInfo *NetworkInfo, extIf *externalInterface) ([]string, error) {
+	switch nwInfo.Mode {
+	case opModeTunnel:
+		fallthrough
+	case opModeBridge:
+		return nm.planConnectExternalInterface(extIf, nwInfo)
+	default:
+		return nil, errNetworkModeInvalid
+	}
+}
+
 // DeleteNetworkImpl deletes an existing container network.
 func (nm *networkManager) deleteNetworkImpl(nw *network) error {
 	// Disconnect the interface if this was the last network using it.
@@ -143,40 +155,37 @@ func (nm *networkManager) applyIPConfig(extIf *externalInterface, targetIf *net.
 
 // AddBridgeRules adds bridge frame table rules for container traffic.
 func (nm *networkManager) addBridgeRules(extIf *externalInterface, hostIf *net.Interface, bridgeName string, opMode string) error {
-	// Add SNAT rule to translate container egress traffic.
-	log.Printf("[net] Adding SNAT rule for egress traffic on %v.", hostIf.Name)
-	err := ebtables.SetSnatForInterface(hostIf.Name, hostIf.HardwareAddr, ebtables.Append)
-	if err != nil {
-		return err
+	tx := newBridgeRules(extIf.IPAddresses[0].IP, hostIf, bridgeName, opMode)
+
+	for _, change := range tx.Changes() {
+		log.Printf("[net] Adding bridge rule %v.", change.Rule)
 	}
 
+	// Apply all rules at once so that a failure does not leave the bridge partially programmed.
+	return tx.Commit()
+}
+
+// NewBridgeRules returns a transaction adding the bridge frame table rules for container traffic.
+func newBridgeRules(primary net.IP, hostIf *net.Interface, bridgeName string, opMode string) *ebtables.Transaction {
+	tx := ebtables.NewTransaction()
+
+	// Add SNAT rule to translate container egress traffic.
+	tx.SetSnatForInterface(hostIf.Name, hostIf.HardwareAddr, ebtables.Append)
+
 	// Add ARP reply rule for host primary IP address.
 	// ARP requests for all IP addresses are forwarded to the SDN fabric, but fabric
 	// doesn't respond to ARP requests from the VM for its own primary IP address.
-	primary := extIf.IPAddresses[0].IP
-	log.Printf("[net] Adding ARP reply rule for primary IP address %v.", primary)
-	err = ebtables.SetArpReply(primary, hostIf.HardwareAddr, ebtables.Append)
-	if err != nil {
-		return err
-	}
+	tx.SetArpReply(primary, hostIf.HardwareAddr, ebtables.Append)
 
 	// Add DNAT rule to forward ARP replies to container interfaces.
-	log.Printf("[net] Adding DNAT rule for ingress ARP traffic on interface %v.", hostIf.Name)
-	err = ebtables.SetDnatForArpReplies(hostIf.Name, ebtables.Append)
-	if err != nil {
-		return err
-	}
+	tx.SetDnatForArpReplies(hostIf.Name, ebtables.Append)
 
 	// Enable VEPA for host policy enforcement if necessary.
 	if opMode == opModeTunnel {
-		log.Printf("[net] Enabling VEPA mode for %v.", hostIf.Name)
-		err = ebtables.SetVepaMode(bridgeName, commonInterfacePrefix, virtualMacAddress, ebtables.Append)
-		if err != nil {
-			return err
-		}
+		tx.SetVepaMode(bridgeName, commonInterfacePrefix, virtualMacAddress, ebtables.Append)
 	}
 
-	return nil
+	return tx
 }
 
 // DeleteBridgeRules deletes bridge rules for container traffic.
@@ -342,3 +351,65 @@ func (nm *networkManager) disconnectExternalInterface(extIf *externalInterface)
 
 	return nil
 }
+
+// PlanConnectExternalInterface returns the changes connectExternalInterface would make, without making them.
+func (nm *networkManager) planConnectExternalInterface(extIf *externalInterface, nwInfo *NetworkInfo) ([]string, error) {
+	var plan []string
+
+	// Check whether this interface is already connected.
+	if extIf.BridgeName != "" {
+		nwInfo.BridgeName = extIf.BridgeName
+		return nil, nil
+	}
+
+	// Find the external interface.
+	hostIf, err := net.InterfaceByName(extIf.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// If a bridge name is not specified, generate one based on the external interface index.
+	bridgeName := nwInfo.BridgeName
+	if bridgeName == "" {
+		bridgeName = fmt.Sprintf("%s%d", bridgePrefix, hostIf.Index)
+		nwInfo.BridgeName = bridgeName
+	}
+
+	_, err = net.InterfaceByName(bridgeName)
+	if err != nil {
+		plan = append(plan, fmt.Sprintf("Create bridge %v.", bridgeName))
+	}
+
+	// Find the global unicast IP addresses that move to the bridge.
+	var primary net.IP
+	addrs, _ := hostIf.Addrs()
+	for _, addr := range addrs {
+		ipAddr, _, err := net.ParseCIDR(addr.String())
+		if err != nil || !ipAddr.IsGlobalUnicast() {
+			continue
+		}
+
+		if primary == nil {
+			primary = ipAddr
+		}
+
+		plan = append(plan, fmt.Sprintf("Move IP address %v from %v to %v.", addr, hostIf.Name, bridgeName))
+	}
+
+	if primary == nil {
+		return nil, fmt.Errorf("Interface %v has no IP address", hostIf.Name)
+	}
+
+	plan = append(plan, fmt.Sprintf("Move IP routes from %v to %v.", hostIf.Name, bridgeName))
+
+	for _, change := range newBridgeRules(primary, hostIf, bridgeName, nwInfo.Mode).Changes() {
+		plan = append(plan, fmt.Sprintf("Add bridge rule %v.", change.Rule))
+	}
+
+	plan = append(plan,
+		fmt.Sprintf("Set link %v master %v.", hostIf.Name, bridgeName),
+		fmt.Sprintf("Set link %v hairpin on.", hostIf.Name),
+		fmt.Sprintf("Set link %v state up.", bridgeName))
+
+	return plan, nil
+}
@@ -7,6 +7,7 @@ package network
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/Azure/azure-container-networking/log"
 	"github.com/Microsoft/hcsshim"
@@ -76,6 +77,28 @@ func (nm *networkManager) newNetworkImpl(nwInfo *NetworkInfo, extIf *externalInt
 	return nw, nil
 }
 
+// PlanNetworkImpl returns the changes newNetworkImpl would make, without making them.
+func (nm *networkManager) planNetworkImpl(nwInfo *NetworkInfo, extIf *externalInterface) ([]string, error) {
+	var hnsType string
+
+	switch nwInfo.Mode {
+	case opModeBridge:
+		hnsType = hnsL2bridge
+	case opModeTunnel:
+		hnsType = hnsL2tunnel
+	default:
+		return nil, errNetworkModeInvalid
+	}
+
+	plan := []string{fmt.Sprintf("Create HNS network %v of type %v on adapter %v.", nwInfo.Id, hnsType, extIf.Name)}
+
+	for _, subnet := range nwInfo.Subnets {
+		plan = append(plan, fmt.Sprintf("Add subnet %v with gateway %v to HNS network %v.", subnet.Prefix.String(), subnet.Gateway, nwInfo.Id))
+	}
+
+	return plan, nil
+}
+
 // DeleteNetworkImpl deletes an existing container network.
 func (nm *networkManager) deleteNetworkImpl(nw *network) error {
 	// Delete the HNS network.
@@ -0,0 +1,171 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package platform
+
+import (
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Executor runs external commands on behalf of the plugins.
+type Executor interface {
+	// Run runs a command and waits for it to complete.
+	Run(name string, arg ...string) error
+	// Output runs a command and returns its standard output.
+	Output(name string, arg ...string) ([]byte, error)
+	// CombinedOutput runs a command and returns its combined standard output and standard error.
+	CombinedOutput(name string, arg ...string) ([]byte, error)
+}
+
+var (
+	executor     Executor = &execExecutor{}
+	executorLock sync.Mutex
+)
+
+// GetExecutor returns the executor used to run external commands.
+func GetExecutor() Executor {
+	executorLock.Lock()
+	defer executorLock.Unlock()
+	return executor
+}
+
+// SetExecutor overrides the executor used to run external commands.
+func SetExecutor(e Executor) {
+	executorLock.Lock()
+	defer executorLock.Unlock()
+	executor = e
+}
+
+// IsDryRun returns whether external commands are currently logged instead of executed.
+func IsDryRun() bool {
+	_, ok := GetExecutor().(*DryRunExecutor)
+	return ok
+}
+
+// ExecuteShellCommand executes a shell command.
+func ExecuteShellCommand(command string) error {
+	return GetExecutor().Run("sh", "-c", command)
+}
+
+// FormatCommand returns the printable form of a command line.
+func FormatCommand(name string, arg ...string) string {
+	return strings.Join(append([]string{name}, arg...), " ")
+}
+
+// execExecutor runs commands on the host.
+type execExecutor struct{}
+
+// NewExecutor creates an executor that runs commands on the host.
+func NewExecutor() Executor {
+	return &execExecutor{}
+}
+
+// Run runs a command and waits for it to complete.
+func (e *execExecutor) Run(name string, arg ...string) error {
+	cmd := exec.Command(name, arg...)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// Output runs a command and returns its standard output.
+func (e *execExecutor) Output(name string, arg ...string) ([]byte, error) {
+	return exec.Command(name, arg...).Output()
+}
+
+// CombinedOutput runs a command and returns its combined standard output and standard error.
+func (e *execExecutor) CombinedOutput(name string, arg ...string) ([]byte, error) {
+	return exec.Command(name, arg...).CombinedOutput()
+}
+
+// DryRunExecutor logs commands instead of running them.
+// Every command succeeds with empty output.
+type DryRunExecutor struct {
+	logf func(format string, args ...interface{})
+}
+
+// NewDryRunExecutor creates an executor that reports commands to the given log function.
+func NewDryRunExecutor(logf func(format string, args ...interface{})) *DryRunExecutor {
+	return &DryRunExecutor{logf: logf}
+}
+
+// Run logs a command.
+func (e *DryRunExecutor) Run(name string, arg ...string) error {
+	e.log(name, arg...)
+	return nil
+}
+
+// Output logs a command.
+func (e *DryRunExecutor) Output(name string, arg ...string) ([]byte, error) {
+	e.log(name, arg...)
+	return []byte{}, nil
+}
+
+// CombinedOutput logs a command.
+func (e *DryRunExecutor) CombinedOutput(name string, arg ...string) ([]byte, error) {
+	e.log(name, arg...)
+	return []byte{}, nil
+}
+
+func (e *DryRunExecutor) log(name string, arg ...string) {
+	if e.logf != nil {
+		e.logf("[dry-run] %s", FormatCommand(name, arg...))
+	}
+}
+
+// RecordingExecutor records commands instead of running them.
+// It is meant for tests that verify which commands a component runs.
+type RecordingExecutor struct {
+	// Commands holds the printable form of every command run, in order.
+	Commands []string
+	// Outputs maps a printable command to the output it returns.
+	Outputs map[string][]byte
+	// Errors maps a printable command to the error it returns.
+	Errors map[string]error
+	lock   sync.Mutex
+}
+
+// NewRecordingExecutor creates an executor that records commands.
+func NewRecordingExecutor() *RecordingExecutor {
+	return &RecordingExecutor{
+		Outputs: make(map[string][]byte),
+		Errors:  make(map[string]error),
+	}
+}
+
+// Run records a command.
+func (e *RecordingExecutor) Run(name string, arg ...string) error {
+	_, err := e.record(name, arg...)
+	return err
+}
+
+// Output records a command and returns its configured output.
+func (e *RecordingExecutor) Output(name string, arg ...string) ([]byte, error) {
+	return e.record(name, arg...)
+}
+
+// CombinedOutput records a command and returns its configured output.
+func (e *RecordingExecutor) CombinedOutput(name string, arg ...string) ([]byte, error) {
+	return e.record(name, arg...)
+}
+
+func (e *RecordingExecutor) record(name string, arg ...string) ([]byte, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	command := FormatCommand(name, arg...)
+	e.Commands = append(e.Commands, command)
+
+	return e.Outputs[command], e.Errors[command]
+}
+
+// String returns the recorded commands, one per line.
+func (e *RecordingExecutor) String() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return strings.Join(e.Commands, "\n")
+}
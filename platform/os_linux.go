@@ -5,7 +5,7 @@ package platform
 
 import (
 	"io/ioutil"
-	"os/exec"
+	"strings"
 	"time"
 )
 
@@ -34,7 +34,7 @@ func GetOSInfo() string {
 // GetLastRebootTime returns the last time the system rebooted.
 func GetLastRebootTime() (time.Time, error) {
 	// Query last reboot time.
-	out, err := exec.Command("uptime", "-s").Output()
+	out, err := GetExecutor().Output("uptime", "-s")
 	if err != nil {
 		//log.Printf("Failed to query uptime, err:%v", err)
 		return time.Time{}, err
@@ -42,7 +42,7 @@ func GetLastRebootTime() (time.Time, error) {
 
 	// Parse the output.
 	layout := "2006-01-02 15:04:05"
-	rebootTime, err := time.Parse(layout, string(out[:len(out)-1]))
+	rebootTime, err := time.Parse(layout, strings.TrimSpace(string(out)))
 	if err != nil {
 		//log.Printf("Failed to parse uptime, err:%v", err)
 		return time.Time{}, err
@@ -50,14 +50,3 @@ func GetLastRebootTime() (time.Time, error) {
 
 	return rebootTime, nil
 }
-
-// ExecuteShellCommand executes a shell command.
-func ExecuteShellCommand(command string) error {
-	//log.Debugf("[shell] %s", command)
-	cmd := exec.Command("sh", "-c", command)
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
-	return cmd.Wait()
-}
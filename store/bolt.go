@@ -0,0 +1,566 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// Extension added to the file name of a JSON store once it is migrated.
+	migratedExtension = ".migrated"
+
+	// Time to wait for the database file lock held by another process when not blocking.
+	boltNonBlockingTimeout = 10 * time.Millisecond
+)
+
+var (
+	// Buckets of values and their schema versions.
+	boltValuesBucket         = []byte("Values")
+	boltSchemaVersionsBucket = []byte(schemaVersionsKey)
+)
+
+// boltStore is an implementation of KeyValueStore using an embedded transactional key value database.
+// Each write is committed in its own transaction, so only the modified key is written to disk.
+type boltStore struct {
+	fileName         string
+	migratedFileName string
+	db               *bolt.DB
+	locked           bool
+	exclusive        bool
+	keyring          *keyring
+	sync.Mutex
+}
+
+// NewBoltStore creates a new boltStore object, accessed as a KeyValueStore.
+func NewBoltStore(fileName string) (KeyValueStore, error) {
+	if fileName == "" {
+		fileName = defaultFileName
+	}
+
+	kvs := &boltStore{
+		fileName: fileName,
+	}
+
+	// Create the buckets once, so that opening the database never writes to it.
+	// Transactions tolerate missing buckets, for databases whose creation was interrupted.
+	err := kvs.createBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	return kvs, nil
+}
+
+// Read restores the value for the given key from persistent store.
+func (kvs *boltStore) Read(key string, value interface{}) error {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	var raw json.RawMessage
+	var version int
+
+	err := kvs.view(func(tx *bolt.Tx) error {
+		var err error
+		raw, version, err = getValue(tx, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Upgrade the value to the current schema version.
+	if current := GetSchemaVersion(key); version < current {
+		raw, err = migrateValue(kvs.keyring, key, raw, version)
+		if err != nil {
+			return err
+		}
+
+		// The migrated value is saved only if the store is writable.
+		if !kvs.locked || kvs.exclusive {
+			err = kvs.update(func(tx *bolt.Tx) error {
+				return putValue(tx, key, raw)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return decodeValue(kvs.keyring, raw, value)
+}
+
+// Write saves the given key value pair to persistent store.
+func (kvs *boltStore) Write(key string, value interface{}) error {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	if kvs.locked && !kvs.exclusive {
+		return ErrStoreNotLockedExclusive
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	raw, err = kvs.keyring.seal(raw)
+	if err != nil {
+		return err
+	}
+
+	return kvs.update(func(tx *bolt.Tx) error {
+		return putValue(tx, key, raw)
+	})
+}
+
+// Delete removes the given key from persistent store.
+func (kvs *boltStore) Delete(key string) error {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	if kvs.locked && !kvs.exclusive {
+		return ErrStoreNotLockedExclusive
+	}
+
+	return kvs.update(func(tx *bolt.Tx) error {
+		return deleteValue(tx, key)
+	})
+}
+
+// Update runs the given function in a database transaction. Changes made in the transaction are
+// committed together when the function returns nil, and rolled back when it returns an error.
+func (kvs *boltStore) Update(fn func(tx Tx) error) error {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	if kvs.locked && !kvs.exclusive {
+		return ErrStoreNotLockedExclusive
+	}
+
+	return kvs.update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx, keyring: kvs.keyring})
+	})
+}
+
+// boltTx is a transaction on a boltStore.
+type boltTx struct {
+	tx      *bolt.Tx
+	keyring *keyring
+}
+
+// Read restores the value for the given key, including changes made in the transaction.
+func (tx *boltTx) Read(key string, value interface{}) error {
+	raw, version, err := getValue(tx.tx, key)
+	if err != nil {
+		return err
+	}
+
+	// Upgrade the value to the current schema version.
+	if current := GetSchemaVersion(key); version < current {
+		raw, err = migrateValue(tx.keyring, key, raw, version)
+		if err != nil {
+			return err
+		}
+
+		err = putValue(tx.tx, key, raw)
+		if err != nil {
+			return err
+		}
+	}
+
+	return decodeValue(tx.keyring, raw, value)
+}
+
+// Write saves the given key value pair when the transaction commits.
+func (tx *boltTx) Write(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	raw, err = tx.keyring.seal(raw)
+	if err != nil {
+		return err
+	}
+
+	return putValue(tx.tx, key, raw)
+}
+
+// Delete removes the given key when the transaction commits.
+func (tx *boltTx) Delete(key string) error {
+	return deleteValue(tx.tx, key)
+}
+
+// ListKeys returns the keys in persistent store.
+func (kvs *boltStore) ListKeys() ([]string, error) {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	var keys []string
+
+	err := kvs.view(func(tx *bolt.Tx) error {
+		values := tx.Bucket(boltValuesBucket)
+		if values == nil {
+			return nil
+		}
+
+		return values.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+
+	return keys, err
+}
+
+// Flush commits in-memory state to persistent store.
+// Writes are committed immediately, so there is nothing to flush.
+func (kvs *boltStore) Flush() error {
+	return nil
+}
+
+// Lock locks the store for exclusive access.
+func (kvs *boltStore) Lock(block bool) error {
+	var timeout time.Duration
+	if block {
+		timeout = lockTimeout
+	}
+
+	return kvs.LockWithTimeout(true, timeout)
+}
+
+// LockWithTimeout locks the store for shared or exclusive access, waiting up to the given timeout
+// for other processes holding a conflicting lock. The database is kept open, and its file locked,
+// until the store is unlocked. Stores locked for shared access open the database read-only.
+func (kvs *boltStore) LockWithTimeout(exclusive bool, timeout time.Duration) error {
+	kvs.Mutex.Lock()
+	locked := kvs.locked
+	kvs.Mutex.Unlock()
+
+	if locked {
+		return ErrStoreLocked
+	}
+
+	// The store is not accessed while waiting, so other goroutines are not blocked on it.
+	db, err := kvs.open(exclusive, timeout)
+	if err != nil {
+		return err
+	}
+
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	// Another goroutine may have locked the store in the meantime.
+	if kvs.locked {
+		db.Close()
+		return ErrStoreLocked
+	}
+
+	kvs.db = db
+	kvs.exclusive = exclusive
+	kvs.locked = true
+
+	return nil
+}
+
+// Unlock unlocks the store.
+func (kvs *boltStore) Unlock() error {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	if !kvs.locked {
+		return ErrStoreNotLocked
+	}
+
+	err := kvs.db.Close()
+	if err != nil {
+		return err
+	}
+
+	kvs.db = nil
+	kvs.locked = false
+
+	return nil
+}
+
+// Watch returns a channel that receives a notification each time the value of the given key changes
+// in persistent store, for example when it is written by another process. Changes made by another
+// process are noticed once it closes the database. The channel is closed when the stop channel is closed.
+func (kvs *boltStore) Watch(key string, stop <-chan struct{}) (<-chan struct{}, error) {
+	read := func() (json.RawMessage, error) {
+		kvs.Mutex.Lock()
+		defer kvs.Mutex.Unlock()
+
+		var raw json.RawMessage
+
+		err := kvs.view(func(tx *bolt.Tx) error {
+			var err error
+			raw, _, err = getValue(tx, key)
+			return err
+		})
+		if err == ErrKeyNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return openWatchedValue(kvs.keyring, raw), nil
+	}
+
+	return watchKey(kvs.fileName, key, read, nil, stop)
+}
+
+// GetModificationTime returns the modification time of the persistent store.
+func (kvs *boltStore) GetModificationTime() (time.Time, error) {
+	info, err := os.Stat(kvs.fileName)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// Opens the database, retrying up to the given timeout while another process holds a conflicting file lock.
+func (kvs *boltStore) open(exclusive bool, timeout time.Duration) (*bolt.DB, error) {
+	retries := lockRetries(timeout)
+
+	for i := 0; ; i++ {
+		// Bolt waits indefinitely with a zero timeout, so each attempt waits briefly instead.
+		db, err := bolt.Open(kvs.fileName, 0664, &bolt.Options{Timeout: boltNonBlockingTimeout, ReadOnly: !exclusive})
+		if err != bolt.ErrTimeout {
+			return db, err
+		}
+
+		if i >= retries {
+			log.Printf("[store] Timed out waiting for the lock on %v, timeout:%v.", kvs.fileName, timeout)
+			return nil, ErrStoreLocked
+		}
+
+		time.Sleep(lockRetryDelay)
+	}
+}
+
+// Creates the database and its buckets if the database does not exist yet.
+func (kvs *boltStore) createBuckets() error {
+	if _, err := os.Stat(kvs.fileName); !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := kvs.open(true, lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltValuesBucket, boltSchemaVersionsBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Runs a read-write transaction. The database is opened for the transaction if the store is not locked,
+// since an open database holds its file lock.
+func (kvs *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	db := kvs.db
+	if db == nil {
+		var err error
+		db, err = kvs.open(true, lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+
+	return db.Update(fn)
+}
+
+// Runs a read-only transaction. The database is opened for the transaction if the store is not locked,
+// since an open database holds its file lock.
+func (kvs *boltStore) view(fn func(tx *bolt.Tx) error) error {
+	db := kvs.db
+	if db == nil {
+		var err error
+		db, err = kvs.open(false, lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+
+	return db.View(fn)
+}
+
+// RotateKey encrypts all values again with a new key, and removes older keys from the key file.
+func (kvs *boltStore) RotateKey() error {
+	return rotateKey(kvs)
+}
+
+// Encrypts the values of the JSON store migrated to this store, and of its previous generation,
+// with the current key.
+func (kvs *boltStore) resealGenerations() error {
+	if kvs.migratedFileName == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(kvs.migratedFileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	jsonKvs, err := NewJsonFileStore(kvs.migratedFileName)
+	if err != nil {
+		return err
+	}
+
+	es := jsonKvs.(encryptedStore)
+	es.setKeyring(kvs.getKeyring())
+
+	err = reseal(es)
+	if err != nil {
+		return err
+	}
+
+	return es.resealGenerations()
+}
+
+// Sets the keyring used to encrypt values at rest.
+func (kvs *boltStore) setKeyring(kr *keyring) {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	kvs.keyring = kr
+}
+
+// Returns the keyring used to encrypt values at rest.
+func (kvs *boltStore) getKeyring() *keyring {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	return kvs.keyring
+}
+
+// Returns the raw value of the given key and its schema version.
+func getValue(tx *bolt.Tx, key string) (json.RawMessage, int, error) {
+	values := tx.Bucket(boltValuesBucket)
+	if values == nil {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	v := values.Get([]byte(key))
+	if v == nil {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	// Values returned by the database are valid only during the transaction.
+	raw := append(json.RawMessage{}, v...)
+
+	var version int
+	if versions := tx.Bucket(boltSchemaVersionsBucket); versions != nil {
+		version, _ = strconv.Atoi(string(versions.Get([]byte(key))))
+	}
+
+	return raw, version, nil
+}
+
+// Removes the given key and its schema version.
+func deleteValue(tx *bolt.Tx, key string) error {
+	for _, name := range [][]byte{boltValuesBucket, boltSchemaVersionsBucket} {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			continue
+		}
+
+		err := bucket.Delete([]byte(key))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Saves the given raw value and records its current schema version.
+func putValue(tx *bolt.Tx, key string, raw json.RawMessage) error {
+	values, err := tx.CreateBucketIfNotExists(boltValuesBucket)
+	if err != nil {
+		return err
+	}
+
+	err = values.Put([]byte(key), raw)
+	if err != nil {
+		return err
+	}
+
+	versions, err := tx.CreateBucketIfNotExists(boltSchemaVersionsBucket)
+	if err != nil {
+		return err
+	}
+
+	// Values without migrations are not recorded.
+	version := GetSchemaVersion(key)
+	if version == 0 {
+		return versions.Delete([]byte(key))
+	}
+
+	return versions.Put([]byte(key), []byte(strconv.Itoa(version)))
+}
+
+// MigrateJsonFileStore copies the contents of a JSON store file to the given store,
+// and renames the file so that it is migrated only once. It does nothing if the file does not exist.
+func MigrateJsonFileStore(jsonFileName string, kvs ExtendedKeyValueStore) error {
+	if _, err := os.Stat(jsonFileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	jsonKvs, err := NewJsonFileStore(jsonFileName)
+	if err != nil {
+		return err
+	}
+
+	keys, err := jsonKvs.(ExtendedKeyValueStore).ListKeys()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[store] Migrating %v keys from %v.", len(keys), jsonFileName)
+
+	for _, key := range keys {
+		var raw json.RawMessage
+
+		// Reading upgrades the value to the current schema version.
+		err = jsonKvs.Read(key, &raw)
+		if err != nil {
+			log.Printf("[store] Failed to read %v from %v, err:%v.", key, jsonFileName, err)
+			return err
+		}
+
+		err = kvs.Write(key, raw)
+		if err != nil {
+			log.Printf("[store] Failed to migrate %v from %v, err:%v.", key, jsonFileName, err)
+			return err
+		}
+	}
+
+	// Keep the previous generation of the JSON store with the migrated file.
+	err = os.Rename(jsonFileName+backupExtension, jsonFileName+migratedExtension+backupExtension)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[store] Failed to rename the previous generation of %v, err:%v.", jsonFileName, err)
+	}
+
+	return os.Rename(jsonFileName, jsonFileName+migratedExtension)
+}
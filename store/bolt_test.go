@@ -0,0 +1,135 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Tests that a bolt store migrates the contents of the JSON store, and deletes and lists keys.
+func TestBoltStoreMigratesJSONStore(t *testing.T) {
+	var encodedPairs = `{"key1":{"Field1":"test","Field2":42},"key2":{"Field1":"test2","Field2":43}}`
+	var actualValue testType1
+
+	fileName := "test-bolt"
+	defer os.Remove(fileName + ".db")
+	defer os.Remove(fileName + ".json" + migratedExtension)
+
+	err := ioutil.WriteFile(fileName+".json", []byte(encodedPairs), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write file %v", err)
+	}
+	defer os.Remove(fileName + ".json")
+
+	kvs, err := NewStore(BackendBolt, fileName)
+	if err != nil {
+		t.Fatalf("Failed to create KeyValueStore %v", err)
+	}
+
+	// The JSON store is migrated only once.
+	if _, err := os.Stat(fileName + ".json"); !os.IsNotExist(err) {
+		t.Errorf("JSON store was not renamed after migration, err:%v", err)
+	}
+
+	err = kvs.Lock(true)
+	if err != nil {
+		t.Fatalf("Failed to lock store %v", err)
+	}
+	defer kvs.Unlock()
+
+	err = kvs.Read(testKey2, &actualValue)
+	if err != nil {
+		t.Fatalf("Failed to read from store %v", err)
+	}
+
+	if actualValue != (testType1{"test2", 43}) {
+		t.Errorf("Read value %v does not match the migrated value", actualValue)
+	}
+
+	ekvs := kvs.(ExtendedKeyValueStore)
+
+	err = ekvs.Delete(testKey1)
+	if err != nil {
+		t.Fatalf("Failed to delete from store %v", err)
+	}
+
+	err = kvs.Read(testKey1, &actualValue)
+	if err != ErrKeyNotFound {
+		t.Errorf("Read of deleted key returned err:%v", err)
+	}
+
+	keys, err := ekvs.ListKeys()
+	if err != nil {
+		t.Fatalf("Failed to list keys %v", err)
+	}
+
+	if len(keys) != 1 || keys[0] != testKey2 {
+		t.Errorf("ListKeys returned %v", keys)
+	}
+
+	// Another store cannot lock the database while it is locked.
+	kvs2, _ := NewBoltStore(fileName + ".db")
+	err = kvs2.Lock(false)
+	if err != ErrStoreLocked {
+		t.Errorf("Lock of a locked store returned err:%v", err)
+	}
+}
+
+// Tests that the changes made in a bolt store transaction are committed together, or not at all.
+func TestBoltStoreUpdateIsAtomic(t *testing.T) {
+	fileName := "test-bolt-update.db"
+	defer os.Remove(fileName)
+
+	kvs, err := NewBoltStore(fileName)
+	if err != nil {
+		t.Fatalf("Failed to create KeyValueStore %v", err)
+	}
+
+	testUpdateIsAtomic(t, kvs, func() KeyValueStore {
+		kvs, _ := NewBoltStore(fileName)
+		return kvs
+	})
+}
+
+// Tests that enabling encryption on a bolt store also encrypts the migrated JSON store and its previous generation.
+func TestBoltStoreEncryptsMigratedJSONStore(t *testing.T) {
+	var encodedPair = `{"key1":{"Field1":"secret","Field2":42}}`
+
+	fileName := "test-bolt-encrypted"
+	migratedFileName := fileName + ".json" + migratedExtension
+	keyFileName := fileName + ".key"
+	defer os.Remove(fileName + ".db")
+	defer os.Remove(fileName + ".db" + lockExtension)
+	defer os.Remove(migratedFileName)
+	defer os.Remove(migratedFileName + backupExtension)
+	defer os.Remove(keyFileName)
+
+	for _, name := range []string{fileName + ".json", fileName + ".json" + backupExtension} {
+		err := ioutil.WriteFile(name, []byte(encodedPair), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write file %v", err)
+		}
+		defer os.Remove(name)
+	}
+
+	kvs, err := NewStore(BackendBolt, fileName)
+	if err != nil {
+		t.Fatalf("Failed to create KeyValueStore %v", err)
+	}
+
+	err = EnableEncryption(kvs, keyFileName)
+	if err != nil {
+		t.Fatalf("Failed to enable encryption %v", err)
+	}
+
+	for _, name := range []string{migratedFileName, migratedFileName + backupExtension} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil || strings.Contains(string(b), "secret") {
+			t.Errorf("File %v contains plaintext value: %v, err:%v", name, string(b), err)
+		}
+	}
+}
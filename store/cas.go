@@ -0,0 +1,104 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package store
+
+import (
+	"encoding/json"
+)
+
+// Represents a versioned value in a CasKeyValueStore.
+type casRecord struct {
+	Version uint64
+	Value   *json.RawMessage
+}
+
+// jsonCasStore is a reference implementation of CasKeyValueStore using a JSON file,
+// for example on a file share mounted by all hosts. Each access locks the file.
+type jsonCasStore struct {
+	kvs *jsonFileStore
+}
+
+// NewJsonCasStore creates a new jsonCasStore object, accessed as a CasKeyValueStore.
+func NewJsonCasStore(fileName string) (CasKeyValueStore, error) {
+	kvs, err := NewJsonFileStore(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsonCasStore{kvs: kvs.(*jsonFileStore)}, nil
+}
+
+// Get restores the value for the given key and returns its version.
+func (cs *jsonCasStore) Get(key string, value interface{}) (uint64, error) {
+	err := cs.kvs.LockWithTimeout(false, lockTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer cs.kvs.Unlock()
+
+	record, err := cs.read(key)
+	if err != nil {
+		return 0, err
+	}
+
+	err = json.Unmarshal(*record.Value, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return record.Version, nil
+}
+
+// CompareAndSwap saves the given value if the key is still at the given version.
+// Version zero means the key must not exist yet. Returns the new version of the key.
+func (cs *jsonCasStore) CompareAndSwap(key string, value interface{}, version uint64) (uint64, error) {
+	err := cs.kvs.Lock(true)
+	if err != nil {
+		return 0, err
+	}
+	defer cs.kvs.Unlock()
+
+	record, err := cs.read(key)
+	if err == ErrKeyNotFound {
+		record = &casRecord{}
+	} else if err != nil {
+		return 0, err
+	}
+
+	if record.Version != version {
+		return 0, ErrVersionMismatch
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return 0, err
+	}
+
+	record.Version++
+	record.Value = (*json.RawMessage)(&raw)
+
+	err = cs.kvs.Write(key, record)
+	if err != nil {
+		return 0, err
+	}
+
+	return record.Version, nil
+}
+
+// Reads the versioned value for the given key.
+func (cs *jsonCasStore) read(key string) (*casRecord, error) {
+	var record casRecord
+
+	err := cs.kvs.Read(key, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	// The file does not exist yet.
+	if record.Value == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return &record, nil
+}
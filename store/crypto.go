@@ -0,0 +1,335 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Size of encryption keys, for AES-256.
+	encryptionKeySize = 32
+
+	// Name of the field wrapping encrypted values.
+	sealedValueField = "SealedValue"
+
+	// Characters allowed between JSON tokens.
+	jsonWhitespace = " \t\r\n"
+)
+
+var (
+	// Errors returned by encrypted stores.
+	ErrEncryptionKeyNotFound = fmt.Errorf("Encryption key not found")
+	ErrValueEncrypted        = fmt.Errorf("Value is encrypted and encryption is not enabled")
+)
+
+// KeyRotator represents a persistent store that encrypts values at rest and can rotate its encryption key.
+type KeyRotator interface {
+	RotateKey() error
+}
+
+// Represents an encrypted value in persistent store.
+type sealedValue struct {
+	KeyId      string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// keyring holds the node-local keys used to encrypt values at rest.
+// Values are encrypted with the current key. Older keys are kept only to decrypt values until they are rotated.
+type keyring struct {
+	fileName     string
+	CurrentKeyId string
+	Keys         map[string][]byte
+	sync.Mutex
+}
+
+// Loads the keyring from the given key file, creating it with a new key if it does not exist.
+func loadKeyring(fileName string) (*keyring, error) {
+	kr := &keyring{
+		fileName: fileName,
+		Keys:     make(map[string][]byte),
+	}
+
+	buf, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		log.Printf("[store] Creating encryption key file %v.", fileName)
+		return kr, kr.addKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(buf, kr)
+	if err != nil {
+		return nil, err
+	}
+
+	if kr.Keys[kr.CurrentKeyId] == nil {
+		return nil, ErrEncryptionKeyNotFound
+	}
+
+	return kr, nil
+}
+
+// Generates a new key, makes it the current key and saves the keyring.
+func (kr *keyring) addKey() error {
+	key := make([]byte, encryptionKeySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return err
+	}
+
+	id := 1
+	for kr.Keys[strconv.Itoa(id)] != nil {
+		id++
+	}
+
+	kr.CurrentKeyId = strconv.Itoa(id)
+	kr.Keys[kr.CurrentKeyId] = key
+
+	return kr.save()
+}
+
+// Removes all keys except the current key and saves the keyring.
+func (kr *keyring) pruneKeys() error {
+	for id := range kr.Keys {
+		if id != kr.CurrentKeyId {
+			delete(kr.Keys, id)
+		}
+	}
+
+	return kr.save()
+}
+
+// Saves the keyring to its key file, readable only by its owner.
+func (kr *keyring) save() error {
+	buf, err := json.Marshal(kr)
+	if err != nil {
+		return err
+	}
+
+	tempName := kr.fileName + tempExtension
+	err = ioutil.WriteFile(tempName, buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempName, kr.fileName)
+}
+
+// Encrypts a raw value with the current key.
+func (kr *keyring) seal(raw json.RawMessage) (json.RawMessage, error) {
+	if kr == nil {
+		return raw, nil
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+
+	aead, err := newAEAD(kr.Keys[kr.CurrentKeyId])
+	if err != nil {
+		return nil, err
+	}
+
+	sv := sealedValue{
+		KeyId: kr.CurrentKeyId,
+		Nonce: make([]byte, aead.NonceSize()),
+	}
+
+	_, err = io.ReadFull(rand.Reader, sv.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sv.Ciphertext = aead.Seal(nil, sv.Nonce, raw, nil)
+
+	return json.Marshal(map[string]*sealedValue{sealedValueField: &sv})
+}
+
+// Decrypts a raw value. Values that are not encrypted, such as those written before encryption
+// was enabled, are returned unchanged.
+func (kr *keyring) open(raw json.RawMessage) (json.RawMessage, error) {
+	sv := getSealedValue(raw)
+	if sv == nil {
+		return raw, nil
+	}
+
+	if kr == nil {
+		return nil, ErrValueEncrypted
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+
+	key := kr.Keys[sv.KeyId]
+	if key == nil {
+		return nil, ErrEncryptionKeyNotFound
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, sv.Nonce, sv.Ciphertext, nil)
+}
+
+// Returns the encrypted value wrapped in a raw value, or nil if the value is not encrypted.
+func getSealedValue(raw json.RawMessage) *sealedValue {
+	var fields map[string]*sealedValue
+
+	// Values that do not start with the sealed value field are not decoded.
+	value := bytes.TrimLeft(raw, jsonWhitespace)
+	if !bytes.HasPrefix(value, []byte("{")) ||
+		!bytes.HasPrefix(bytes.TrimLeft(value[1:], jsonWhitespace), []byte(`"`+sealedValueField+`"`)) {
+		return nil
+	}
+
+	err := json.Unmarshal(raw, &fields)
+	if err != nil || len(fields) != 1 || fields[sealedValueField] == nil {
+		return nil
+	}
+
+	return fields[sealedValueField]
+}
+
+// Returns an authenticated cipher for the given key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// EnableEncryption encrypts the values of the given store at rest with the keys in the given node-local key file.
+// The key file is created if it does not exist. Values written before encryption was enabled are read
+// transparently, and are encrypted right away, along with those in older generations of the store.
+func EnableEncryption(kvs KeyValueStore, keyFileName string) error {
+	es, ok := kvs.(encryptedStore)
+	if !ok {
+		return fmt.Errorf("Store does not support encryption")
+	}
+
+	kr, err := loadKeyring(keyFileName)
+	if err != nil {
+		log.Printf("[store] Failed to load encryption key file %v, err:%v.", keyFileName, err)
+		return err
+	}
+
+	es.setKeyring(kr)
+
+	err = reseal(es)
+	if err != nil {
+		return err
+	}
+
+	return es.resealGenerations()
+}
+
+// Implemented by stores that support encryption at rest.
+// Older generations of a store, such as backups and migrated files, are encrypted again with its values.
+type encryptedStore interface {
+	ExtendedKeyValueStore
+	setKeyring(kr *keyring)
+	getKeyring() *keyring
+	resealGenerations() error
+}
+
+// Rotates the encryption key of a store. All values are encrypted again with a new key
+// in a single transaction. Older keys are removed from the key file only once no generation
+// of the store uses them anymore.
+func rotateKey(es encryptedStore) error {
+	kr := es.getKeyring()
+	if kr == nil {
+		return ErrValueEncrypted
+	}
+
+	kr.Lock()
+	err := kr.addKey()
+	kr.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[store] Rotating encryption key to %v.", kr.CurrentKeyId)
+
+	err = reseal(es)
+	if err != nil {
+		return err
+	}
+
+	err = es.resealGenerations()
+	if err != nil {
+		log.Printf("[store] Failed to encrypt older generations with key %v, keeping older keys, err:%v.",
+			kr.CurrentKeyId, err)
+		return err
+	}
+
+	kr.Lock()
+	defer kr.Unlock()
+
+	return kr.pruneKeys()
+}
+
+// Encrypts all values of a store again with the current key in a single transaction.
+func reseal(es encryptedStore) error {
+	keys, err := es.ListKeys()
+	if err != nil {
+		return err
+	}
+
+	err = es.Update(func(tx Tx) error {
+		for _, key := range keys {
+			var raw json.RawMessage
+
+			err := tx.Read(key, &raw)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Write(key, raw)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[store] Failed to encrypt values with key %v, err:%v.", es.getKeyring().CurrentKeyId, err)
+	}
+
+	return err
+}
+
+// Decrypts a raw value and decodes it. Encrypted values cannot be decrypted without a keyring,
+// but can still be copied as they are, for example when migrating to another backend.
+func decodeValue(kr *keyring, raw json.RawMessage, value interface{}) error {
+	plaintext, err := kr.open(raw)
+	if err == ErrValueEncrypted {
+		if rm, ok := value.(*json.RawMessage); ok {
+			*rm = append((*rm)[:0], raw...)
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plaintext, value)
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package store
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// dryRunStore is an implementation of KeyValueStore that reads from another store
+// but keeps writes in memory, so that the persisted state is never modified.
+type dryRunStore struct {
+	kvs     KeyValueStore
+	logf    func(format string, args ...interface{})
+	changes map[string]*json.RawMessage
+	sync.Mutex
+}
+
+// dryRunTx is a transaction on a dryRunStore.
+type dryRunTx struct {
+	kvs     *dryRunStore
+	changes map[string]*json.RawMessage
+}
+
+// NewDryRunStore creates a store that reads from the given store and reports writes
+// to the given log function instead of persisting them.
+func NewDryRunStore(kvs KeyValueStore, logf func(format string, args ...interface{})) KeyValueStore {
+	return &dryRunStore{
+		kvs:     kvs,
+		logf:    logf,
+		changes: make(map[string]*json.RawMessage),
+	}
+}
+
+// Read restores the value for the given key, including values written in dry-run mode.
+func (kvs *dryRunStore) Read(key string, value interface{}) error {
+	kvs.Mutex.Lock()
+	raw, ok := kvs.changes[key]
+	kvs.Mutex.Unlock()
+
+	if !ok {
+		return kvs.kvs.Read(key, value)
+	}
+
+	if raw == nil {
+		return ErrKeyNotFound
+	}
+
+	return json.Unmarshal(*raw, value)
+}
+
+// Write keeps the value for the given key in memory.
+func (kvs *dryRunStore) Write(key string, value interface{}) error {
+	raw, err := marshalRaw(value)
+	if err != nil {
+		return err
+	}
+
+	kvs.Mutex.Lock()
+	kvs.changes[key] = raw
+	kvs.Mutex.Unlock()
+
+	kvs.logf("[store] [dry-run] Skipped writing key %v.", key)
+
+	return nil
+}
+
+// Flush does nothing, since writes are never persisted.
+func (kvs *dryRunStore) Flush() error {
+	return nil
+}
+
+// Update runs fn in a transaction whose writes are kept in memory.
+func (kvs *dryRunStore) Update(fn func(tx Tx) error) error {
+	tx := &dryRunTx{
+		kvs:     kvs,
+		changes: make(map[string]*json.RawMessage),
+	}
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	kvs.Mutex.Lock()
+	for key, raw := range tx.changes {
+		kvs.changes[key] = raw
+	}
+	kvs.Mutex.Unlock()
+
+	for key := range tx.changes {
+		kvs.logf("[store] [dry-run] Skipped writing key %v.", key)
+	}
+
+	return nil
+}
+
+// Lock locks the underlying store.
+func (kvs *dryRunStore) Lock(block bool) error {
+	return kvs.kvs.Lock(block)
+}
+
+// Unlock unlocks the underlying store.
+func (kvs *dryRunStore) Unlock() error {
+	return kvs.kvs.Unlock()
+}
+
+// GetModificationTime returns the modification time of the underlying store.
+func (kvs *dryRunStore) GetModificationTime() (time.Time, error) {
+	return kvs.kvs.GetModificationTime()
+}
+
+// Watch watches the given key in the underlying store.
+func (kvs *dryRunStore) Watch(key string, stop <-chan struct{}) (<-chan struct{}, error) {
+	return kvs.kvs.Watch(key, stop)
+}
+
+// Read restores the value for the given key, including values written earlier in the transaction.
+func (tx *dryRunTx) Read(key string, value interface{}) error {
+	raw, ok := tx.changes[key]
+	if !ok {
+		return tx.kvs.Read(key, value)
+	}
+
+	if raw == nil {
+		return ErrKeyNotFound
+	}
+
+	return json.Unmarshal(*raw, value)
+}
+
+// Write keeps the value for the given key in the transaction.
+func (tx *dryRunTx) Write(key string, value interface{}) error {
+	raw, err := marshalRaw(value)
+	if err != nil {
+		return err
+	}
+
+	tx.changes[key] = raw
+
+	return nil
+}
+
+// Delete marks the given key as deleted in the transaction.
+func (tx *dryRunTx) Delete(key string) error {
+	tx.changes[key] = nil
+	return nil
+}
+
+// marshalRaw encodes a value as a raw JSON message.
+func marshalRaw(value interface{}) (*json.RawMessage, error) {
+	buffer, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := json.RawMessage(buffer)
+
+	return &raw, nil
+}
@@ -6,9 +6,11 @@ package store
 import (
 	"encoding/json"
 	"os"
-	"strconv"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/Azure/azure-container-networking/log"
 )
 
 const (
@@ -18,19 +20,33 @@ const (
 	// Extension added to the file name for lock.
 	lockExtension = ".lock"
 
-	// Maximum number of retries before failing a lock call.
+	// Extension added to the file name for the file being written.
+	tempExtension = ".tmp"
+
+	// Extension added to the file name for the previous generation.
+	backupExtension = ".bak"
+
+	// Maximum number of retries before failing a blocking lock call.
 	lockMaxRetries = 20
 
 	// Delay between lock retries.
 	lockRetryDelay = 100 * time.Millisecond
+
+	// Time to wait for a lock held by another process when blocking.
+	defaultLockTimeout = lockMaxRetries * lockRetryDelay
 )
 
 // jsonFileStore is an implementation of KeyValueStore using a local JSON file.
 type jsonFileStore struct {
-	fileName string
-	data     map[string]*json.RawMessage
-	inSync   bool
-	locked   bool
+	fileName  string
+	data      map[string]*json.RawMessage
+	inSync    bool
+	locked    bool
+	exclusive bool
+	lockFile  *os.File
+	corrupt   bool
+	restored  bool
+	keyring   *keyring
 	sync.Mutex
 }
 
@@ -53,37 +69,68 @@ func (kvs *jsonFileStore) Read(key string, value interface{}) error {
 	kvs.Mutex.Lock()
 	defer kvs.Mutex.Unlock()
 
-	// Read contents from file if memory is not in sync.
-	if !kvs.inSync {
-		// Open and parse the file if it exists.
-		file, err := os.Open(kvs.fileName)
+	err := kvs.load()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return kvs.read(key, value)
+}
+
+// Lock-free read for internal callers.
+func (kvs *jsonFileStore) read(key string, value interface{}) error {
+	raw := kvs.data[key]
+	if raw == nil {
+		return ErrKeyNotFound
+	}
+
+	// Upgrade the value to the current schema version.
+	version := kvs.getSchemaVersion(key)
+	if current := GetSchemaVersion(key); version < current {
+		migrated, err := migrateValue(kvs.keyring, key, *raw, version)
 		if err != nil {
-			if os.IsNotExist(err) {
-				return nil
-			}
 			return err
 		}
 
-		// Decode to raw JSON messages.
-		err = json.NewDecoder(file).Decode(&kvs.data)
-		if err != nil {
+		raw = &migrated
+		kvs.data[key] = raw
+		kvs.setSchemaVersion(key, current)
+	}
+
+	return decodeValue(kvs.keyring, *raw, value)
+}
+
+// Lock-free load for internal callers.
+// Reads contents from file if memory is not in sync.
+func (kvs *jsonFileStore) load() error {
+	if kvs.inSync {
+		return nil
+	}
+
+	// Open and parse the file if it exists.
+	data, err := readJsonFile(kvs.fileName)
+	if err != nil {
+		if _, ok := err.(*os.PathError); ok {
 			return err
 		}
 
-		err = file.Close()
+		// The file is corrupt. Fall back to the previous generation.
+		backupName := kvs.fileName + backupExtension
+		data, err = kvs.readBackup(backupName, err)
 		if err != nil {
 			return err
 		}
-
-		kvs.inSync = true
 	}
 
-	raw := kvs.data[key]
-	if raw == nil {
-		return ErrKeyNotFound
+	for k, v := range data {
+		kvs.data[k] = v
 	}
+	kvs.inSync = true
 
-	return json.Unmarshal(*raw, value)
+	return nil
 }
 
 // Write saves the given key value pair to persistent store.
@@ -91,86 +138,416 @@ func (kvs *jsonFileStore) Write(key string, value interface{}) error {
 	kvs.Mutex.Lock()
 	defer kvs.Mutex.Unlock()
 
+	if kvs.locked && !kvs.exclusive {
+		return ErrStoreNotLockedExclusive
+	}
+
 	var raw json.RawMessage
 	raw, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
+	raw, err = kvs.keyring.seal(raw)
+	if err != nil {
+		return err
+	}
+
 	kvs.data[key] = &raw
+	kvs.setSchemaVersion(key, GetSchemaVersion(key))
+
+	return kvs.flush()
+}
+
+// Delete removes the given key from persistent store.
+func (kvs *jsonFileStore) Delete(key string) error {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	if kvs.locked && !kvs.exclusive {
+		return ErrStoreNotLockedExclusive
+	}
+
+	err := kvs.load()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	delete(kvs.data, key)
+	kvs.setSchemaVersion(key, 0)
 
 	return kvs.flush()
 }
 
+// ListKeys returns the keys in persistent store.
+func (kvs *jsonFileStore) ListKeys() ([]string, error) {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	err := kvs.load()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range kvs.data {
+		if key != schemaVersionsKey {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Update runs the given function in a transaction. Changes made in the transaction are saved
+// together when the function returns nil, and discarded when it returns an error.
+func (kvs *jsonFileStore) Update(fn func(tx Tx) error) error {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	if kvs.locked && !kvs.exclusive {
+		return ErrStoreNotLockedExclusive
+	}
+
+	err := kvs.load()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tx := &jsonTx{
+		kvs:     kvs,
+		changes: make(map[string]*json.RawMessage),
+	}
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	if len(tx.changes) == 0 {
+		return nil
+	}
+
+	// Apply the changes, keeping the previous values to restore if they cannot be saved.
+	previous := make(map[string]*json.RawMessage)
+	previousVersions := kvs.data[schemaVersionsKey]
+
+	for key, raw := range tx.changes {
+		previous[key] = kvs.data[key]
+
+		if raw == nil {
+			delete(kvs.data, key)
+			kvs.setSchemaVersion(key, 0)
+		} else {
+			kvs.data[key] = raw
+			kvs.setSchemaVersion(key, GetSchemaVersion(key))
+		}
+	}
+
+	err = kvs.flush()
+	if err != nil {
+		previous[schemaVersionsKey] = previousVersions
+
+		for key, raw := range previous {
+			if raw == nil {
+				delete(kvs.data, key)
+			} else {
+				kvs.data[key] = raw
+			}
+		}
+	}
+
+	return err
+}
+
+// jsonTx is a transaction on a jsonFileStore. Changes are kept in memory until the transaction commits.
+type jsonTx struct {
+	kvs     *jsonFileStore
+	changes map[string]*json.RawMessage
+}
+
+// Read restores the value for the given key, including changes made in the transaction.
+func (tx *jsonTx) Read(key string, value interface{}) error {
+	raw, ok := tx.changes[key]
+	if !ok {
+		return tx.kvs.read(key, value)
+	}
+
+	if raw == nil {
+		return ErrKeyNotFound
+	}
+
+	return decodeValue(tx.kvs.keyring, *raw, value)
+}
+
+// Write saves the given key value pair when the transaction commits.
+func (tx *jsonTx) Write(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	raw, err = tx.kvs.keyring.seal(raw)
+	if err != nil {
+		return err
+	}
+
+	rawMessage := json.RawMessage(raw)
+	tx.changes[key] = &rawMessage
+
+	return nil
+}
+
+// Delete removes the given key when the transaction commits.
+func (tx *jsonTx) Delete(key string) error {
+	tx.changes[key] = nil
+	return nil
+}
+
+// RotateKey encrypts all values again with a new key, and removes older keys from the key file.
+func (kvs *jsonFileStore) RotateKey() error {
+	return rotateKey(kvs)
+}
+
+// Replaces the previous generation of the store file, which may hold values that are not encrypted
+// or are encrypted with older keys, with the current one.
+func (kvs *jsonFileStore) resealGenerations() error {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	if kvs.locked && !kvs.exclusive {
+		return ErrStoreNotLockedExclusive
+	}
+
+	err := kvs.load()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return kvs.flush()
+}
+
+// Sets the keyring used to encrypt values at rest.
+func (kvs *jsonFileStore) setKeyring(kr *keyring) {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	kvs.keyring = kr
+}
+
+// Returns the keyring used to encrypt values at rest.
+func (kvs *jsonFileStore) getKeyring() *keyring {
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	return kvs.keyring
+}
+
+// Returns the schema version of the value of the given key.
+func (kvs *jsonFileStore) getSchemaVersion(key string) int {
+	versions := make(map[string]int)
+
+	if raw := kvs.data[schemaVersionsKey]; raw != nil {
+		json.Unmarshal(*raw, &versions)
+	}
+
+	return versions[key]
+}
+
+// Records the schema version of the value of the given key.
+func (kvs *jsonFileStore) setSchemaVersion(key string, version int) {
+	versions := make(map[string]int)
+
+	if raw := kvs.data[schemaVersionsKey]; raw != nil {
+		json.Unmarshal(*raw, &versions)
+	}
+
+	if versions[key] == version {
+		return
+	}
+
+	// Values without migrations are not recorded.
+	if version == 0 {
+		delete(versions, key)
+	} else {
+		versions[key] = version
+	}
+
+	if len(versions) == 0 {
+		delete(kvs.data, schemaVersionsKey)
+		return
+	}
+
+	raw, err := json.Marshal(versions)
+	if err == nil {
+		rawMessage := json.RawMessage(raw)
+		kvs.data[schemaVersionsKey] = &rawMessage
+	}
+}
+
 // Flush commits in-memory state to persistent store.
 func (kvs *jsonFileStore) Flush() error {
 	kvs.Mutex.Lock()
 	defer kvs.Mutex.Unlock()
 
+	if kvs.locked && !kvs.exclusive {
+		return ErrStoreNotLockedExclusive
+	}
+
 	return kvs.flush()
 }
 
 // Lock-free flush for internal callers.
+// The contents are written to a temporary file, which replaces the store file only after it is synced to disk.
+// The store file being replaced is kept as the previous generation.
 func (kvs *jsonFileStore) flush() error {
-	file, err := os.Create(kvs.fileName)
+	buf, err := json.MarshalIndent(&kvs.data, "", "\t")
 	if err != nil {
 		return err
 	}
 
-	buf, err := json.MarshalIndent(&kvs.data, "", "\t")
+	tempName := kvs.fileName + tempExtension
+	file, err := os.Create(tempName)
 	if err != nil {
 		return err
 	}
 
 	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tempName)
+		return err
+	}
+
+	err = file.Close()
 	if err != nil {
+		os.Remove(tempName)
 		return err
 	}
 
-	return file.Close()
+	// Keep the store file as the previous generation, unless it is corrupt.
+	if !kvs.corrupt {
+		backupName := kvs.fileName + backupExtension
+		os.Remove(backupName)
+
+		err = os.Link(kvs.fileName, backupName)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[store] Failed to keep the previous generation of %v, err:%v.", kvs.fileName, err)
+		}
+	}
+
+	err = os.Rename(tempName, kvs.fileName)
+	if err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	kvs.corrupt = false
+
+	// Persist the rename. Directories cannot be synced on all platforms.
+	if dir, err := os.Open(filepath.Dir(kvs.fileName)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
 }
 
-// Lock locks the store for exclusive access.
-func (kvs *jsonFileStore) Lock(block bool) error {
+// RestoredFromBackup returns whether the store file was corrupt and its contents were restored
+// from the previous generation.
+func (kvs *jsonFileStore) RestoredFromBackup() bool {
 	kvs.Mutex.Lock()
 	defer kvs.Mutex.Unlock()
 
-	if kvs.locked {
-		return ErrStoreLocked
+	return kvs.restored
+}
+
+// Reads the previous generation of a corrupt store file.
+func (kvs *jsonFileStore) readBackup(backupName string, parseErr error) (map[string]*json.RawMessage, error) {
+	data, err := readJsonFile(backupName)
+	if err != nil {
+		log.Printf("[store] Failed to parse %v, err:%v. No previous generation is available, err:%v.",
+			kvs.fileName, parseErr, err)
+		return nil, parseErr
 	}
 
-	var lockFile *os.File
-	var err error
-	lockName := kvs.fileName + lockExtension
-	lockPerm := os.FileMode(0664) + os.FileMode(os.ModeExclusive)
+	log.Printf("[store] Failed to parse %v, err:%v. Restored the previous generation from %v.",
+		kvs.fileName, parseErr, backupName)
 
-	// Try to acquire the lock file.
-	for i := 0; ; i++ {
-		lockFile, err = os.OpenFile(lockName, os.O_CREATE|os.O_EXCL|os.O_RDWR, lockPerm)
-		if err == nil {
-			break
-		}
+	// Do not replace the previous generation with the corrupt file.
+	kvs.corrupt = true
+	kvs.restored = true
 
-		if !block || i == lockMaxRetries {
-			return ErrStoreLocked
-		}
+	return data, nil
+}
 
-		time.Sleep(lockRetryDelay)
+// Reads and decodes a JSON file to raw JSON messages.
+func readJsonFile(fileName string) (map[string]*json.RawMessage, error) {
+	data := make(map[string]*json.RawMessage)
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
 
-	// Write the process ID for easy identification.
-	_, err = lockFile.WriteString(strconv.Itoa(os.Getpid()))
+	err = json.NewDecoder(file).Decode(&data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = lockFile.Close()
+	return data, nil
+}
+
+// Lock locks the store for exclusive access.
+func (kvs *jsonFileStore) Lock(block bool) error {
+	var timeout time.Duration
+	if block {
+		timeout = lockTimeout
+	}
+
+	return kvs.LockWithTimeout(true, timeout)
+}
+
+// LockWithTimeout locks the store for shared or exclusive access, waiting up to the given timeout
+// for other processes holding a conflicting lock. The lock is released if the process exits.
+func (kvs *jsonFileStore) LockWithTimeout(exclusive bool, timeout time.Duration) error {
+	kvs.Mutex.Lock()
+	locked := kvs.locked
+	kvs.Mutex.Unlock()
+
+	if locked {
+		return ErrStoreLocked
+	}
+
+	// The store is not accessed while waiting, so other goroutines are not blocked on it.
+	lockFile, err := lockStoreFile(kvs.fileName+lockExtension, exclusive, timeout)
 	if err != nil {
 		return err
 	}
 
+	kvs.Mutex.Lock()
+	defer kvs.Mutex.Unlock()
+
+	// Another goroutine may have locked the store in the meantime.
+	if kvs.locked {
+		unlockStoreFile(lockFile, exclusive)
+		return ErrStoreLocked
+	}
+
+	kvs.lockFile = lockFile
+	kvs.exclusive = exclusive
 	kvs.locked = true
 
+	// The previous holder may have changed the file.
+	kvs.inSync = false
+
 	return nil
 }
 
@@ -183,17 +560,47 @@ func (kvs *jsonFileStore) Unlock() error {
 		return ErrStoreNotLocked
 	}
 
-	err := os.Remove(kvs.fileName + lockExtension)
+	err := unlockStoreFile(kvs.lockFile, kvs.exclusive)
 	if err != nil {
 		return err
 	}
 
+	kvs.lockFile = nil
 	kvs.inSync = false
 	kvs.locked = false
 
 	return nil
 }
 
+// Watch returns a channel that receives a notification each time the value of the given key changes
+// in persistent store, for example when it is written by another process. The next read after a
+// notification returns the new value. The channel is closed when the stop channel is closed.
+func (kvs *jsonFileStore) Watch(key string, stop <-chan struct{}) (<-chan struct{}, error) {
+	read := func() (json.RawMessage, error) {
+		data, err := readJsonFile(kvs.fileName)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if data[key] == nil {
+			return nil, nil
+		}
+
+		return openWatchedValue(kvs.getKeyring(), *data[key]), nil
+	}
+
+	changed := func() {
+		kvs.Mutex.Lock()
+		kvs.inSync = false
+		kvs.Mutex.Unlock()
+	}
+
+	return watchKey(kvs.fileName, key, read, changed, stop)
+}
+
 // GetModificationTime returns the modification time of the persistent store.
 func (kvs *jsonFileStore) GetModificationTime() (time.Time, error) {
 	info, err := os.Stat(kvs.fileName)
@@ -4,9 +4,14 @@
 package store
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -205,4 +210,523 @@ func TestLockingStoreGivesExclusiveAccess(t *testing.T) {
 
 	// Cleanup.
 	os.Remove(testFileName)
+	os.Remove(testFileName + lockExtension)
+}
+
+// Tests that shared locks exclude only exclusive locks, and that a lock left behind by a dead process is recovered.
+func TestSharedLocksAndStaleLockFiles(t *testing.T) {
+	defer os.Remove(testFileName + lockExtension)
+
+	// Leave a lock file behind as a killed process would.
+	err := ioutil.WriteFile(testFileName+lockExtension, []byte("999999"), 0664)
+	if err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+
+	kvs, _ := NewJsonFileStore(testFileName)
+	kvs2, _ := NewJsonFileStore(testFileName)
+	kvs3, _ := NewJsonFileStore(testFileName)
+
+	// The stale lock file does not prevent locking.
+	err = kvs.(TimedLocker).LockWithTimeout(false, 0)
+	if err != nil {
+		t.Fatalf("Failed to lock store with a stale lock file: %v", err)
+	}
+
+	err = kvs2.(TimedLocker).LockWithTimeout(false, 0)
+	if err != nil {
+		t.Errorf("Failed to lock store shared by another reader: %v", err)
+	}
+
+	err = kvs3.(TimedLocker).LockWithTimeout(true, lockRetryDelay)
+	if err != ErrStoreLocked {
+		t.Errorf("Locking a store shared by readers for exclusive access returned err:%v", err)
+	}
+
+	err = kvs.Write(testKey1, &testType1{"test", 42})
+	if err != ErrStoreNotLockedExclusive {
+		t.Errorf("Writing to a store locked for shared access returned err:%v", err)
+	}
+
+	kvs.Unlock()
+	kvs2.Unlock()
+
+	err = kvs3.Lock(false)
+	if err != nil {
+		t.Fatalf("Failed to lock unlocked store: %v", err)
+	}
+
+	// The exclusive holder is recorded in the lock file.
+	b, _ := ioutil.ReadFile(testFileName + lockExtension)
+	if string(b) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Lock file records holder %v", string(b))
+	}
+
+	kvs3.Unlock()
+}
+
+// Tests that a store waiting for a lock held by another process can still be used by other goroutines.
+func TestWaitingForLockDoesNotBlockStore(t *testing.T) {
+	defer os.Remove(testFileName + lockExtension)
+
+	kvs, _ := NewJsonFileStore(testFileName)
+	kvs2, _ := NewJsonFileStore(testFileName)
+
+	err := kvs.Lock(false)
+	if err != nil {
+		t.Fatalf("Failed to lock store: %v", err)
+	}
+	defer kvs.Unlock()
+
+	waiting := make(chan error)
+	go func() {
+		waiting <- kvs2.(TimedLocker).LockWithTimeout(true, 5*lockRetryDelay)
+	}()
+
+	// Give the goroutine time to start waiting.
+	time.Sleep(lockRetryDelay)
+
+	start := time.Now()
+	kvs2.GetModificationTime()
+	kvs2.Read(testKey1, &testType1{})
+	if time.Since(start) >= 2*lockRetryDelay {
+		t.Errorf("Store was blocked while waiting for a lock")
+	}
+
+	err = <-waiting
+	if err != ErrStoreLocked {
+		t.Errorf("Locking a store locked by another holder returned err:%v", err)
+	}
+}
+
+// Tests that values are only swapped when their version matches.
+func TestCompareAndSwapRejectsStaleVersions(t *testing.T) {
+	var actualValue testType1
+	value1 := testType1{"test1", 1}
+	value2 := testType1{"test2", 2}
+
+	defer os.Remove(testFileName)
+	defer os.Remove(testFileName + backupExtension)
+	defer os.Remove(testFileName + lockExtension)
+
+	// Create two stores backed by the same file.
+	cs, err := NewJsonCasStore(testFileName)
+	if err != nil {
+		t.Fatalf("Failed to create CasKeyValueStore %v", err)
+	}
+
+	cs2, err := NewJsonCasStore(testFileName)
+	if err != nil {
+		t.Fatalf("Failed to create second CasKeyValueStore %v", err)
+	}
+
+	// Read a key that does not exist.
+	_, err = cs.Get(testKey1, &actualValue)
+	if err != ErrKeyNotFound {
+		t.Fatalf("Get returned %v instead of %v", err, ErrKeyNotFound)
+	}
+
+	// Create the key.
+	version, err := cs.CompareAndSwap(testKey1, &value1, 0)
+	if err != nil || version != 1 {
+		t.Fatalf("Failed to create key, version:%v err:%v", version, err)
+	}
+
+	// Read the key through the second store.
+	version, err = cs2.Get(testKey1, &actualValue)
+	if err != nil || version != 1 || actualValue != value1 {
+		t.Fatalf("Get returned %+v version:%v err:%v", actualValue, version, err)
+	}
+
+	// Update the key through the second store.
+	version, err = cs2.CompareAndSwap(testKey1, &value2, version)
+	if err != nil || version != 2 {
+		t.Fatalf("Failed to update key, version:%v err:%v", version, err)
+	}
+
+	// An update based on the stale version should fail.
+	_, err = cs.CompareAndSwap(testKey1, &value1, 1)
+	if err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap returned %v instead of %v", err, ErrVersionMismatch)
+	}
+
+	version, err = cs.Get(testKey1, &actualValue)
+	if err != nil || version != 2 || actualValue != value2 {
+		t.Errorf("Get returned %+v version:%v err:%v", actualValue, version, err)
+	}
+}
+
+// Tests that the previous generation is restored when the store file is corrupt.
+func TestPreviousGenerationIsRestoredFromCorruptFile(t *testing.T) {
+	var actualValue testType1
+	value1 := testType1{"test1", 1}
+	value2 := testType1{"test2", 2}
+
+	defer os.Remove(testFileName)
+	defer os.Remove(testFileName + backupExtension)
+
+	kvs, err := NewJsonFileStore(testFileName)
+	if err != nil {
+		t.Fatalf("Failed to create KeyValueStore %v", err)
+	}
+
+	// Write two generations.
+	err = kvs.Write(testKey1, &value1)
+	if err != nil {
+		t.Fatalf("Failed to write to store %v", err)
+	}
+
+	err = kvs.Write(testKey1, &value2)
+	if err != nil {
+		t.Fatalf("Failed to write to store %v", err)
+	}
+
+	// Truncate the store file as if the host crashed while writing it.
+	err = os.Truncate(testFileName, 10)
+	if err != nil {
+		t.Fatalf("Failed to truncate file %v", err)
+	}
+
+	// The previous generation should be restored.
+	kvs2, err := NewJsonFileStore(testFileName)
+	if err != nil {
+		t.Fatalf("Failed to create second KeyValueStore %v", err)
+	}
+
+	err = kvs2.Read(testKey1, &actualValue)
+	if err != nil || actualValue != value1 {
+		t.Fatalf("Read returned %+v err:%v instead of %+v", actualValue, err, value1)
+	}
+
+	if RestoredFromBackup(kvs) || !RestoredFromBackup(kvs2) {
+		t.Errorf("RestoredFromBackup returned %v and %v", RestoredFromBackup(kvs), RestoredFromBackup(kvs2))
+	}
+
+	// The next write should replace the corrupt file, but keep the previous generation.
+	err = kvs2.Write(testKey2, &value2)
+	if err != nil {
+		t.Fatalf("Failed to write to store %v", err)
+	}
+
+	kvs3, _ := NewJsonFileStore(testFileName + backupExtension)
+	err = kvs3.Read(testKey1, &actualValue)
+	if err != nil || actualValue != value1 {
+		t.Errorf("Previous generation contains %+v err:%v instead of %+v", actualValue, err, value1)
+	}
+}
+
+// Tests that values are migrated to the current schema version when read.
+func TestValuesAreMigratedToCurrentSchemaVersion(t *testing.T) {
+	var encodedPair = `{"migratedKey":{"Name":"test","Field2":42}}`
+	var expectedValue = testType1{"test", 42}
+	var actualValue testType1
+
+	// Schema version 1 renamed Name to Field1.
+	RegisterMigration("migratedKey", 0, func(raw json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(strings.Replace(string(raw), `"Name"`, `"Field1"`, 1)), nil
+	})
+
+	err := ioutil.WriteFile(testFileName, []byte(encodedPair), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write file %v", err)
+	}
+	defer os.Remove(testFileName)
+	defer os.Remove(testFileName + backupExtension)
+
+	kvs, err := NewJsonFileStore(testFileName)
+	if err != nil {
+		t.Fatalf("Failed to create KeyValueStore %v", err)
+	}
+
+	err = kvs.Read("migratedKey", &actualValue)
+	if err != nil || actualValue != expectedValue {
+		t.Fatalf("Read returned %+v err:%v instead of %+v", actualValue, err, expectedValue)
+	}
+
+	// The schema version should be recorded when the store is written.
+	err = kvs.Flush()
+	if err != nil {
+		t.Fatalf("Failed to flush store %v", err)
+	}
+
+	b, _ := ioutil.ReadFile(testFileName)
+	if !strings.Contains(string(b), `"migratedKey": 1`) {
+		t.Errorf("Schema version is not recorded in %s", b)
+	}
+}
+
+// Tests that the changes made in a transaction are saved together, or not at all.
+func TestUpdateIsAtomic(t *testing.T) {
+	defer os.Remove(testFileName)
+	defer os.Remove(testFileName + backupExtension)
+
+	kvs, err := NewJsonFileStore(testFileName)
+	if err != nil {
+		t.Fatalf("Failed to create KeyValueStore %v", err)
+	}
+
+	testUpdateIsAtomic(t, kvs, func() KeyValueStore {
+		kvs, _ := NewJsonFileStore(testFileName)
+		return kvs
+	})
+}
+
+// Tests transactions on a store. The reopen function returns a new store backed by the same file.
+func testUpdateIsAtomic(t *testing.T, kvs KeyValueStore, reopen func() KeyValueStore) {
+	var actualValue testType1
+	value1 := testType1{"test1", 1}
+	value2 := testType1{"test2", 2}
+
+	err := kvs.Write(testKey1, &value1)
+	if err != nil {
+		t.Fatalf("Failed to write to store %v", err)
+	}
+
+	// Changes are discarded if the transaction fails.
+	errFailed := fmt.Errorf("failed")
+	err = kvs.Update(func(tx Tx) error {
+		tx.Write(testKey2, &value2)
+		tx.Delete(testKey1)
+
+		// Changes are visible in the transaction.
+		if err := tx.Read(testKey1, &actualValue); err != ErrKeyNotFound {
+			t.Errorf("Read of key deleted in transaction returned err:%v", err)
+		}
+
+		return errFailed
+	})
+	if err != errFailed {
+		t.Errorf("Failed transaction returned err:%v", err)
+	}
+
+	if err := kvs.Read(testKey2, &actualValue); err != ErrKeyNotFound {
+		t.Errorf("Key written by failed transaction was saved, err:%v", err)
+	}
+
+	// Changes are saved together if the transaction succeeds.
+	err = kvs.Update(func(tx Tx) error {
+		err := tx.Read(testKey1, &actualValue)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Write(testKey2, &actualValue)
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(testKey1)
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed %v", err)
+	}
+
+	kvs2 := reopen()
+
+	if err := kvs2.Read(testKey1, &actualValue); err != ErrKeyNotFound {
+		t.Errorf("Key deleted by transaction was not removed, err:%v", err)
+	}
+
+	err = kvs2.Read(testKey2, &actualValue)
+	if err != nil || actualValue != value1 {
+		t.Errorf("Key written by transaction read %v, err:%v", actualValue, err)
+	}
+}
+
+// Tests that values are encrypted at rest, that plaintext values are read transparently, and that keys are rotated.
+func TestValuesAreEncryptedAtRest(t *testing.T) {
+	var encodedPair = `{"key1":{"Field1":"secret","Field2":42}}`
+	var expectedValue = testType1{"secret", 42}
+	var actualValue testType1
+	keyFileName := "test.key"
+
+	defer os.Remove(testFileName)
+	defer os.Remove(testFileName + backupExtension)
+	defer os.Remove(keyFileName)
+
+	err := ioutil.WriteFile(testFileName, []byte(encodedPair), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write file %v", err)
+	}
+
+	kvs, _ := NewJsonFileStore(testFileName)
+
+	// Plaintext values are encrypted when encryption is enabled.
+	err = EnableEncryption(kvs, keyFileName)
+	if err != nil {
+		t.Fatalf("Failed to enable encryption %v", err)
+	}
+
+	for _, fileName := range []string{testFileName, testFileName + backupExtension} {
+		b, _ := ioutil.ReadFile(fileName)
+		if strings.Contains(string(b), "secret") {
+			t.Errorf("File %v contains plaintext value: %v", fileName, string(b))
+		}
+	}
+
+	err = kvs.Read(testKey1, &actualValue)
+	if err != nil || actualValue != expectedValue {
+		t.Errorf("Read value %v, err:%v", actualValue, err)
+	}
+
+	// Encrypted values cannot be read without the key.
+	kvs2, _ := NewJsonFileStore(testFileName)
+	err = kvs2.Read(testKey1, &actualValue)
+	if err != ErrValueEncrypted {
+		t.Errorf("Read of encrypted value without the key returned err:%v", err)
+	}
+
+	// Rotating the key removes the previous key from the key file.
+	err = kvs.(KeyRotator).RotateKey()
+	if err != nil {
+		t.Fatalf("Failed to rotate key %v", err)
+	}
+
+	kr, err := loadKeyring(keyFileName)
+	if err != nil || len(kr.Keys) != 1 || kr.CurrentKeyId != "2" {
+		t.Errorf("Key file has keys %v after rotation, err:%v", kr, err)
+	}
+
+	// The previous generation does not use the removed key.
+	b, _ := ioutil.ReadFile(testFileName + backupExtension)
+	if strings.Contains(string(b), `"KeyId":"1"`) {
+		t.Errorf("Previous generation uses a removed key: %v", string(b))
+	}
+
+	kvs3, _ := NewJsonFileStore(testFileName)
+	err = EnableEncryption(kvs3, keyFileName)
+	if err != nil {
+		t.Fatalf("Failed to enable encryption %v", err)
+	}
+
+	actualValue = testType1{}
+	err = kvs3.Read(testKey1, &actualValue)
+	if err != nil || actualValue != expectedValue {
+		t.Errorf("Read value %v after rotation, err:%v", actualValue, err)
+	}
+}
+
+// Tests that watching a key notifies changes of its value written by another store.
+func TestWatchNotifiesChangesByOtherStores(t *testing.T) {
+	var actualValue testType1
+	value1 := testType1{"test1", 1}
+	value2 := testType1{"test2", 2}
+
+	keyFileName := "test.key"
+
+	defer os.Remove(testFileName)
+	defer os.Remove(testFileName + backupExtension)
+	defer os.Remove(keyFileName)
+
+	kvs, _ := NewJsonFileStore(testFileName)
+	kvs2, _ := NewJsonFileStore(testFileName)
+
+	// Values are compared after decryption.
+	for _, s := range []KeyValueStore{kvs, kvs2} {
+		err := EnableEncryption(s, keyFileName)
+		if err != nil {
+			t.Fatalf("Failed to enable encryption %v", err)
+		}
+	}
+
+	err := kvs.Write(testKey1, &value1)
+	if err != nil {
+		t.Fatalf("Failed to write to store %v", err)
+	}
+
+	kvs.Read(testKey1, &actualValue)
+
+	stop := make(chan struct{})
+	changes, err := kvs.Watch(testKey1, stop)
+	if err != nil {
+		t.Fatalf("Failed to watch store %v", err)
+	}
+
+	// Changes to other keys and unchanged values sealed again are not notified.
+	kvs2.Read(testKey1, &actualValue)
+	kvs2.Write(testKey2, &value2)
+	kvs2.Write(testKey1, &value1)
+
+	select {
+	case <-changes:
+		t.Errorf("Change of another key or unchanged value was notified")
+	case <-time.After(2 * time.Second):
+	}
+
+	kvs2.Write(testKey1, &value2)
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Change was not notified")
+	}
+
+	// The new value is read after the notification.
+	err = kvs.Read(testKey1, &actualValue)
+	if err != nil || actualValue != value2 {
+		t.Errorf("Read value %v after change, err:%v", actualValue, err)
+	}
+
+	close(stop)
+
+	select {
+	case _, ok := <-changes:
+		if ok {
+			t.Errorf("Unexpected notification after stop")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Watch did not stop")
+	}
+}
+
+// Tests that a dry-run store reads the underlying store but never writes to it.
+func TestDryRunStoreDoesNotWrite(t *testing.T) {
+	var value testType1
+
+	defer os.Remove(testFileName)
+
+	kvs, err := NewJsonFileStore(testFileName)
+	if err != nil {
+		t.Fatalf("Failed to create KeyValueStore %v\n", err)
+	}
+
+	err = kvs.Write(testKey1, &testType1{"test", 1})
+	if err != nil {
+		t.Fatalf("Failed to write to store %v", err)
+	}
+
+	dryRunKvs := NewDryRunStore(kvs, t.Logf)
+
+	err = dryRunKvs.Update(func(tx Tx) error {
+		err := tx.Write(testKey1, &testType1{"test", 2})
+		if err != nil {
+			return err
+		}
+		return tx.Write(testKey2, &testType1{"test", 3})
+	})
+	if err != nil {
+		t.Fatalf("Failed to update dry-run store %v", err)
+	}
+
+	// Values written in dry-run mode are read back from memory.
+	err = dryRunKvs.Read(testKey1, &value)
+	if err != nil || value.Field2 != 2 {
+		t.Errorf("Dry-run store returned %+v err:%v, expected the value written in dry-run mode.", value, err)
+	}
+
+	// The underlying store is not modified.
+	kvs, err = NewJsonFileStore(testFileName)
+	if err != nil {
+		t.Fatalf("Failed to create KeyValueStore %v\n", err)
+	}
+
+	err = kvs.Read(testKey1, &value)
+	if err != nil || value.Field2 != 1 {
+		t.Errorf("Store returned %+v err:%v after a dry-run update.", value, err)
+	}
+
+	err = kvs.Read(testKey2, &value)
+	if err != ErrKeyNotFound {
+		t.Errorf("Store returned %+v err:%v for a key written in dry-run mode.", value, err)
+	}
 }
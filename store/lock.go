@@ -0,0 +1,107 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// Time to wait for a lock held by another process when blocking.
+var lockTimeout = defaultLockTimeout
+
+// SetLockTimeout sets the time blocking lock calls wait for a lock held by another process.
+// It is called before stores are created.
+func SetLockTimeout(timeout time.Duration) {
+	lockTimeout = timeout
+}
+
+// Opens and locks a lock file. The holder of an exclusive lock records its process ID in the file.
+func lockStoreFile(lockName string, exclusive bool, timeout time.Duration) (*os.File, error) {
+	file, err := os.OpenFile(lockName, os.O_CREATE|os.O_RDWR, 0664)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file, exclusive, timeout)
+	if err == nil && exclusive {
+		err = writeLockHolder(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Unlocks and closes a lock file. The lock file is not removed, as another process may be waiting on it.
+func unlockStoreFile(file *os.File, exclusive bool) error {
+	if exclusive {
+		file.Truncate(0)
+	}
+
+	err := unlockFile(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Locks a file for shared or exclusive access, waiting up to the given timeout for other processes
+// holding a conflicting lock. The lock is released by the kernel when the file is closed or the process exits.
+func lockFile(file *os.File, exclusive bool, timeout time.Duration) error {
+	retries := lockRetries(timeout)
+
+	for i := 0; ; i++ {
+		err := tryLockFile(file, exclusive)
+		if err != ErrStoreLocked {
+			return err
+		}
+
+		// Log the holder once per lock call.
+		if i == 0 {
+			log.Printf("[store] %v is locked by process %v, timeout:%v.", file.Name(), readLockHolder(file), timeout)
+		}
+
+		if i >= retries {
+			return ErrStoreLocked
+		}
+
+		time.Sleep(lockRetryDelay)
+	}
+}
+
+// Returns the number of lock retries that fit in the given timeout.
+func lockRetries(timeout time.Duration) int {
+	return int(timeout / lockRetryDelay)
+}
+
+// Records the current process as the exclusive holder of a locked file.
+func writeLockHolder(file *os.File) error {
+	err := file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	return err
+}
+
+// Returns the process ID of the exclusive holder of a locked file.
+func readLockHolder(file *os.File) string {
+	buf, err := ioutil.ReadFile(file.Name())
+	if err != nil || len(buf) == 0 {
+		return "unknown"
+	}
+
+	return strings.TrimSpace(string(buf))
+}
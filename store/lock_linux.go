@@ -0,0 +1,32 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build linux
+
+package store
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tries to lock a file without blocking.
+func tryLockFile(file *os.File, exclusive bool) error {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+
+	err := unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return ErrStoreLocked
+	}
+
+	return err
+}
+
+// Unlocks a locked file.
+func unlockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_UN)
+}
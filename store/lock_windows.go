@@ -0,0 +1,40 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build windows
+
+package store
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// Offset of the locked byte range. Locks are mandatory on Windows, so the range
+	// lies beyond the process ID of the holder to keep it readable by other processes.
+	lockRangeOffset = 0x7FFFFFFF
+)
+
+// Tries to lock a file without blocking.
+func tryLockFile(file *os.File, exclusive bool) error {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+
+	ol := &windows.Overlapped{Offset: lockRangeOffset}
+	err := windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, 1, 0, ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrStoreLocked
+	}
+
+	return err
+}
+
+// Unlocks a locked file.
+func unlockFile(file *os.File) error {
+	ol := &windows.Overlapped{Offset: lockRangeOffset}
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, ol)
+}
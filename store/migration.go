@@ -0,0 +1,97 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package store
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+const (
+	// Key under which stores record the schema version of each value.
+	schemaVersionsKey = "SchemaVersions"
+)
+
+// MigrationFunc upgrades the encoding of a value from one schema version to the next.
+// Values written before schema versions were recorded have version zero, so migrations
+// from version zero must accept values already in the newer schema.
+type MigrationFunc func(raw json.RawMessage) (json.RawMessage, error)
+
+// Registry of migrations by key and the schema version they upgrade from.
+var migrations = struct {
+	funcs map[string]map[int]MigrationFunc
+	sync.Mutex
+}{
+	funcs: make(map[string]map[int]MigrationFunc),
+}
+
+// RegisterMigration registers the migration of values of the given key from the given schema version to the next.
+// The current schema version of a key is the number of consecutive migrations registered from version zero.
+func RegisterMigration(key string, version int, migrate MigrationFunc) {
+	migrations.Lock()
+	defer migrations.Unlock()
+
+	if migrations.funcs[key] == nil {
+		migrations.funcs[key] = make(map[int]MigrationFunc)
+	}
+
+	migrations.funcs[key][version] = migrate
+}
+
+// GetSchemaVersion returns the current schema version of values of the given key.
+func GetSchemaVersion(key string) int {
+	migrations.Lock()
+	defer migrations.Unlock()
+
+	version := 0
+	for migrations.funcs[key][version] != nil {
+		version++
+	}
+
+	return version
+}
+
+// Upgrades the encoding of a value of the given key from the given schema version to the current one.
+func migrate(key string, raw json.RawMessage, version int) (json.RawMessage, error) {
+	current := GetSchemaVersion(key)
+
+	if version > current {
+		log.Printf("[store] Value of %v has schema version %v newer than %v.", key, version, current)
+		return raw, nil
+	}
+
+	for ; version < current; version++ {
+		migrations.Lock()
+		migrate := migrations.funcs[key][version]
+		migrations.Unlock()
+
+		log.Printf("[store] Migrating value of %v from schema version %v to %v.", key, version, version+1)
+
+		var err error
+		raw, err = migrate(raw)
+		if err != nil {
+			log.Printf("[store] Failed to migrate value of %v from schema version %v, err:%v.", key, version, err)
+			return nil, err
+		}
+	}
+
+	return raw, nil
+}
+
+// Upgrades a raw value, encrypted or not, to the current schema version.
+func migrateValue(kr *keyring, key string, raw json.RawMessage, version int) (json.RawMessage, error) {
+	plaintext, err := kr.open(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated, err := migrate(key, plaintext, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return kr.seal(migrated)
+}
@@ -8,19 +8,104 @@ import (
 	"time"
 )
 
+const (
+	// Persistent store backends.
+	BackendJson = "json"
+	BackendBolt = "bolt"
+)
+
 // KeyValueStore represents a persistent store of (key,value) pairs.
 type KeyValueStore interface {
 	Read(key string, value interface{}) error
 	Write(key string, value interface{}) error
 	Flush() error
+	Update(fn func(tx Tx) error) error
 	Lock(block bool) error
 	Unlock() error
 	GetModificationTime() (time.Time, error)
+	Watch(key string, stop <-chan struct{}) (<-chan struct{}, error)
+}
+
+// Tx represents a transaction updating several (key,value) pairs of a KeyValueStore atomically.
+type Tx interface {
+	Read(key string, value interface{}) error
+	Write(key string, value interface{}) error
+	Delete(key string) error
+}
+
+// ExtendedKeyValueStore represents a persistent store of (key,value) pairs that can also delete and list keys.
+type ExtendedKeyValueStore interface {
+	KeyValueStore
+	Delete(key string) error
+	ListKeys() ([]string, error)
+}
+
+// TimedLocker represents a persistent store that can be locked for shared or exclusive access with a timeout.
+type TimedLocker interface {
+	LockWithTimeout(exclusive bool, timeout time.Duration) error
+}
+
+// BackupRestorer represents a persistent store that falls back to the previous generation of its
+// contents when the current one is corrupt.
+type BackupRestorer interface {
+	RestoredFromBackup() bool
+}
+
+// CasKeyValueStore represents a store of (key,value) pairs shared by multiple hosts.
+// Each value has a version, and is updated only if it was not modified since it was read.
+type CasKeyValueStore interface {
+	Get(key string, value interface{}) (uint64, error)
+	CompareAndSwap(key string, value interface{}, version uint64) (uint64, error)
 }
 
 var (
 	// Errors returned by KeyValueStore methods.
-	ErrKeyNotFound    = fmt.Errorf("Key not found")
-	ErrStoreLocked    = fmt.Errorf("Store is locked")
-	ErrStoreNotLocked = fmt.Errorf("Store is not locked")
+	ErrKeyNotFound             = fmt.Errorf("Key not found")
+	ErrStoreLocked             = fmt.Errorf("Store is locked")
+	ErrStoreNotLocked          = fmt.Errorf("Store is not locked")
+	ErrStoreNotLockedExclusive = fmt.Errorf("Store is not locked for exclusive access")
+	ErrVersionMismatch         = fmt.Errorf("Key was modified concurrently")
 )
+
+// NewStore creates a new store of the given backend, accessed as a KeyValueStore.
+// The file name is given without extension. Creating a bolt store for the first time
+// migrates the contents of the JSON store with the same file name.
+func NewStore(backend string, fileName string) (KeyValueStore, error) {
+	switch backend {
+	case "", BackendJson:
+		return NewJsonFileStore(fileName + ".json")
+
+	case BackendBolt:
+		kvs, err := NewBoltStore(fileName + ".db")
+		if err != nil {
+			return nil, err
+		}
+
+		// Lock the store so that only one process migrates the JSON store.
+		err = kvs.Lock(true)
+		if err != nil {
+			return nil, err
+		}
+
+		err = MigrateJsonFileStore(fileName+".json", kvs.(ExtendedKeyValueStore))
+		kvs.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		// The migrated file is encrypted along with the store.
+		kvs.(*boltStore).migratedFileName = fileName + ".json" + migratedExtension
+
+		return kvs, nil
+
+	default:
+		return nil, fmt.Errorf("Invalid store backend %v", backend)
+	}
+}
+
+// RestoredFromBackup returns whether the contents of a store were restored from the previous generation
+// because the current one was corrupt. Changes made after the previous generation are lost.
+func RestoredFromBackup(kvs KeyValueStore) bool {
+	br, ok := kvs.(BackupRestorer)
+	return ok && br.RestoredFromBackup()
+}
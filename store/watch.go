@@ -0,0 +1,84 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/Azure/azure-container-networking/log"
+)
+
+// Watches the value of a key in a store file. The read function returns the current value of the key
+// in the file, or nil if it does not exist. The changed function is called before each notification.
+func watchKey(fileName string, key string, read func() (json.RawMessage, error), changed func(),
+	stop <-chan struct{}) (<-chan struct{}, error) {
+
+	fileChanges, err := watchFile(fileName, stop)
+	if err != nil {
+		log.Printf("[store] Failed to watch %v, err:%v.", fileName, err)
+		return nil, err
+	}
+
+	last, _ := read()
+	last = compactValue(last)
+
+	notifications := make(chan struct{}, 1)
+
+	go func() {
+		defer close(notifications)
+
+		for range fileChanges {
+			value, err := read()
+			if err != nil {
+				// The file is read again on its next change, for example when it is unlocked.
+				log.Printf("[store] Failed to read %v from %v, err:%v.", key, fileName, err)
+				continue
+			}
+
+			value = compactValue(value)
+			if bytes.Equal(value, last) {
+				continue
+			}
+
+			last = value
+
+			if changed != nil {
+				changed()
+			}
+
+			select {
+			case notifications <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return notifications, nil
+}
+
+// Returns the compact encoding of a raw value, so that values are compared regardless of formatting.
+func compactValue(raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) != nil {
+		return raw
+	}
+
+	return buf.Bytes()
+}
+
+// Returns the decrypted value of an encrypted raw value, so that a value sealed again with a new
+// nonce is not reported as changed. Values that cannot be decrypted are compared as they are.
+func openWatchedValue(kr *keyring, raw json.RawMessage) json.RawMessage {
+	value, err := kr.open(raw)
+	if err != nil {
+		return raw
+	}
+
+	return value
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build linux
+
+package store
+
+import (
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/Azure/azure-container-networking/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Events on the store directory that may change the store file.
+	// The directory is watched because the JSON store file is replaced on every write,
+	// and modifications are watched because the bolt store file is written in place.
+	watchEvents = unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE
+)
+
+// Watches a file with inotify. Returns a channel that receives a notification
+// each time the file may have changed, until the stop channel is closed.
+func watchFile(fileName string, stop <-chan struct{}) (<-chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = unix.InotifyAddWatch(fd, filepath.Dir(fileName), watchEvents)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// The pipe wakes up the watcher when it is stopped.
+	var pipe [2]int
+	err = unix.Pipe2(pipe[:], unix.O_CLOEXEC)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	go func() {
+		<-stop
+		unix.Write(pipe[1], []byte{0})
+	}()
+
+	changes := make(chan struct{}, 1)
+	name := filepath.Base(fileName)
+
+	go func() {
+		defer close(changes)
+		defer unix.Close(pipe[1])
+		defer unix.Close(pipe[0])
+		defer unix.Close(fd)
+
+		buf := make([]byte, 4096)
+		fds := []unix.PollFd{
+			{Fd: int32(fd), Events: unix.POLLIN},
+			{Fd: int32(pipe[0]), Events: unix.POLLIN},
+		}
+
+		for {
+			_, err := unix.Poll(fds, -1)
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				log.Printf("[store] Failed to watch %v, err:%v.", fileName, err)
+				return
+			}
+
+			if fds[1].Revents != 0 {
+				return
+			}
+
+			n, err := unix.Read(fd, buf)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				log.Printf("[store] Failed to read events for %v, err:%v.", fileName, err)
+				return
+			}
+
+			changed := false
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				offset += unix.SizeofInotifyEvent
+
+				eventName := strings.TrimRight(string(buf[offset:offset+int(event.Len)]), "\x00")
+				offset += int(event.Len)
+
+				if eventName == name {
+					changed = true
+				}
+			}
+
+			if changed {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changes, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Microsoft. All rights reserved.
+// MIT License
+
+// +build windows
+
+package store
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	// Interval between checks of the modification time of watched files.
+	watchInterval = time.Second
+)
+
+// Watches a file by checking its modification time. Returns a channel that receives
+// a notification each time the file may have changed, until the stop channel is closed.
+func watchFile(fileName string, stop <-chan struct{}) (<-chan struct{}, error) {
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer close(changes)
+
+		var modTime time.Time
+		if info, err := os.Stat(fileName); err == nil {
+			modTime = info.ModTime()
+		}
+
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(fileName)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+
+			modTime = info.ModTime()
+
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes, nil
+}
@@ -14,7 +14,6 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/Azure/azure-container-networking/common"
@@ -60,6 +59,20 @@ type BridgeInfo struct {
 	ErrorMessage string
 }
 
+// IPAM pool utilization structure.
+type IpamPoolInfo struct {
+	PoolId   string
+	Capacity int
+	Free     int
+}
+
+// IPAM Details structure.
+type IpamInfo struct {
+	OrphanedAddresses []string
+	LowWatermarkPools []IpamPoolInfo
+	ErrorMessage      string
+}
+
 // Orchestrator Details structure.
 type OrchestratorInfo struct {
 	OrchestratorName    string
@@ -82,6 +95,7 @@ type Report struct {
 	SystemDetails       *SystemInfo
 	InterfaceDetails    *InterfaceInfo
 	BridgeDetails       *BridgeInfo
+	IpamDetails         *IpamInfo
 }
 
 // ReportManager structure.
@@ -300,7 +314,7 @@ func (report *Report) GetInterfaceDetails(queryUrl string) {
 
 // This function  creates a report with orchestrator details(name, version).
 func (report *Report) GetOrchestratorDetails() {
-	out, err := exec.Command("kubectl", "--version").Output()
+	out, err := platform.GetExecutor().Output("kubectl", "--version")
 	if err != nil {
 		report.OrchestratorDetails = &OrchestratorInfo{}
 		report.OrchestratorDetails.ErrorMessage = "kubectl command failed due to " + err.Error()
@@ -5,10 +5,11 @@ package telemetry
 
 import (
 	"fmt"
-	"os/exec"
 	"runtime"
 	"strings"
 	"syscall"
+
+	"github.com/Azure/azure-container-networking/platform"
 )
 
 // Memory Info structure.
@@ -97,7 +98,7 @@ func (report *Report) GetOSDetails() {
 
 	osInfoArr := strings.Split(linesArr[0], " ")
 
-	out, err := exec.Command("uname", "-r").Output()
+	out, err := platform.GetExecutor().Output("uname", "-r")
 	if err != nil {
 		report.OSDetails = &OSInfo{OSType: runtime.GOOS}
 		report.OSDetails.ErrorMessage = "uname -r failed with " + err.Error()